@@ -6,18 +6,29 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	//bencode "github.com/jackpal/bencode-go" // Available if you need it!
 	"os"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/dht"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ipfilter"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/manager"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/proxy"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ratelimit"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/tracker"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
 )
@@ -47,9 +58,9 @@ func printMetaInfo(m *types.Torrent) {
 	}
 }
 
-func GetPeers(m *types.Torrent) (*types.PeerSpec, error) {
+func GetPeers(ctx context.Context, m *types.Torrent) (*types.PeerSpec, error) {
 	client := tracker.NewClient()
-	return client.GetPeers(PeerID, 6881, m)
+	return client.GetPeers(ctx, PeerID, 6881, m)
 }
 
 func FatalExit(format string, args ...interface{}) {
@@ -57,7 +68,201 @@ func FatalExit(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// parseRate parses a rate in bytes per second like 512K or 2M. The suffixes are powers of 1024.
+func parseRate(v string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(strings.ToUpper(v), "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(strings.ToUpper(v), "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(strings.ToUpper(v), "G"):
+		multiplier = 1 << 30
+	}
+	digits := v
+	if multiplier > 1 {
+		digits = v[:len(v)-1]
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", v)
+	}
+	return n * multiplier, nil
+}
+
+// setLimits limits the download and upload rate of the manager for the --max-down and --max-up flags
+func setLimits(m *manager.TorrentManager, maxDown, maxUp string) {
+	if maxDown != "" {
+		rate, err := parseRate(maxDown)
+		if err != nil {
+			FatalExit("invalid --max-down: %v", err)
+		}
+		m.DownloadLimiter = ratelimit.NewLimiter(rate, nil)
+	}
+	if maxUp != "" {
+		rate, err := parseRate(maxUp)
+		if err != nil {
+			FatalExit("invalid --max-up: %v", err)
+		}
+		m.UploadLimiter = ratelimit.NewLimiter(rate, nil)
+	}
+}
+
+// parseFlags parses the flags in args wherever they are, so they can come before or after the positional
+// arguments, and returns the positional arguments. Everything after -- is positional.
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for len(args) > 0 {
+		flags.Parse(args)
+		rest := flags.Args()
+		// the flag package drops the -- that ends the flags
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional
+}
+
+// setNetwork makes the connections of the manager from the local address of the --bind flag and through
+// the proxies of the --proxy and --tracker-proxy flags. Trackers use the tracker proxy when there is one
+// and the proxy otherwise.
+func setNetwork(m *manager.TorrentManager, bind, proxyURL, trackerProxyURL string) {
+	var direct proxy.Dialer
+	if bind != "" {
+		local, err := proxy.Local(bind)
+		if err != nil {
+			FatalExit("invalid --bind: %v", err)
+		}
+		direct = local
+	}
+	peers, trackers := direct, direct
+	if proxyURL != "" {
+		d, err := proxy.Parse(proxyURL, direct)
+		if err != nil {
+			FatalExit("invalid --proxy: %v", err)
+		}
+		peers, trackers = d, d
+	}
+	if trackerProxyURL != "" {
+		d, err := proxy.Parse(trackerProxyURL, direct)
+		if err != nil {
+			FatalExit("invalid --tracker-proxy: %v", err)
+		}
+		trackers = d
+	}
+	m.Dialer = peers
+	m.Tracker.Dialer = trackers
+}
+
+// setDHT looks up more peers on the DHT the same way the manager connects to peers: through the proxy
+// of the --proxy flag when it can relay UDP, or from the local address of the --bind flag
+func setDHT(m *manager.TorrentManager) {
+	m.DHT = dht.NewClient()
+	switch d := m.Dialer.(type) {
+	case nil:
+	case proxy.PacketDialer:
+		m.DHT.Listen = d.ListenPacket
+	case *net.Dialer:
+		addr := &net.UDPAddr{IP: d.LocalAddr.(*net.TCPAddr).IP}
+		m.DHT.Listen = func(ctx context.Context) (net.PacketConn, error) {
+			return net.ListenUDP("udp4", addr)
+		}
+	default:
+		FatalExit("--dht needs a socks5 --proxy, the proxy can't relay UDP")
+	}
+}
+
+// watchPeers prints the peers of the download to stderr every interval until ctx is done
+func watchPeers(ctx context.Context, m *manager.TorrentManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			printPeers(os.Stderr, m.Peers())
+		}
+	}
+}
+
+func printPeers(out io.Writer, peers []peer.Stats) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tCLIENT\tDOWN\tUP\tDOWNLOADED\tOVERHEAD\tLATENCY\tUNCHOKED\tPIECES\tREQUESTS")
+	for _, p := range peers {
+		client := p.Client
+		if client == "" {
+			client = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s/s\t%s/s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			p.Peer, client, formatBytes(int64(p.DownloadRate)), formatBytes(int64(p.UploadRate)),
+			formatBytes(p.PayloadIn), formatBytes(p.OverheadIn),
+			p.Latency.Round(time.Millisecond), p.Unchoked.Round(time.Second), p.Pieces, p.PendingRequests)
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "K", "M", "G"}
+	v, unit := float64(n), 0
+	for v >= 1024 && unit < len(units)-1 {
+		v /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", v, units[unit])
+}
+
+// setupLogging parses the flags that come before the command and sets up the default logger all
+// packages log to. Logs go to stderr so they don't mix with the output of commands.
+func setupLogging() {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	level := flags.String("log-level", "info", "level to log at: debug, info, warn or error")
+	flags.Parse(os.Args[1:])
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(*level)); err != nil {
+		FatalExit("invalid --log-level: %v", err)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+
+	os.Args = append(os.Args[:1], flags.Args()...)
+	if len(os.Args) < 2 {
+		FatalExit("usage: %s [--log-level <level>] <command> [args]", os.Args[0])
+	}
+}
+
+// shutdownContext returns a context that is cancelled on SIGINT or SIGTERM, so that downloads get to save
+// their progress before the process exits. A second signal kills the process right away.
+func shutdownContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		slog.Info("shutting down")
+		stop()
+	}()
+	return ctx
+}
+
+// downloadFailed exits for a failed download. Downloads that were interrupted saved their progress.
+func downloadFailed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		FatalExit("download interrupted - run the command again to continue where it left off")
+	}
+	FatalExit("download failure: %v", err)
+}
+
 func main() {
+	setupLogging()
+	ctx := shutdownContext()
 	command := os.Args[1]
 
 	switch command {
@@ -94,7 +299,7 @@ func main() {
 				FatalExit("failed to read torrent %q: %v", os.Args[2], err)
 			}
 
-			spec, err := GetPeers(t)
+			spec, err := GetPeers(ctx, t)
 			if err != nil {
 				FatalExit("failed to get peers: %v", err)
 			}
@@ -115,10 +320,9 @@ func main() {
 				FatalExit("failed to read torrent %q: %v", os.Args[2], err)
 			}
 
-			bctx := context.Background()
-			ctx, cancel := context.WithTimeout(bctx, 10*time.Second)
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 			defer cancel()
-			client, err := peer.NewClient(ctx, PeerID, p, t)
+			client, err := peer.NewClient(ctx, PeerID, p, t, nil)
 			if err != nil {
 				FatalExit("failed to create client: %v", err)
 			}
@@ -142,19 +346,18 @@ func main() {
 				FatalExit("failed to read torrent %q: %v", os.Args[2], err)
 			}
 
-			peers, err := GetPeers(t)
+			peers, err := GetPeers(ctx, t)
 			if err != nil {
-				FatalExit("failed to get peers: %v", os.Args[2], err)
+				FatalExit("failed to get peers: %v", err)
 			}
 
-			println("connecting to peers")
+			slog.Info("connecting to peers")
 			var client *peer.Client
 			var clientErr error
 			for _, p := range peers.Peers {
-				bctx := context.Background()
-				ctx, cancel := context.WithTimeout(bctx, 10*time.Second)
+				ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 				defer cancel()
-				client, clientErr = peer.NewClient(ctx, PeerID, p, t)
+				client, clientErr = peer.NewClient(ctx, PeerID, p, t, nil)
 				if clientErr != nil {
 					cancel()
 					continue
@@ -169,9 +372,7 @@ func main() {
 			}
 			defer client.Close()
 
-			println("connected")
-
-			println("starting download of piece")
+			slog.Info("starting download of piece", "peer", client.Peer.String(), "piece", pieceIdx)
 
 			plan := t.BlockPlan(pieceIdx, manager.MaxBlockSize)
 			if b, err := client.DownloadPiece(plan); err != nil {
@@ -197,24 +398,145 @@ func main() {
 			dst := os.Args[3]
 
 			m := manager.NewTorrentManager(PeerID, t)
-			if err := m.Download(t, dst); err != nil {
-				FatalExit("download failure: %v", err)
+			if err := m.Download(ctx, t, dst); err != nil {
+				downloadFailed(ctx, err)
 			}
 		}
 	case "download":
 		{
-			dst := os.Args[3]
-			torrentFile := os.Args[4]
+			flags := flag.NewFlagSet("download", flag.ExitOnError)
+			dst := flags.String("o", "", "where to download the torrent to")
+			only := flags.String("only", "", "only download the files matching the glob")
+			maxDown := flags.String("max-down", "", "download limit in bytes per second, with an optional K, M or G suffix")
+			maxUp := flags.String("max-up", "", "upload limit in bytes per second, with an optional K, M or G suffix")
+			proxyURL := flags.String("proxy", "", "connect to peers and trackers through this socks5:// or http:// proxy")
+			trackerProxyURL := flags.String("tracker-proxy", "", "connect to trackers through this socks5:// or http:// proxy")
+			bind := flags.String("bind", "", "make every connection from this local IP address or network interface")
+			peers := flags.Duration("peers", 0, "print the connected peers to stderr at this interval")
+			blocklist := flags.String("blocklist", "", "don't talk to the addresses in this eMule .dat, PeerGuardian .p2p or CIDR list")
+			useDHT := flags.Bool("dht", false, "look up more peers on the DHT unless the torrent is private")
+			args := parseFlags(flags, os.Args[2:])
+			if len(args) != 1 || *dst == "" {
+				FatalExit("usage: %s download -o <dst> [--only <glob>] [--max-down <rate>] [--max-up <rate>] [--peers <interval>] [--blocklist <file>] [--proxy <url>] [--tracker-proxy <url>] [--bind <addr>] [--dht] <torrent>", os.Args[0])
+			}
+			torrentFile := args[0]
 			t, err := encoding.DecodeTorrent(torrentFile)
 			if err != nil {
-				FatalExit("failed to read torrent %q: %v", os.Args[2], err)
+				FatalExit("failed to read torrent %q: %v", torrentFile, err)
 			}
 
 			m := manager.NewTorrentManager(PeerID, t)
-			if err := m.Download(t, dst); err != nil {
-				FatalExit("download failure: %v", err)
+			setLimits(m, *maxDown, *maxUp)
+			setNetwork(m, *bind, *proxyURL, *trackerProxyURL)
+			if *useDHT {
+				setDHT(m)
+				defer m.DHT.Close()
+			}
+			if *only != "" {
+				m.Files, err = manager.OnlyFiles(t, *only)
+				if err != nil {
+					FatalExit("invalid --only: %v", err)
+				}
+			}
+			if *blocklist != "" {
+				m.Blocklist, err = ipfilter.Load(*blocklist)
+				if err != nil {
+					FatalExit("invalid --blocklist: %v", err)
+				}
+				slog.Info("loaded blocklist", "ranges", m.Blocklist.Len())
+			}
+			if *peers > 0 {
+				go watchPeers(ctx, m, *peers)
+			}
+			if err := m.Download(ctx, t, *dst); err != nil {
+				downloadFailed(ctx, err)
+			}
+			fmt.Printf("downloaded %s to %s\n", torrentFile, *dst)
+		}
+	case "stream":
+		{
+			if len(os.Args) < 3 {
+				FatalExit("usage: %s stream <torrent> [--http <addr>] [-o <dst>]", os.Args[0])
+			}
+			torrentFile := os.Args[2]
+			t, err := encoding.DecodeTorrent(torrentFile)
+			if err != nil {
+				FatalExit("failed to read torrent %q: %v", torrentFile, err)
+			}
+			flags := flag.NewFlagSet("stream", flag.ExitOnError)
+			addr := flags.String("http", ":8080", "address to serve the files of the torrent on")
+			dst := flags.String("o", t.Name, "where to download the torrent to")
+			maxDown := flags.String("max-down", "", "download limit in bytes per second, with an optional K, M or G suffix")
+			maxUp := flags.String("max-up", "", "upload limit in bytes per second, with an optional K, M or G suffix")
+			proxyURL := flags.String("proxy", "", "connect to peers and trackers through this socks5:// or http:// proxy")
+			trackerProxyURL := flags.String("tracker-proxy", "", "connect to trackers through this socks5:// or http:// proxy")
+			bind := flags.String("bind", "", "make every connection from this local IP address or network interface")
+			flags.Parse(os.Args[3:])
+
+			m := manager.NewTorrentManager(PeerID, t)
+			m.Sequential = true
+			setLimits(m, *maxDown, *maxUp)
+			setNetwork(m, *bind, *proxyURL, *trackerProxyURL)
+			if err := m.Start(ctx, t, *dst); err != nil {
+				FatalExit("failed to start download: %v", err)
+			}
+			go func() {
+				if err := m.Wait(ctx); err != nil {
+					if ctx.Err() == nil {
+						fmt.Printf("download failure: %v\n", err)
+					}
+					return
+				}
+				fmt.Printf("downloaded %s to %s\n", torrentFile, *dst)
+			}()
+
+			srv := &http.Server{Addr: *addr, Handler: m}
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), manager.StopTimeout)
+				defer cancel()
+				srv.Shutdown(shutdownCtx)
+			}()
+			fmt.Printf("serving %s on %s\n", t.Name, *addr)
+			serveErr := srv.ListenAndServe()
+			if err := m.Stop(); err != nil {
+				slog.Warn("failed to save resume data", "err", err)
+			}
+			if serveErr != http.ErrServerClosed {
+				FatalExit("failed to serve: %v", serveErr)
+			}
+		}
+	case "verify":
+		{
+			if len(os.Args) < 4 {
+				FatalExit("usage: %s verify <torrent> <path>", os.Args[0])
+			}
+			torrentFile := os.Args[2]
+			t, err := encoding.DecodeTorrent(torrentFile)
+			if err != nil {
+				FatalExit("failed to read torrent %q: %v", torrentFile, err)
+			}
+			dst := os.Args[3]
+
+			m := manager.NewTorrentManager(PeerID, t)
+			result, err := m.Recheck(ctx, t, dst)
+			if err != nil {
+				FatalExit("failed to verify %s: %v", dst, err)
+			}
+
+			good := 0
+			for i := 0; i < t.GetPieceCount(); i++ {
+				if result.Pieces.Has(i) {
+					good++
+				}
+			}
+			for _, f := range result.Files {
+				fmt.Printf("%-8s %s (%d/%d pieces)\n", f.Status, f.Path, f.Good, f.Total)
+			}
+			fmt.Printf("%d/%d pieces ok\n", good, t.GetPieceCount())
+			if !result.Complete() {
+				os.Exit(1)
 			}
-			fmt.Printf("downloaded %s to %s\n", torrentFile, dst)
 		}
 	default:
 		{
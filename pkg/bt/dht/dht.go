@@ -0,0 +1,435 @@
+// Package dht finds peers for torrents on the mainline DHT (BEP 5). The client only looks peers up: it
+// tells the nodes it asks that it is read-only (BEP 43), so they don't add it to their routing tables or
+// send it queries, and it doesn't announce itself. Only IPv4 nodes and peers are used.
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+const (
+	// K is how many of the nodes closest to an info hash a lookup asks before it is done
+	K = 8
+	// Alpha is how many nodes a lookup asks at the same time
+	Alpha = 3
+	// QueryTimeout is how long a node has to answer a query
+	QueryTimeout = 2 * time.Second
+	// MaxQueries caps the nodes a single lookup asks
+	MaxQueries = 100
+	// maxNodes is how many nodes that answered are remembered for later lookups
+	maxNodes = 256
+)
+
+// DefaultBootstrap are the nodes lookups start from while no other nodes are known
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var ErrNoNodes = fmt.Errorf("no dht node answered")
+var ErrClosed = fmt.Errorf("dht client closed")
+
+// node is a DHT node we know the address of. Bootstrap nodes have no ID until they answer.
+type node struct {
+	id    [20]byte
+	hasID bool
+	addr  *net.UDPAddr
+}
+
+// Client looks up peers on the DHT. The socket is opened by the first lookup and the nodes that answer
+// are remembered for the next ones. Share one client between downloads.
+type Client struct {
+	// Bootstrap are the host:port addresses of the nodes lookups start from when no other nodes are known
+	Bootstrap []string
+	// Listen opens the socket queries are sent from, a UDP socket on any port when it is nil. Set it
+	// before the first lookup.
+	Listen func(ctx context.Context) (net.PacketConn, error)
+	// Logger is where lookups are logged, the default logger is used when it is nil
+	Logger *slog.Logger
+
+	id   [20]byte
+	done chan struct{}
+
+	mu      sync.Mutex
+	conn    net.PacketConn
+	tx      uint16
+	pending map[string]*call
+	nodes   map[string]*node
+	closed  bool
+}
+
+// call is a query that waits for its answer
+type call struct {
+	addr  string
+	reply chan map[string]interface{}
+}
+
+func NewClient() *Client {
+	c := &Client{
+		Bootstrap: DefaultBootstrap,
+		done:      make(chan struct{}),
+		pending:   map[string]*call{},
+		nodes:     map[string]*node{},
+	}
+	rand.Read(c.id[:])
+	return c
+}
+
+func (c *Client) log() *slog.Logger {
+	return bt.Logger(c.Logger)
+}
+
+// open returns the socket, which is opened and read from on first use
+func (c *Client) open(ctx context.Context) (net.PacketConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	var conn net.PacketConn
+	var err error
+	if c.Listen != nil {
+		conn, err = c.Listen(ctx)
+	} else {
+		conn, err = net.ListenPacket("udp4", ":0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.read(conn)
+	return conn, nil
+}
+
+// read hands the answers that come in on conn to the queries waiting for them. A socket that fails is
+// dropped, so that the next query opens another one.
+func (c *Client) read(conn net.PacketConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.mu.Lock()
+			if c.conn == conn {
+				c.conn = nil
+			}
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		v, err := encoding.DecodeBencode(encoding.NewBencodeReader(string(buf[:n])))
+		if err != nil {
+			continue
+		}
+		msg, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		t, _ := msg["t"].(string)
+		c.mu.Lock()
+		pending, ok := c.pending[t]
+		if ok && pending.addr == from.String() {
+			delete(c.pending, t)
+			pending.reply <- msg
+		}
+		c.mu.Unlock()
+	}
+}
+
+// query sends a query to the node and returns the dictionary of its answer
+func (c *Client) query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	conn, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.tx++
+	t := string([]byte{byte(c.tx >> 8), byte(c.tx)})
+	pending := &call{addr: addr.String(), reply: make(chan map[string]interface{}, 1)}
+	c.pending[t] = pending
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.pending[t] == pending {
+			delete(c.pending, t)
+		}
+		c.mu.Unlock()
+	}()
+
+	args["id"] = string(c.id[:])
+	data, err := encoding.NewBenEncoder().Encode(map[string]interface{}{
+		"t":  t,
+		"y":  "q",
+		"q":  method,
+		"a":  args,
+		"ro": 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(data, addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(QueryTimeout)
+	defer timer.Stop()
+	var msg map[string]interface{}
+	select {
+	case msg = <-pending.reply:
+	case <-timer.C:
+		return nil, fmt.Errorf("%s timed out", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+
+	switch msg["y"] {
+	case "r":
+		r, ok := msg["r"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("malformed answer from %s", addr)
+		}
+		return r, nil
+	case "e":
+		return nil, fmt.Errorf("%s answered with error %v", addr, msg["e"])
+	}
+	return nil, fmt.Errorf("unexpected message from %s", addr)
+}
+
+// GetPeers looks up the peers of the torrent with the info hash. It asks the nodes closest to the info
+// hash it can find, Alpha at a time, until the K closest ones answered, and returns every peer they
+// know of.
+func (c *Client) GetPeers(ctx context.Context, hash [20]byte) ([]*types.Peer, error) {
+	candidates := c.known()
+	if len(candidates) < K {
+		candidates = append(candidates, c.bootstrap(ctx)...)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	queried := map[string]bool{}
+	for _, n := range candidates {
+		queried[n.addr.String()] = false
+	}
+	peers := map[string]*types.Peer{}
+	answered, queries := 0, 0
+	var lastErr error
+	for queries < MaxQueries {
+		sortByDistance(candidates, hash)
+		batch := []*node{}
+		for i := 0; i < len(candidates) && i < K && len(batch) < Alpha; i++ {
+			if !queried[candidates[i].addr.String()] {
+				batch = append(batch, candidates[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make([]map[string]interface{}, len(batch))
+		errs := make([]error, len(batch))
+		wg := &sync.WaitGroup{}
+		for i, n := range batch {
+			queried[n.addr.String()] = true
+			queries++
+			wg.Add(1)
+			go func(i int, n *node) {
+				defer wg.Done()
+				results[i], errs[i] = c.query(ctx, n.addr, "get_peers", map[string]interface{}{"info_hash": string(hash[:])})
+			}(i, n)
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for i, n := range batch {
+			if errs[i] != nil {
+				lastErr = errs[i]
+				c.forget(n)
+				candidates = remove(candidates, n)
+				continue
+			}
+			answered++
+			r := results[i]
+			if id, ok := r["id"].(string); ok && len(id) == 20 {
+				copy(n.id[:], id)
+				n.hasID = true
+				c.remember(n)
+			}
+			for _, p := range parseValues(r["values"]) {
+				peers[p.String()] = p
+			}
+			for _, found := range parseNodes(r["nodes"]) {
+				if _, ok := queried[found.addr.String()]; !ok {
+					queried[found.addr.String()] = false
+					candidates = append(candidates, found)
+				}
+			}
+		}
+	}
+	if answered == 0 {
+		if lastErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNoNodes, lastErr)
+		}
+		return nil, ErrNoNodes
+	}
+
+	found := make([]*types.Peer, 0, len(peers))
+	for _, p := range peers {
+		found = append(found, p)
+	}
+	c.log().Debug("dht lookup done", bt.InfoHash(hash), "peers", len(found), "queries", queries)
+	return found, nil
+}
+
+// known returns the nodes that answered earlier lookups
+func (c *Client) known() []*node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := make([]*node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		copied := *n
+		nodes = append(nodes, &copied)
+	}
+	return nodes
+}
+
+func (c *Client) remember(n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[n.addr.String()]; ok || len(c.nodes) < maxNodes {
+		copied := *n
+		c.nodes[n.addr.String()] = &copied
+	}
+}
+
+func (c *Client) forget(n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.nodes, n.addr.String())
+}
+
+// bootstrap resolves the bootstrap nodes. Nodes that don't resolve are left out.
+func (c *Client) bootstrap(ctx context.Context) []*node {
+	nodes := []*node{}
+	for _, address := range c.Bootstrap {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			c.log().Debug("invalid dht bootstrap node", "node", address, "err", err)
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			c.log().Debug("invalid dht bootstrap node", "node", address, "err", err)
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			c.log().Debug("failed to resolve dht bootstrap node", "node", address, "err", err)
+			continue
+		}
+		for _, addr := range addrs {
+			if ip4 := addr.IP.To4(); ip4 != nil {
+				nodes = append(nodes, &node{addr: &net.UDPAddr{IP: ip4, Port: port}})
+				break
+			}
+		}
+	}
+	return nodes
+}
+
+// Close stops the lookups and closes the socket
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// sortByDistance sorts the nodes by their XOR distance to the target, nodes without an ID last
+func sortByDistance(nodes []*node, target [20]byte) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a.hasID != b.hasID {
+			return a.hasID
+		}
+		var da, db [20]byte
+		for k := range target {
+			da[k] = a.id[k] ^ target[k]
+			db[k] = b.id[k] ^ target[k]
+		}
+		return bytes.Compare(da[:], db[:]) < 0
+	})
+}
+
+func remove(nodes []*node, n *node) []*node {
+	for i, other := range nodes {
+		if other == n {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+	return nodes
+}
+
+// parseValues parses the compact peers of a get_peers answer, 6 bytes each
+func parseValues(v interface{}) []*types.Peer {
+	list, _ := v.([]interface{})
+	peers := []*types.Peer{}
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+		peers = append(peers, &types.Peer{
+			IP:   net.IPv4(s[0], s[1], s[2], s[3]),
+			Port: int(binary.BigEndian.Uint16([]byte(s[4:6]))),
+		})
+	}
+	return peers
+}
+
+// parseNodes parses the compact nodes of an answer, 26 bytes each: the ID, the IPv4 address and the port
+func parseNodes(v interface{}) []*node {
+	s, _ := v.(string)
+	nodes := []*node{}
+	for i := 0; i+26 <= len(s); i += 26 {
+		n := &node{hasID: true}
+		copy(n.id[:], s[i:i+20])
+		ip := net.IPv4(s[i+20], s[i+21], s[i+22], s[i+23])
+		port := int(binary.BigEndian.Uint16([]byte(s[i+24 : i+26])))
+		if port == 0 {
+			continue
+		}
+		n.addr = &net.UDPAddr{IP: ip.To4(), Port: port}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
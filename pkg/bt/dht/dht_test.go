@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
+)
+
+// fakeNode is a DHT node that answers get_peers with the nodes and peers it is given
+type fakeNode struct {
+	id      [20]byte
+	conn    net.PacketConn
+	nodes   []*fakeNode
+	peers   []*net.TCPAddr
+	queries chan map[string]interface{}
+}
+
+func newFakeNode(t *testing.T, id byte, peers []*net.TCPAddr, nodes ...*fakeNode) *fakeNode {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	n := &fakeNode{conn: conn, nodes: nodes, peers: peers, queries: make(chan map[string]interface{}, 10)}
+	n.id[0] = id
+	go n.serve()
+	return n
+}
+
+func (n *fakeNode) addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (n *fakeNode) serve() {
+	buf := make([]byte, 2048)
+	for {
+		size, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		v, err := encoding.DecodeBencode(encoding.NewBencodeReader(string(buf[:size])))
+		if err != nil {
+			continue
+		}
+		msg := v.(map[string]interface{})
+		n.queries <- msg
+
+		var nodes []byte
+		for _, other := range n.nodes {
+			addr := other.addr()
+			nodes = append(nodes, other.id[:]...)
+			nodes = append(nodes, addr.IP.To4()...)
+			nodes = binary.BigEndian.AppendUint16(nodes, uint16(addr.Port))
+		}
+		values := []interface{}{}
+		for _, p := range n.peers {
+			value := append([]byte{}, p.IP.To4()...)
+			values = append(values, string(binary.BigEndian.AppendUint16(value, uint16(p.Port))))
+		}
+		r := map[string]interface{}{"id": string(n.id[:]), "token": "tok", "nodes": string(nodes)}
+		if len(values) > 0 {
+			r["values"] = values
+		}
+		data, _ := encoding.NewBenEncoder().Encode(map[string]interface{}{"t": msg["t"], "y": "r", "r": r})
+		n.conn.WriteTo(data, from)
+	}
+}
+
+func TestGetPeers(t *testing.T) {
+	peer := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	near := newFakeNode(t, 0x01, []*net.TCPAddr{peer})
+	router := newFakeNode(t, 0xf0, nil, near)
+
+	c := NewClient()
+	c.Bootstrap = []string{router.addr().String()}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hash := [20]byte{0x01, 0x02}
+	peers, err := c.GetPeers(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].String() != peer.String() {
+		t.Fatalf("expected %s got %v", peer, peers)
+	}
+
+	q := <-router.queries
+	if q["q"] != "get_peers" || q["ro"] != 1 {
+		t.Errorf("expected a read-only get_peers query got %v", q)
+	}
+	if args := q["a"].(map[string]interface{}); args["info_hash"] != string(hash[:]) {
+		t.Errorf("expected the info hash to be asked for got %q", args["info_hash"])
+	}
+
+	// nodes that answered are asked first the next time
+	if known := c.known(); len(known) != 2 {
+		t.Errorf("expected both nodes to be remembered got %d", len(known))
+	}
+}
+
+func TestGetPeersWithoutNodes(t *testing.T) {
+	// nothing listens there, so the query times out
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	c := NewClient()
+	c.Bootstrap = []string{addr}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetPeers(ctx, [20]byte{}); err == nil {
+		t.Fatalf("expected the lookup to fail without nodes")
+	}
+
+	c.Bootstrap = nil
+	if _, err := c.GetPeers(context.Background(), [20]byte{}); err != ErrNoNodes {
+		t.Fatalf("expected %v got %v", ErrNoNodes, err)
+	}
+}
@@ -93,7 +93,10 @@ func DecodeTorrent(filename string) (*bttypes.Torrent, error) {
 
 		for _, item := range fileList {
 			fileDict := item.(map[string]interface{})
-			m.Files = append(m.Files, newFileInfo(fileDict))
+			f := newFileInfo(fileDict)
+			m.Files = append(m.Files, f)
+			// pieces run across file boundaries, so the torrent is as long as all its files together
+			m.Length += f.Length
 		}
 	}
 
@@ -55,6 +55,9 @@ func (b *BencodeReader) ReadString() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if length < 0 || length > b.input.Len() {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
 	// now we can read the string with the length that we got
 	data := make([]byte, length)
 	n, err := b.input.Read(data)
@@ -93,6 +93,13 @@ func TestReadString(t *testing.T) {
 				return err != nil, "expected err for string without colon"
 			},
 		},
+		{
+			"-1:w",
+			"",
+			func(err error) (bool, string) {
+				return err != nil, "expected err for negative length"
+			},
+		},
 	}
 
 	for _, tc := range tt {
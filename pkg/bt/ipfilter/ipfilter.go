@@ -0,0 +1,225 @@
+// Package ipfilter decides which IP addresses we talk to. A Filter holds blocked address ranges, which
+// can be loaded from eMule .dat files, PeerGuardian .p2p files and lists of CIDR blocks or single
+// addresses, and looks addresses up with a binary search over the merged ranges.
+package ipfilter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxDatLevel is the highest access level of an eMule .dat entry that is blocked. Entries above it are
+// allowed, like eMule does.
+const MaxDatLevel = 127
+
+var ErrInvalidLine = fmt.Errorf("invalid blocklist line")
+
+// Range is the addresses from From up to and including To
+type Range struct {
+	From netip.Addr
+	To   netip.Addr
+}
+
+func (r Range) String() string {
+	return r.From.String() + "-" + r.To.String()
+}
+
+// Filter is a set of blocked address ranges. A nil Filter blocks nothing. It is not changed after it is
+// created, so it is safe for concurrent use.
+type Filter struct {
+	// ranges are sorted and don't overlap
+	ranges []Range
+}
+
+// New returns a filter that blocks the ranges
+func New(ranges ...Range) *Filter {
+	sorted := []Range{}
+	for _, r := range ranges {
+		r.From, r.To = r.From.Unmap(), r.To.Unmap()
+		if !r.From.IsValid() || !r.To.IsValid() || r.From.Is4() != r.To.Is4() || r.To.Less(r.From) {
+			continue
+		}
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].From.Less(sorted[j].From)
+	})
+
+	merged := []Range{}
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && merged[n-1].From.Is4() == r.From.Is4() && !merged[n-1].To.Less(r.From.Prev()) {
+			if merged[n-1].To.Less(r.To) {
+				merged[n-1].To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return &Filter{ranges: merged}
+}
+
+// Load reads a blocklist file, which may be gzipped
+func Load(path string) (*Filter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	filter, err := Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return filter, nil
+}
+
+// Parse reads a blocklist with one entry per line. Each line can be in any of these formats:
+//
+//	1.2.3.0 - 1.2.3.255 , 000 , description   (eMule .dat)
+//	description:1.2.3.0-1.2.3.255              (PeerGuardian .p2p)
+//	1.2.3.0/24                                 (CIDR)
+//	1.2.3.0-1.2.3.255
+//	1.2.3.4
+//
+// Empty lines and lines starting with # or // are skipped.
+func Parse(r io.Reader) (*Filter, error) {
+	ranges := []Range{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, ok, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if ok {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return New(ranges...), nil
+}
+
+// parseLine parses a single entry. It reports false for entries that don't block anything.
+func parseLine(line string) (Range, bool, error) {
+	if prefix, err := netip.ParsePrefix(line); err == nil {
+		prefix = prefix.Masked()
+		return Range{From: prefix.Addr(), To: lastAddr(prefix)}, true, nil
+	}
+	if addr, err := netip.ParseAddr(line); err == nil {
+		return Range{From: addr, To: addr}, true, nil
+	}
+
+	// eMule: range , level , description
+	if fields := strings.SplitN(line, ",", 3); len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		r, rangeErr := parseRange(fields[0])
+		if err == nil && rangeErr == nil {
+			return r, level <= MaxDatLevel, nil
+		}
+	}
+
+	// PeerGuardian: description:range, where the description may contain colons and commas itself
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if r, err := parseRange(line[i+1:]); err == nil {
+			return r, true, nil
+		}
+	}
+
+	r, err := parseRange(line)
+	return r, err == nil, err
+}
+
+// parseRange parses from-to. eMule lists pad addresses with zeros, like 001.002.003.004.
+func parseRange(s string) (Range, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Range{}, fmt.Errorf("%w: %q", ErrInvalidLine, s)
+	}
+	var r Range
+	var err error
+	if r.From, err = parseAddr(from); err != nil {
+		return Range{}, err
+	}
+	if r.To, err = parseAddr(to); err != nil {
+		return Range{}, err
+	}
+	return r, nil
+}
+
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr, nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, fmt.Errorf("%w: invalid address %q", ErrInvalidLine, s)
+	}
+	var ip [4]byte
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("%w: invalid address %q", ErrInvalidLine, s)
+		}
+		ip[i] = byte(v)
+	}
+	return netip.AddrFrom4(ip), nil
+}
+
+// lastAddr returns the last address of a masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Blocked reports whether the address is in one of the blocked ranges
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil || len(f.ranges) == 0 {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	// IPv4 addresses sort before IPv6 ones, so the first range that ends at or after the address is the
+	// only one that can hold it
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return !f.ranges[i].To.Less(addr)
+	})
+	return i < len(f.ranges) && !addr.Less(f.ranges[i].From)
+}
+
+// Len returns the number of ranges after overlapping ones were merged
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.ranges)
+}
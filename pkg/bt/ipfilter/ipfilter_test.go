@@ -0,0 +1,71 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	list := `# comment
+// another comment
+
+001.002.003.000 - 001.002.003.255 , 000 , eMule range
+005.000.000.000 - 005.255.255.255 , 200 , allowed eMule range
+Some Org, Inc: Office:10.0.0.0-10.0.0.127
+192.168.0.0/16
+8.8.8.8
+20.0.0.0-20.0.0.9
+20.0.0.10-20.0.0.20
+2001:db8::/32
+`
+	f, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{ip: "1.2.3.0", blocked: true},
+		{ip: "1.2.3.255", blocked: true},
+		{ip: "1.2.4.0", blocked: false},
+		{ip: "5.1.1.1", blocked: false},
+		{ip: "10.0.0.127", blocked: true},
+		{ip: "10.0.0.128", blocked: false},
+		{ip: "192.168.10.20", blocked: true},
+		{ip: "192.169.0.0", blocked: false},
+		{ip: "8.8.8.8", blocked: true},
+		{ip: "8.8.8.9", blocked: false},
+		{ip: "20.0.0.15", blocked: true},
+		{ip: "::ffff:1.2.3.4", blocked: true},
+		{ip: "2001:db8::1", blocked: true},
+		{ip: "2001:db9::1", blocked: false},
+		{ip: "255.255.255.255", blocked: false},
+	}
+	for _, tt := range tests {
+		if got := f.Blocked(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("Blocked(%s): expected %t got %t", tt.ip, tt.blocked, got)
+		}
+	}
+	// the adjacent 20.0.0.x ranges are merged
+	if f.Len() != 6 {
+		t.Errorf("expected 6 ranges got %d", f.Len())
+	}
+}
+
+func TestParseInvalidLine(t *testing.T) {
+	_, err := Parse(strings.NewReader("1.2.3.4/8\nnot an address\n"))
+	if !errors.Is(err, ErrInvalidLine) || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected %v on line 2 got %v", ErrInvalidLine, err)
+	}
+}
+
+func TestNilFilterBlocksNothing(t *testing.T) {
+	var f *Filter
+	if f.Blocked(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("nil filter should not block anything")
+	}
+}
@@ -0,0 +1,27 @@
+package bt
+
+import (
+	"encoding/hex"
+	"log/slog"
+)
+
+// Keys of the attributes that are attached to log records across packages
+const (
+	PeerKey     = "peer"
+	InfoHashKey = "info_hash"
+	PieceKey    = "piece"
+	MessageKey  = "message"
+)
+
+// Logger returns l, or the default logger when l is nil
+func Logger(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// InfoHash returns the attribute for an info hash
+func InfoHash(hash [20]byte) slog.Attr {
+	return slog.String(InfoHashKey, hex.EncodeToString(hash[:]))
+}
@@ -0,0 +1,142 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventBuffer is how many events a subscriber can fall behind before events are dropped for it
+const EventBuffer = 256
+
+// EventType says what happened in an Event
+type EventType int
+
+const (
+	// PieceCompleted is published when a piece was verified and written to storage
+	PieceCompleted EventType = iota
+	// PieceFailed is published when a piece doesn't match its hash and has to be downloaded again
+	PieceFailed
+	// PeerConnected is published when a peer is used for the download for the first time
+	PeerConnected
+	// PeerDisconnected is published when the connection to a peer is closed
+	PeerDisconnected
+	// TrackerAnnounced is published after every announce, Err is set when it failed
+	TrackerAnnounced
+	// StateChanged is published when the State of the download changes
+	StateChanged
+	// PeerBanned is published when a peer sent corrupt data and is banned
+	PeerBanned
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PieceCompleted:
+		return "piece-completed"
+	case PieceFailed:
+		return "piece-failed"
+	case PeerConnected:
+		return "peer-connected"
+	case PeerDisconnected:
+		return "peer-disconnected"
+	case TrackerAnnounced:
+		return "tracker-announced"
+	case StateChanged:
+		return "state-changed"
+	case PeerBanned:
+		return "peer-banned"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// State is the state of a download
+type State int
+
+const (
+	// Stopped downloads have not been started or were stopped
+	Stopped State = iota
+	// Downloading downloads are missing pieces that aren't skipped
+	Downloading
+	// Complete downloads have every piece that isn't skipped
+	Complete
+	// Paused downloads are connected to their peers but don't request anything until they are resumed
+	Paused
+)
+
+func (s State) String() string {
+	switch s {
+	case Stopped:
+		return "stopped"
+	case Downloading:
+		return "downloading"
+	case Complete:
+		return "complete"
+	case Paused:
+		return "paused"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Event is something that happened during a download. Only the fields that apply to the Type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Piece is the index of the piece for PieceCompleted and PieceFailed
+	Piece int
+	// Peer is the address of the peer for PeerConnected, PeerDisconnected, PieceFailed and PeerBanned
+	Peer string
+	// Peers is the number of peers the tracker returned for TrackerAnnounced
+	Peers int
+	// State is the new state for StateChanged
+	State State
+	Err   error
+}
+
+// events hands out published events to every subscriber
+type events struct {
+	sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func (e *events) subscribe() (<-chan Event, func()) {
+	e.Lock()
+	defer e.Unlock()
+	if e.subs == nil {
+		e.subs = map[chan Event]struct{}{}
+	}
+	ch := make(chan Event, EventBuffer)
+	e.subs[ch] = struct{}{}
+
+	once := sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			e.Lock()
+			defer e.Unlock()
+			delete(e.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// publish sends the event to every subscriber. Subscribers that fall behind by more than EventBuffer
+// events miss events rather than holding up the download.
+func (e *events) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.Lock()
+	defer e.Unlock()
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives the events of the downloads of the manager and a function
+// that ends the subscription and closes the channel. The channel has to be drained, events are dropped
+// for subscribers that fall more than EventBuffer events behind.
+func (tm *TorrentManager) Subscribe() (<-chan Event, func()) {
+	return tm.events.subscribe()
+}
@@ -0,0 +1,75 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func TestDownloadEventsAndStats(t *testing.T) {
+	data := []byte("aaaabbbbcc")
+	torrent := testTorrent(4, data)
+	d := testDownload(torrent)
+	events, unsubscribe := d.events.subscribe()
+	defer unsubscribe()
+
+	d.updateState()
+	if s := d.stats(); s.State != Downloading || s.PiecesDone != 0 || s.PiecesWanted != 3 || s.PiecesTotal != 3 {
+		t.Fatalf("unexpected stats before download: %+v", s)
+	}
+
+	for i := 0; i < torrent.GetPieceCount(); i++ {
+		// the scheduler hands out pieces once they are verified
+		d.picker.MarkHave(i)
+		end := bt.Min(i*4+4, len(data))
+		d.pool.scheduler.downloaded.Add(end - i*4)
+		if err := d.storePiece(&types.Piece{Index: i, Data: append([]byte{}, data[i*4:end]...)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []Event{
+		{Type: StateChanged, State: Downloading},
+		{Type: PieceCompleted, Piece: 0},
+		{Type: PieceCompleted, Piece: 1},
+		{Type: PieceCompleted, Piece: 2},
+		{Type: StateChanged, State: Complete},
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e.Type != w.Type || e.Piece != w.Piece || e.State != w.State || e.Time.IsZero() {
+				t.Errorf("expected %v %d %v got %+v", w.Type, w.Piece, w.State, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing event %v", w.Type)
+		}
+	}
+
+	s := d.stats()
+	if s.State != Complete || s.PiecesDone != 3 || s.Downloaded != int64(len(data)) || s.DownloadRate <= 0 || s.ETA != 0 {
+		t.Errorf("unexpected stats after download: %+v", s)
+	}
+
+	d.setState(Stopped)
+	d.updateState()
+	if s := d.stats(); s.State != Stopped {
+		t.Errorf("expected download to stay stopped got %v", s.State)
+	}
+}
+
+func TestEventsDropForSlowSubscribers(t *testing.T) {
+	e := &events{}
+	ch, unsubscribe := e.subscribe()
+	for i := 0; i < EventBuffer+10; i++ {
+		e.publish(Event{Type: PieceCompleted, Piece: i})
+	}
+	if len(ch) != EventBuffer {
+		t.Errorf("expected %d buffered events got %d", EventBuffer, len(ch))
+	}
+	unsubscribe()
+	unsubscribe()
+	e.publish(Event{Type: PieceCompleted})
+}
@@ -0,0 +1,155 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// File is a file of a torrent that is being downloaded. Reads block until the data they need is
+// downloaded and verified, and the pieces they need are downloaded before anything else. Read also
+// raises the priority of the next StreamReadahead bytes, so that sequential reads rarely have to wait.
+type File struct {
+	ctx  context.Context
+	d    *download
+	span types.FileSpan
+	pos  int64
+	// critical is the range of pieces Read raised to time critical priority
+	critical [2]int
+}
+
+// OpenFile opens the file at path in the torrent that is being downloaded. Paths are the same as in
+// Layout. Skipped files can be opened as well, the pieces that were stored without their part of the
+// file are downloaded again.
+func (tm *TorrentManager) OpenFile(path string) (*File, error) {
+	return tm.OpenFileContext(context.Background(), path)
+}
+
+// OpenFileContext is like OpenFile, but reads that wait for data return once ctx is done
+func (tm *TorrentManager) OpenFileContext(ctx context.Context, path string) (*File, error) {
+	d, err := tm.download()
+	if err != nil {
+		return nil, err
+	}
+	return d.openFile(ctx, path)
+}
+
+func (d *download) openFile(ctx context.Context, path string) (*File, error) {
+	spans, err := d.torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	for _, span := range spans {
+		if span.Path != path {
+			continue
+		}
+		d.Lock()
+		d.read[span.Path] = true
+		missing := d.resume.unskip(span.Path)
+		d.Unlock()
+		d.redownload(missing)
+		return &File{ctx: ctx, d: d, span: span, critical: [2]int{0, -1}}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFileNotFound, path)
+}
+
+// Path returns the path of the file in the torrent
+func (f *File) Path() string {
+	return f.span.Path
+}
+
+// Size returns the length of the file
+func (f *File) Size() int64 {
+	return f.span.Length
+}
+
+// pieces returns the range of pieces that hold length bytes of the file at off
+func (f *File) pieces(off, length int64) [2]int {
+	pieceLength := int64(f.d.torrent.PieceLength)
+	start := f.span.Offset + off
+	return [2]int{int(start / pieceLength), int((start + length - 1) / pieceLength)}
+}
+
+// readAt waits for the pieces that hold p and reads them. p has to be within the file.
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	need := f.pieces(off, int64(len(p)))
+	for i := need[0]; i <= need[1]; i++ {
+		if err := f.d.waitPiece(f.ctx, i); err != nil {
+			return 0, err
+		}
+	}
+	return f.d.readAt(p, f.span.Offset+off)
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if f.pos >= f.span.Length {
+		return 0, io.EOF
+	}
+	if left := f.span.Length - f.pos; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	need := f.pieces(f.pos, int64(len(p)))
+	ahead := f.pieces(f.pos, bt.Min64(f.span.Length-f.pos, StreamReadahead))
+	window := [2]int{need[0], bt.Max(need[1], ahead[1])}
+	f.d.setCritical(f.critical, window)
+	f.critical = window
+
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes at off in the file. It doesn't use or change the position of Read and Seek
+// and can be called by several goroutines at once.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= f.span.Length {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if left := f.span.Length - off; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	need := f.pieces(off, int64(len(p)))
+	f.d.setCritical([2]int{0, -1}, need)
+	defer f.d.setCritical(need, [2]int{0, -1})
+
+	n, err := f.readAt(p, off)
+	if err == nil && n < want {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.pos + offset
+	case io.SeekEnd:
+		pos = f.span.Length + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+// Close gives the pieces Read was waiting for their old priority back
+func (f *File) Close() error {
+	f.d.setCritical(f.critical, [2]int{0, -1})
+	f.critical = [2]int{0, -1}
+	return nil
+}
@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func TestFileReadAt(t *testing.T) {
+	data := []byte("aaaabbbbccccdd")
+	torrent := testTorrent(4, data)
+	tm := &TorrentManager{}
+	if _, err := tm.OpenFile("test"); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("expected %v got %v", ErrNotStarted, err)
+	}
+	d := testDownload(torrent)
+	tm.active = d
+
+	f, err := tm.OpenFile("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Size() != int64(len(data)) {
+		t.Errorf("expected size %d got %d", len(data), f.Size())
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	reads := make(chan result)
+	for _, off := range []int64{2, 10} {
+		go func(off int64) {
+			buf := make([]byte, 5)
+			n, err := f.ReadAt(buf, off)
+			reads <- result{buf[:n], err}
+		}(off)
+	}
+
+	// the pieces the reads cover are needed right away
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		d.Lock()
+		raised := len(d.critical)
+		d.Unlock()
+		if raised == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < torrent.GetPieceCount(); i++ {
+		if got := d.picker.Priority(i); got != picker.Critical {
+			t.Errorf("expected piece %d to be critical got %v", i, got)
+		}
+	}
+
+	for i := 0; i < torrent.GetPieceCount(); i++ {
+		end := i*4 + 4
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := d.storePiece(&types.Piece{Index: i, Data: append([]byte{}, data[i*4:end]...)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := map[string]error{}
+	for i := 0; i < 2; i++ {
+		r := <-reads
+		got[string(r.data)] = r.err
+	}
+	if err, ok := got["aabbb"]; !ok || err != nil {
+		t.Errorf("expected aabbb at 2 got %v", got)
+	}
+	// the read at 10 goes past the end of the file
+	if err, ok := got["ccdd"]; !ok || err != io.EOF {
+		t.Errorf("expected ccdd and EOF at 10 got %v", got)
+	}
+	for i := 0; i < torrent.GetPieceCount(); i++ {
+		if d.picker.Priority(i) != picker.Normal {
+			t.Errorf("expected piece %d to be normal after the reads got %v", i, d.picker.Priority(i))
+		}
+	}
+
+	// ReadAt leaves the position of Read alone
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "aaaa" {
+		t.Errorf("expected aaaa got %q %v", buf, err)
+	}
+}
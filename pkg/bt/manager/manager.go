@@ -3,25 +3,93 @@ package manager
 import (
 	"context"
 	"fmt"
-	"os"
-	"sort"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/hashicorp/go-multierror"
-
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ipfilter"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/proxy"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/tracker"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
-	"golang.org/x/sync/semaphore"
 )
 
-const MaxBlockSize = 16 * 1024
+const MaxBlockSize = peer.MaxBlockSize
+
+// DefaultPort is the port announced to trackers when the manager has none set
+const DefaultPort = 6881
+
+// StopTimeout bounds how long Stop waits for trackers to take note that the download stopped
+const StopTimeout = 5 * time.Second
+
+// DefaultPeers is how many peers a download uses at the same time when the manager has no MaxPeers set
+const DefaultPeers = 10
+
+// DHTInterval is how often the DHT is asked for more peers while downloading
+const DHTInterval = 15 * time.Minute
+
+// DHTTimeout bounds a single lookup on the DHT
+const DHTTimeout = time.Minute
+
+var ErrAlreadyStarted = fmt.Errorf("download already started")
+var ErrNotStarted = fmt.Errorf("download not started")
+var ErrStopped = fmt.Errorf("download stopped")
+var ErrNoPeers = peer.ErrNoPeers
 
 type TorrentManager struct {
 	PeerID  string
 	Tracker *tracker.TrackerClient
+	// Port is the port peers can connect to us on, which is announced to trackers
+	Port int
+	// Storage opens the storage downloads are written to
+	Storage storage.Opener
+	// Files sets the priority of files in the torrent. Pieces are downloaded in order of the priority
+	// of the files they belong to, and skipped files are not downloaded at all.
+	Files FilePriorities
+	// Sequential downloads pieces in order instead of rarest first, which suits streaming
+	Sequential bool
+	// Logger is where downloads are logged, the default logger is used when it is nil
+	Logger *slog.Logger
+	// DownloadLimiter and UploadLimiter limit the piece data of the download. Give them a common parent
+	// to limit several managers together. Nil limiters don't limit.
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	// PeerDownloadLimit and PeerUploadLimit limit every peer to that many bytes per second, zero doesn't
+	// limit. Use SetPeerLimits to change them while downloading.
+	PeerDownloadLimit int
+	PeerUploadLimit   int
+	// MaxPeers is how many peers are downloaded from at the same time, DefaultPeers when it is zero
+	MaxPeers int
+	// MaxConns and MaxHalfOpen cap the peers we stay connected to and the connections dialed at the
+	// same time. The defaults of peer.ConnManager are used when they are zero.
+	MaxConns    int
+	MaxHalfOpen int
+	// ConnLimit caps the connections of this and other managers together. Share one between managers
+	// to limit them all, nil only applies MaxConns.
+	ConnLimit *peer.ConnLimit
+	// Bans are the peers we don't connect to. Peers that send corrupt data are added to it. Share one
+	// list between managers to keep those peers away from all of them.
+	Bans *peer.BanList
+	// Blocklist are the addresses we never talk to, nil doesn't block any
+	Blocklist *ipfilter.Filter
+	// Dialer makes the connections to peers, like through a proxy. They are made directly when it is
+	// nil. Tracker requests use the Dialer of Tracker.
+	Dialer proxy.Dialer
+	// DHT finds more peers for torrents that aren't private. Nil only uses the trackers.
+	DHT *dht.Client
+
+	sync.Mutex
+	active *download
+	// starting is set while Start opens the storage and announces the download, which it does without
+	// holding the lock
+	starting bool
+	events   events
 }
 
 func NewTorrentManager(peerID string, torrent *types.Torrent) *TorrentManager {
@@ -30,49 +98,489 @@ func NewTorrentManager(peerID string, torrent *types.Torrent) *TorrentManager {
 	return &TorrentManager{
 		PeerID:  peerID,
 		Tracker: client,
+		Storage: storage.OpenFiles,
+		Bans:    peer.NewBanList(),
 	}
 }
 
-func (tm *TorrentManager) newPeerPool(t *types.Torrent) (peer.Pool, error) {
-	fmt.Println("getting peers ...")
-	peers, err := tm.Tracker.GetPeers(tm.PeerID, 6881, t)
+// port returns the port announced to trackers
+func (tm *TorrentManager) port() int {
+	if tm.Port == 0 {
+		return DefaultPort
+	}
+	return tm.Port
+}
+
+// newPeerPool announces the download to the tracker and starts connecting to the peers it knows of.
+// With no peers the download waits for peers that connect to us or are added later on.
+func (tm *TorrentManager) newPeerPool(ctx context.Context, t *types.Torrent, logger *slog.Logger) (*peer.ConnManager, error) {
+	logger.Info("getting peers")
+	peers, err := tm.Tracker.GetPeers(ctx, tm.PeerID, tm.port(), t)
 	if err != nil {
+		tm.events.publish(Event{Type: TrackerAnnounced, Err: err})
 		return nil, err
 	}
+	tm.events.publish(Event{Type: TrackerAnnounced, Peers: len(peers.Peers)})
+	logger.Info("got peers", "peers", len(peers.Peers))
+
+	conns := peer.NewConnManager(tm.PeerID, t, logger)
+	conns.Bans = tm.Bans
+	conns.Blocklist = tm.Blocklist
+	conns.Dialer = tm.Dialer
+	conns.Limit = tm.ConnLimit
+	if tm.MaxConns > 0 {
+		conns.MaxConns = tm.MaxConns
+	}
+	if tm.MaxHalfOpen > 0 {
+		conns.MaxHalfOpen = tm.MaxHalfOpen
+	}
+	conns.Add(peer.SourceTracker, peers.Peers...)
+	conns.Start()
+	if tm.DHT != nil && !t.Private() {
+		go tm.lookupDHT(ctx, conns, t, logger)
+	}
+	return conns, nil
+}
 
-	fmt.Println("Peers ", len(peers.Peers))
+// lookupDHT adds the peers the DHT knows of to conns every DHTInterval until ctx is done or conns is
+// closed
+func (tm *TorrentManager) lookupDHT(ctx context.Context, conns *peer.ConnManager, t *types.Torrent, logger *slog.Logger) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-conns.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	tick := time.NewTicker(DHTInterval)
+	defer tick.Stop()
+	for {
+		lookup, stop := context.WithTimeout(ctx, DHTTimeout)
+		peers, err := tm.DHT.GetPeers(lookup, t.Hash)
+		stop()
+		if err != nil {
+			logger.Debug("dht lookup failed", "error", err)
+		} else {
+			logger.Info("got peers from the dht", "peers", len(peers))
+			conns.Add(peer.SourceDHT, peers...)
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-	return peer.NewPool(tm.PeerID, peers, t)
+// download is the state of a download between Start and Stop
+type download struct {
+	sync.Mutex
+
+	torrent *types.Torrent
+	dst     string
+	store   storage.Storage
+	picker  *picker.Picker
+	pool    *DownloaderPool
+	conns   *peer.ConnManager
+	resume  *ResumeData
+	// files are the file priorities of the download. Files that are read from are written out even
+	// when they are skipped.
+	files FilePriorities
+	read  map[string]bool
+	// base are the piece priorities from the file priorities, critical are the number of readers that
+	// need each piece right away
+	base     []picker.Priority
+	critical map[int]int
+	// changed is closed and replaced whenever a piece is stored
+	changed  chan struct{}
+	lastSave time.Time
+
+	events  *events
+	state   State
+	stopped bool
+	paused  bool
+
+	// announced is set when the tracker was told about the download, and has to be told when it stops
+	announced bool
+	log       *slog.Logger
 }
 
-func (tm *TorrentManager) Download(torrent *types.Torrent, dst string) error {
-	p, err := tm.newPeerPool(torrent)
-	if err != nil {
-		return err
+// Start starts downloading the torrent to dst in the background. Pieces are written as soon as they are
+// verified and the progress is saved in a resume file next to dst, so a download that got interrupted
+// only fetches the pieces that are missing. Use Wait to wait for the download and Stop to end it.
+//
+// The download stops requesting pieces once ctx is done, which Wait reports, but Stop still has to be
+// called to save the progress.
+func (tm *TorrentManager) Start(ctx context.Context, torrent *types.Torrent, dst string) error {
+	tm.Lock()
+	if tm.active != nil || tm.starting {
+		tm.Unlock()
+		return ErrAlreadyStarted
 	}
+	tm.starting = true
+	tm.Unlock()
+	defer func() {
+		tm.Lock()
+		tm.starting = false
+		tm.Unlock()
+	}()
 
-	fmt.Println("starting download")
-	all, err := download(p, torrent)
+	open := tm.Storage
+	if open == nil {
+		open = storage.OpenFiles
+	}
+	store, err := open(torrent, dst)
 	if err != nil {
-		fmt.Println("download failed")
 		return err
 	}
-	fmt.Println("download complete")
 
-	fd, err := os.Create(dst)
+	logger := bt.Logger(tm.Logger).With(bt.InfoHash(torrent.Hash))
+	resume := loadResumeData(ctx, torrent, dst, store, logger)
+	files := FilePriorities{}
+	for path, p := range tm.Files {
+		files[path] = p
+	}
+	base, err := piecePriorities(torrent, files)
 	if err != nil {
+		store.Close()
 		return err
 	}
-	defer fd.Close()
-	for _, piece := range all {
-		_, err := fd.Write(piece.Data)
+	// files that were skipped before but aren't anymore need the pieces that were stored without them
+	for path := range resume.Skipped {
+		if files.of(path) != picker.Skip {
+			resume.unskip(path)
+		}
+	}
+	d := &download{
+		torrent:  torrent,
+		dst:      dst,
+		store:    store,
+		picker:   picker.New(torrent.GetPieceCount()),
+		resume:   resume,
+		files:    files,
+		read:     map[string]bool{},
+		base:     base,
+		critical: map[int]int{},
+		changed:  make(chan struct{}),
+		lastSave: time.Now(),
+		events:   &tm.events,
+		log:      logger,
+	}
+	d.picker.SetSequential(tm.Sequential)
+	for i, priority := range d.base {
+		d.picker.SetPriority(i, priority)
+	}
+
+	// skipped files that have pieces stored without them need peers to get those pieces when the files are
+	// read, even when everything that is wanted is there
+	plans := resume.missingPlans(torrent)
+	if len(plans) > 0 || len(resume.Skipped) > 0 {
+		conns, err := tm.newPeerPool(ctx, torrent, logger)
 		if err != nil {
+			store.Close()
 			return err
 		}
+		d.conns = conns
+		d.announced = true
+		size := tm.MaxPeers
+		if size <= 0 {
+			size = DefaultPeers
+		}
+		d.pool = NewDownloaderPool(size, conns, d.picker, plans)
+		for _, partial := range resume.Partial {
+			d.pool.scheduler.restore(partial)
+		}
+		d.pool.OnPiece = d.storePiece
+		d.pool.OnEvent = d.events.publish
+		d.pool.Logger = logger
+		d.pool.DownloadLimiter = tm.DownloadLimiter
+		d.pool.UploadLimiter = tm.UploadLimiter
+		d.pool.Bans = tm.Bans
+		d.pool.SetPeerLimits(tm.PeerDownloadLimit, tm.PeerUploadLimit)
+		logger.Info("starting download", "left", d.picker.Remaining(), "pieces", torrent.GetPieceCount())
+		d.pool.Start(ctx)
+	}
+
+	tm.Lock()
+	tm.active = d
+	tm.Unlock()
+	d.updateState()
+	return nil
+}
+
+// Wait waits until every piece that isn't skipped has been downloaded. It returns the error of ctx when
+// ctx is done first, and ErrStopped when the download is stopped.
+func (tm *TorrentManager) Wait(ctx context.Context) error {
+	d, err := tm.download()
+	if err != nil {
+		return err
+	}
+	if d.pool == nil {
+		return nil
+	}
+	return d.pool.Wait(ctx)
+}
+
+// Pause stops requesting pieces until Resume is called. Peers stay connected and nothing is lost, so the
+// download picks up where it left off.
+func (tm *TorrentManager) Pause() error {
+	d, err := tm.download()
+	if err != nil {
+		return err
+	}
+	if d.pool != nil {
+		d.pool.Pause()
+	}
+	d.setPaused(true)
+	return nil
+}
+
+// Resume continues a paused download
+func (tm *TorrentManager) Resume() error {
+	d, err := tm.download()
+	if err != nil {
+		return err
+	}
+	if d.pool != nil {
+		d.pool.Resume()
+	}
+	d.setPaused(false)
+	return nil
+}
+
+// Stop stops the download, flushes the storage, saves the resume data and tells the tracker that the
+// download stopped
+func (tm *TorrentManager) Stop() error {
+	tm.Lock()
+	d := tm.active
+	tm.active = nil
+	tm.Unlock()
+	if d == nil {
+		return ErrNotStarted
+	}
+
+	if d.pool != nil {
+		d.pool.Stop()
+		d.conns.Close()
+	}
+	d.setState(Stopped)
+	err := d.save()
+	if closeErr := d.store.Close(); err == nil {
+		err = closeErr
+	}
+	if d.announced {
+		tm.announceStopped(d)
+	}
+	return err
+}
+
+// announceStopped tells the tracker that the download stopped. Trackers that don't answer in time are
+// left to find out on their own.
+func (tm *TorrentManager) announceStopped(d *download) {
+	ctx, cancel := context.WithTimeout(context.Background(), StopTimeout)
+	defer cancel()
+
+	stats := d.stats()
+	req := tracker.NewPeersRequest(tm.PeerID, tm.port(), d.torrent)
+	req.Event = tracker.Stopped
+	req.Downloaded = float64(stats.Downloaded)
+	req.Left = int(stats.Left)
+	if _, err := tm.Tracker.Announce(ctx, req, d.torrent); err != nil {
+		d.log.Debug("failed to announce that the download stopped", "err", err)
+	}
+}
+
+// Download downloads the torrent to dst and returns once all the pieces that aren't skipped are there
+// or ctx is done. The progress is saved either way. See Start.
+func (tm *TorrentManager) Download(ctx context.Context, torrent *types.Torrent, dst string) error {
+	if err := tm.Start(ctx, torrent, dst); err != nil {
+		return err
+	}
+	logger := bt.Logger(tm.Logger).With(bt.InfoHash(torrent.Hash))
+	err := tm.Wait(ctx)
+	if stopErr := tm.Stop(); stopErr != nil {
+		logger.Warn("failed to save resume data", "err", stopErr)
+	}
+	if err != nil && ctx.Err() != nil {
+		logger.Info("download interrupted", "err", err)
+		return err
+	} else if err != nil {
+		logger.Error("download failed", "err", err)
+		return err
+	}
+	logger.Info("download complete")
+	return nil
+}
+
+// AddPeer hands a peer that connected to us to the download. Pieces aren't served to peers, so peers
+// of downloads that have nothing left to download are disconnected.
+func (tm *TorrentManager) AddPeer(c *peer.Client) error {
+	d, err := tm.download()
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if d.pool == nil {
+		c.Close()
+		return nil
+	}
+	d.pool.AddPeer(c)
+	return nil
+}
+
+// AddPeers adds peers to connect to, for instance ones learned from other peers. Downloads that have
+// nothing left to download ignore them.
+func (tm *TorrentManager) AddPeers(source peer.Source, peers ...*types.Peer) error {
+	d, err := tm.download()
+	if err != nil {
+		return err
+	}
+	if d.conns != nil {
+		d.conns.Add(source, peers...)
+	}
+	return nil
+}
+
+// SetPeerLimits changes the limits of every peer, including the ones that are connected already
+func (tm *TorrentManager) SetPeerLimits(down, up int) {
+	tm.Lock()
+	tm.PeerDownloadLimit, tm.PeerUploadLimit = down, up
+	d := tm.active
+	tm.Unlock()
+	if d != nil && d.pool != nil {
+		d.pool.SetPeerLimits(down, up)
+	}
+}
+
+func (tm *TorrentManager) download() (*download, error) {
+	tm.Lock()
+	defer tm.Unlock()
+	if tm.active == nil {
+		return nil, ErrNotStarted
+	}
+	return tm.active, nil
+}
+
+// storePiece writes a downloaded piece to the storage and saves the resume data every ResumeInterval
+func (d *download) storePiece(piece *types.Piece) error {
+	d.Lock()
+	files := FilePriorities{}
+	for path, p := range d.files {
+		if !d.read[path] {
+			files[path] = p
+		}
+	}
+	d.Unlock()
+
+	skipped, err := writePiece(d.store, d.torrent, files, piece)
+	if err != nil {
+		return err
+	}
+	if err := d.store.MarkComplete(piece.Index); err != nil {
+		return err
+	}
+	// the data is in storage now, there's no need to keep it around
+	piece.Data = nil
+
+	d.Lock()
+	for _, path := range skipped {
+		// a file that was opened while the piece was written needs the part that was left out
+		if d.read[path] {
+			d.Unlock()
+			d.redownload([]int{piece.Index})
+			return nil
+		}
+	}
+	for _, path := range skipped {
+		d.resume.skip(path, piece.Index)
+	}
+	d.resume.Pieces.Set(piece.Index)
+	close(d.changed)
+	d.changed = make(chan struct{})
+	save := time.Since(d.lastSave) >= ResumeInterval
+	d.Unlock()
+
+	d.events.publish(Event{Type: PieceCompleted, Piece: piece.Index})
+	d.updateState()
+
+	if save {
+		if err := d.save(); err != nil {
+			d.log.Warn("failed to save resume data", "err", err)
+		}
 	}
 	return nil
 }
 
+// redownload downloads the pieces again, for pieces that were stored without the part of a file that is
+// needed now
+func (d *download) redownload(pieces []int) {
+	if len(pieces) == 0 || d.pool == nil {
+		return
+	}
+	for _, idx := range pieces {
+		d.pool.scheduler.want(d.torrent.BlockPlan(idx, MaxBlockSize))
+	}
+	d.pool.notify()
+	d.updateState()
+}
+
+// updateState switches between Downloading, Complete and Paused as pieces come in, priorities change and
+// the download is paused
+func (d *download) updateState() {
+	d.Lock()
+	paused := d.paused
+	d.Unlock()
+
+	state := Downloading
+	if d.pool == nil || d.pool.scheduler.Finished() {
+		state = Complete
+	} else if paused {
+		state = Paused
+	}
+	d.setState(state)
+}
+
+func (d *download) setPaused(paused bool) {
+	d.Lock()
+	d.paused = paused
+	d.Unlock()
+	d.updateState()
+}
+
+// setState changes the state and publishes the change. Stopped downloads stay stopped.
+func (d *download) setState(state State) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopped || d.state == state {
+		return
+	}
+	d.state = state
+	d.stopped = state == Stopped
+	d.events.publish(Event{Type: StateChanged, State: state})
+}
+
+func (d *download) save() error {
+	if err := d.store.Flush(); err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.lastSave = time.Now()
+	files, err := fileStates(d.torrent, d.dst)
+	if err != nil {
+		return err
+	}
+	d.resume.Files = files
+	if d.pool != nil {
+		d.resume.Partial = d.pool.scheduler.partial()
+	}
+	return d.resume.Save(ResumePath(d.dst))
+}
+
 type PeerClientErr struct {
 	Err       error
 	BlockPlan *types.BlockPlan
@@ -89,6 +597,8 @@ func (p *PeerClientErr) String() string {
 type PieceDownloadFailedErr struct {
 	Err       error
 	BlockPlan *types.BlockPlan
+	// Peer is the address of the peer that sent the last block of the piece
+	Peer string
 }
 
 func (p *PieceDownloadFailedErr) Error() string {
@@ -99,185 +609,413 @@ func (p *PieceDownloadFailedErr) String() string {
 	return fmt.Sprintf("piece %d failed to download: %v", p.BlockPlan.PieceIndex, p.Err)
 }
 
+// DownloaderPool runs a block pipeline against each of Size peers at a time. The pipelines share a
+// scheduler so that a peer keeps requesting blocks across piece boundaries instead of waiting for a
+// piece to complete before it starts on the next one.
 type DownloaderPool struct {
 	Size int
 
 	clientPool peer.Pool
-
-	errC     chan error
-	workC    chan *types.BlockPlan
-	complete chan *types.Piece
-
-	count atomic.Int64
-	wg    *sync.WaitGroup
-	sem   *semaphore.Weighted
-
-	Result []*types.Piece
+	picker     *picker.Picker
+	scheduler  *blockScheduler
+
+	// OnPiece is called for every piece as soon as it is downloaded and verified. An error stops the
+	// download.
+	OnPiece func(p *types.Piece) error
+	// OnEvent is called for the events of the pool: peers that connect and disconnect and pieces that
+	// fail their hash check
+	OnEvent func(e Event)
+	// Logger is where the pool logs, the default logger is used when it is nil
+	Logger *slog.Logger
+	// DownloadLimiter and UploadLimiter are the parents of the limiters of every peer
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	// Bans is where peers that sent corrupt data are banned
+	Bans *peer.BanList
+
+	tracked types.Set[*peer.Client]
+	// uploaded is the piece data sent to peers that aren't tracked anymore
+	uploaded atomic.Int64
+	// done is closed and ctx cancelled when the pool stops
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+
+	mu      sync.Mutex
+	err     error
+	changed chan struct{}
+	// peerDown and peerUp are the limits of every peer in bytes per second
+	peerDown, peerUp int
+	// run is cancelled when the pool is paused, which stops the pipelines. resumed is closed when it
+	// is resumed again.
+	paused  bool
+	run     context.Context
+	pause   context.CancelFunc
+	resumed chan struct{}
 }
 
-func NewDownloaderPool(s int, clientPool peer.Pool) *DownloaderPool {
+func NewDownloaderPool(s int, clientPool peer.Pool, pk *picker.Picker, plans []*types.BlockPlan) *DownloaderPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	run, pause := context.WithCancel(ctx)
+	done := make(chan struct{})
 	return &DownloaderPool{
 		Size:       s,
 		clientPool: clientPool,
-		errC:       make(chan error, 5),
-		workC:      make(chan *types.BlockPlan),
-		complete:   make(chan *types.Piece, s),
+		picker:     pk,
+		scheduler:  newBlockScheduler(plans, pk, done),
+		tracked:    types.NewSyncSet[*peer.Client](),
+		done:       done,
+		ctx:        ctx,
+		cancel:     cancel,
 		wg:         &sync.WaitGroup{},
-		sem:        semaphore.NewWeighted(int64(s)),
+		changed:    make(chan struct{}),
+		run:        run,
+		pause:      pause,
+		resumed:    make(chan struct{}),
 	}
 }
 
-func (dp *DownloaderPool) Start() chan peer.Result[[]*types.Piece] {
-	for i := 0; i < dp.Size; i++ {
-		dp.wg.Add(1)
-		go dp.startWorker(i)
+// track feeds the pieces the peer has into the picker for as long as the peer stays connected
+func (dp *DownloaderPool) track(c *peer.Client) {
+	if dp.tracked.Has(c) {
+		return
 	}
+	dp.tracked.Put(c)
+
+	id := c.Peer.String()
+	dp.publish(Event{Type: PeerConnected, Peer: id})
+	dp.mu.Lock()
+	down, up := dp.peerDown, dp.peerUp
+	dp.mu.Unlock()
+	dp.limit(c, down, up)
+	c.Channel.RegisterReceiveHook(peer.HaveType, func(msg peer.Message) error {
+		if have, ok := msg.(*peer.Have); ok {
+			dp.picker.PeerHas(id, have.Index)
+			dp.updateInterest(c)
+		}
+		return nil
+	})
+	c.Channel.RegisterReceiveHook(peer.BitFieldType, func(msg peer.Message) error {
+		if field, ok := msg.(*peer.BitField); ok {
+			dp.picker.AddPeer(id, field)
+			dp.updateInterest(c)
+		}
+		return nil
+	})
+	dp.picker.AddPeer(id, c.Channel.Pieces())
+	c.Channel.PredictAllowedFast(dp.picker.Len())
 
-	return dp.resultCh()
+	go func() {
+		select {
+		case <-c.Channel.Done:
+			dp.publish(Event{Type: PeerDisconnected, Peer: id, Err: c.Channel.Err})
+		case <-dp.done:
+		}
+		dp.picker.RemovePeer(id)
+		dp.tracked.Del(c)
+		dp.uploaded.Add(c.Channel.Traffic().PayloadOut)
+	}()
 }
 
-func (dp *DownloaderPool) resultCh() chan peer.Result[[]*types.Piece] {
+// uploads returns the piece data sent to peers so far and the rate it is sent at, summed over the peers
+func (dp *DownloaderPool) uploads() (int64, float64) {
+	total, rate := dp.uploaded.Load(), 0.0
+	for _, c := range dp.tracked.All() {
+		stats := c.Channel.Stats()
+		total += stats.PayloadOut
+		rate += stats.UploadRate
+	}
+	return total, rate
+}
 
-	resultC := make(chan peer.Result[[]*types.Piece])
+// Start starts the workers. They keep going until Stop is called or ctx is done, even when there is
+// nothing left to download, so that pieces that become wanted later on get downloaded as well.
+func (dp *DownloaderPool) Start(ctx context.Context) {
+	dp.scheduler.log = dp.log()
+	for i := 0; i < dp.Size; i++ {
+		dp.wg.Add(1)
+		go dp.startWorker(i)
+	}
+	dp.wg.Add(2)
+	go dp.collect()
 	go func() {
-		var allPieces = []*types.Piece{}
-		var allErrs error
-	loop:
-		for {
-			select {
-			case p := <-dp.complete:
-				allPieces = append(allPieces, p)
-				total := dp.count.Load()
-				if total == int64(len(allPieces)) {
-					break loop
-				} else {
-					fmt.Printf("--- (%d/%d)\n", len(allPieces), total)
-				}
-			case err := <-dp.errC:
-				switch e := err.(type) {
-				case *PieceDownloadFailedErr:
-					fmt.Printf("--- Piece %d failed - Retrying ---\n", e.BlockPlan.PieceLength)
-					dp.count.Add(-1)
-					go dp.Download(e.BlockPlan)
-				case *PeerClientErr:
-					fmt.Printf("--- Peer Client err - Retrying piece %d ---\n", e.BlockPlan.PieceLength)
-					dp.count.Add(-1)
-					go dp.Download(e.BlockPlan)
-				default:
-					allErrs = multierror.Append(allErrs, err)
+		defer dp.wg.Done()
+		select {
+		case <-ctx.Done():
+			dp.fail(ctx.Err())
+			dp.halt()
+		case <-dp.done:
+		}
+	}()
+}
 
-				}
+// Wait waits until the scheduler is finished, OnPiece fails, the pool stops or ctx is done
+func (dp *DownloaderPool) Wait(ctx context.Context) error {
+	for {
+		dp.mu.Lock()
+		err, changed := dp.err, dp.changed
+		dp.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if dp.scheduler.Finished() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-dp.done:
+			dp.mu.Lock()
+			err := dp.err
+			dp.mu.Unlock()
+			if err != nil {
+				return err
 			}
+			return ErrStopped
 		}
-		close(dp.workC)
-		dp.wg.Wait()
-
-		close(dp.errC)
-		close(dp.complete)
+	}
+}
 
-		resultC <- peer.Result[[]*types.Piece]{
-			R:   allPieces,
-			Err: allErrs,
-		}
-	}()
+// Stop stops the workers and waits for them to return
+func (dp *DownloaderPool) Stop() {
+	dp.halt()
+	dp.wg.Wait()
+}
 
-	return resultC
+// halt tells the workers to stop
+func (dp *DownloaderPool) halt() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	select {
+	case <-dp.done:
+	default:
+		close(dp.done)
+		dp.cancel()
+	}
+}
 
+// fail records the error that stopped the download, unless there already is one
+func (dp *DownloaderPool) fail(err error) {
+	dp.mu.Lock()
+	if dp.err == nil {
+		dp.err = err
+	}
+	dp.mu.Unlock()
 }
 
-func (dp *DownloaderPool) Download(work *types.BlockPlan) {
-	dp.count.Add(1)
-	dp.workC <- work
+// Pause stops requesting blocks until Resume is called. Peers stay connected, and the blocks that were
+// requested from them are handed back to the scheduler.
+func (dp *DownloaderPool) Pause() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if dp.paused {
+		return
+	}
+	dp.paused = true
+	dp.pause()
 }
 
-func (dp *DownloaderPool) doWorkerDownload(id int, piecePlan *types.BlockPlan) error {
-	defer fmt.Printf("[downloader %d] work complete\n", id)
-	fmt.Printf("[downloader %d] %d piece\n", id, piecePlan.PieceIndex)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	fmt.Printf("[downloader %d] acuiring semaphore\n", id)
-	if err := dp.sem.Acquire(ctx, 1); err != nil {
-		cancel()
-		return fmt.Errorf("[downloader %d] failed to acquire semaphore for download: %w", id, err)
+// Resume lets a paused pool request blocks again
+func (dp *DownloaderPool) Resume() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if !dp.paused {
+		return
 	}
-	defer dp.sem.Release(1)
-	defer cancel()
+	dp.paused = false
+	dp.run, dp.pause = context.WithCancel(dp.ctx)
+	close(dp.resumed)
+	dp.resumed = make(chan struct{})
+}
 
-	innerCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
+// Paused reports whether the pool is paused
+func (dp *DownloaderPool) Paused() bool {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	return dp.paused
+}
 
-	fmt.Printf("[downloader %d] acuiring client\n", id)
-	client, release, err := dp.clientPool.Get(innerCtx)
-	defer release()
-	if err != nil {
-		fmt.Printf("[downloader %d] failed to get client (PeerClientErr): %v\n", id, err)
-		return &PeerClientErr{
-			Err:       fmt.Errorf("[downloader %d] failed to retrieve client from pool: %w", id, err),
-			BlockPlan: piecePlan,
-		}
+// running returns the context the workers download with, or the channel that is closed once the pool
+// is resumed when it is paused
+func (dp *DownloaderPool) running() (context.Context, <-chan struct{}) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if dp.paused {
+		return nil, dp.resumed
 	}
+	return dp.run, nil
+}
 
-	fmt.Printf("[downloader %d] downloading piece %d\n", id, piecePlan.PieceIndex)
-	piece, err := client.DownloadPiece(piecePlan)
-	if err != nil {
-		switch err {
-		case peer.ErrChannelClosed:
-			fmt.Printf("[downloader %d] client channel closed\n", id)
-			return &PeerClientErr{
-				Err:       err,
-				BlockPlan: piecePlan,
-			}
-		case peer.ErrPieceUnavailable:
-			fmt.Printf("[downloader %d] piece unavailable %d\n", id, piecePlan.PieceIndex)
-			fallthrough
-		default:
-			return &PieceDownloadFailedErr{BlockPlan: piecePlan, Err: err}
-		}
+// SetPeerLimits limits every peer to down and up bytes per second, zero doesn't limit
+func (dp *DownloaderPool) SetPeerLimits(down, up int) {
+	dp.mu.Lock()
+	dp.peerDown, dp.peerUp = down, up
+	dp.mu.Unlock()
+	for _, c := range dp.tracked.All() {
+		dp.limit(c, down, up)
 	}
-	dp.complete <- piece
-	return nil
 }
 
-func (dp *DownloaderPool) startWorker(id int) {
-	fmt.Printf("<<<<<<<<<<<<<<<< WORKER %d [START] >>>>>>>>>>>>>>>>>>>>\n", id)
-	defer dp.wg.Done()
-	for piecePlan := range dp.workC {
-		fmt.Printf("<<<<<<<<<<<<<<<< WORKER %d [WORK Piece %d] >>>>>>>>>>>>>>>>>>>>\n", id, piecePlan.PieceIndex)
-		if err := dp.doWorkerDownload(id, piecePlan); err != nil {
+func (dp *DownloaderPool) limit(c *peer.Client, down, up int) {
+	c.Channel.DownloadLimiter().SetParent(dp.DownloadLimiter)
+	c.Channel.DownloadLimiter().SetRate(down)
+	c.Channel.UploadLimiter().SetParent(dp.UploadLimiter)
+	c.Channel.UploadLimiter().SetRate(up)
+}
 
-			dp.errC <- err
-			fmt.Printf("<<<<<<<<<<<<<<<< WORKER %d [WORK ERR ] >>>>>>>>>>>>>>>>>>>>\n", id)
-		}
+// AddPeer hands a peer that connected to us to the client pool. The peer is disconnected when there is
+// no pool.
+func (dp *DownloaderPool) AddPeer(c *peer.Client) {
+	if dp.clientPool == nil {
+		c.Close()
+		return
 	}
+	dp.clientPool.AddClient(c)
+}
+
+// nextClient returns a peer from the pool and the function that hands it back once the worker is done
+// with it
+func (dp *DownloaderPool) nextClient(ctx context.Context) (*peer.Client, func(), error) {
+	if dp.clientPool == nil {
+		return nil, func() {}, ErrNoPeers
+	}
+	return dp.clientPool.Get(ctx)
+}
 
-	fmt.Printf("<<<<<<<<<<<<<<<< WORKER %d [QUIT] >>>>>>>>>>>>>>>>>>>>\n", id)
+func (dp *DownloaderPool) log() *slog.Logger {
+	return bt.Logger(dp.Logger)
 }
 
-func download(p peer.Pool, torrent *types.Torrent) ([]*types.Piece, error) {
-	plans := torrent.AllBlockPlans(MaxBlockSize)
+func (dp *DownloaderPool) publish(e Event) {
+	if dp.OnEvent != nil {
+		dp.OnEvent(e)
+	}
+}
 
-	var dp = NewDownloaderPool(10, p)
+// notify wakes up Wait, for instance because priorities changed
+func (dp *DownloaderPool) notify() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	close(dp.changed)
+	dp.changed = make(chan struct{})
+}
 
-	results := dp.Start()
+// updateInterest tells the peer whether it has anything we want and reports whether it does
+func (dp *DownloaderPool) updateInterest(c *peer.Client) (bool, error) {
+	if dp.scheduler.Wants(c) {
+		return true, c.Channel.SendInterested()
+	}
+	return false, c.Channel.SendNotInterested()
+}
 
-	for _, plan := range plans {
-		dp.Download(plan)
+// collect hands the pieces the scheduler completes to OnPiece
+func (dp *DownloaderPool) collect() {
+	defer dp.wg.Done()
+	done := 0
+	for {
+		select {
+		case <-dp.done:
+			return
+		case p := <-dp.scheduler.complete:
+			done++
+			dp.log().Info("piece done", bt.PieceKey, p.Index, "done", done, "left", dp.picker.Remaining())
+			if dp.OnPiece != nil {
+				if err := dp.OnPiece(p); err != nil {
+					dp.fail(err)
+				}
+			}
+			dp.notify()
+		case failure := <-dp.scheduler.failed:
+			dp.log().Warn("piece failed - retrying", bt.PieceKey, failure.BlockPlan.PieceIndex, bt.PeerKey, failure.Peer, "err", failure.Err)
+			dp.publish(Event{Type: PieceFailed, Piece: failure.BlockPlan.PieceIndex, Peer: failure.Peer, Err: failure.Err})
+		case corrupt := <-dp.scheduler.corrupt:
+			for _, p := range corrupt {
+				dp.ban(p)
+			}
+		}
 	}
+}
 
-	downloadResult := <-results
-	if downloadResult.Err != nil {
-		fmt.Printf("<< ERR: %v >>", downloadResult.Err)
+// ban bans a peer that sent corrupt data and disconnects every connection to its address
+func (dp *DownloaderPool) ban(p *types.Peer) {
+	dp.log().Warn("banning peer that sent corrupt data", bt.PeerKey, p.String())
+	dp.Bans.Ban(p.IP)
+	for _, c := range dp.tracked.All() {
+		if c.Peer.IP.Equal(p.IP) {
+			c.Close()
+		}
 	}
+	dp.publish(Event{Type: PeerBanned, Peer: p.String()})
+}
 
-	pieces := downloadResult.R
+func (dp *DownloaderPool) doWorkerDownload(ctx context.Context, id int) error {
+	getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
 
-	fmt.Printf("%d pieces downloaded\n", len(pieces))
+	client, release, err := dp.nextClient(getCtx)
+	defer release()
+	if err == ErrNoPeers {
+		return err
+	} else if err != nil {
+		return &PeerClientErr{
+			Err: fmt.Errorf("[downloader %d] failed to retrieve client from pool: %w", id, err),
+		}
+	}
 
-	sort.SliceStable(pieces, func(a, b int) bool {
-		p1 := pieces[a]
-		p2 := pieces[b]
+	dp.track(client)
+	// a peer with nothing we want goes back to the pool for when it gets new pieces
+	if interested, err := dp.updateInterest(client); err != nil {
+		return &PeerClientErr{Err: err}
+	} else if !interested {
+		return peer.ErrNothingWanted
+	}
 
-		return p1.Index <= p2.Index
-	})
+	client.Channel.Logger().Debug("pipelining", "worker", id)
+	pipeline := peer.NewPipeline(client, dp.scheduler)
+	err = pipeline.Run(ctx)
+	if err == peer.ErrNothingWanted {
+		client.Channel.SendNotInterested()
+		return err
+	} else if ctx.Err() != nil {
+		// paused or stopped - the peer stays connected but shouldn't expect requests from us
+		client.Channel.SendNotInterested()
+		return ctx.Err()
+	} else if err != nil {
+		return &PeerClientErr{Err: err}
+	}
+	return nil
+}
 
-	return pieces, downloadResult.Err
+func (dp *DownloaderPool) startWorker(id int) {
+	defer dp.wg.Done()
+	for {
+		select {
+		case <-dp.done:
+			return
+		default:
+		}
+		ctx, resumed := dp.running()
+		if ctx == nil {
+			select {
+			case <-dp.done:
+			case <-resumed:
+			}
+			continue
+		}
+		err := dp.doWorkerDownload(ctx, id)
+		if err == peer.ErrNothingWanted || err == ErrNoPeers {
+			// give other workers a chance at the pool before grabbing a peer again, otherwise all the
+			// workers spin on peers that have nothing for us
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		} else if ctx.Err() != nil {
+			continue
+		} else if err != nil {
+			dp.log().Debug("worker failed", "worker", id, "err", err)
+		}
+	}
 }
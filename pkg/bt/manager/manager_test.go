@@ -0,0 +1,201 @@
+package manager
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/tracker"
+)
+
+func TestPoolPeerLimits(t *testing.T) {
+	torrent := testTorrent(4, []byte("aaaabbbb"))
+	dp := NewDownloaderPool(1, nil, picker.New(torrent.GetPieceCount()), torrent.AllBlockPlans(MaxBlockSize))
+	dp.DownloadLimiter = ratelimit.NewLimiter(1000, nil)
+	defer dp.Stop()
+
+	connected := newTestClient(t, 6881)
+	dp.track(connected)
+	dp.SetPeerLimits(100, 200)
+
+	// peers that connect later get the same limits
+	later := newTestClient(t, 6882)
+	dp.track(later)
+
+	if dp.tracked.Len() != 2 {
+		t.Fatalf("expected 2 tracked peers got %d", dp.tracked.Len())
+	}
+	for _, c := range dp.tracked.All() {
+		if down, up := c.Channel.DownloadLimiter().Rate(), c.Channel.UploadLimiter().Rate(); down != 100 || up != 200 {
+			t.Errorf("expected %s to be limited to 100 down and 200 up got %d and %d", c.Peer.String(), down, up)
+		}
+	}
+}
+
+func TestManagerPauseResumeAndCancel(t *testing.T) {
+	dir := t.TempDir()
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	torrent := testTorrent(4, []byte("aaaabbbb"))
+	torrent.Announce = srv.URL
+	tm := NewTorrentManager("00112233445566778899", torrent)
+	tm.Storage = storage.OpenMemory
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := tm.Start(ctx, torrent, filepath.Join(dir, "test")); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != string(tracker.Started) {
+		t.Fatalf("expected the first announce to be %q got %q", tracker.Started, event)
+	}
+
+	states := []struct {
+		change func() error
+		want   State
+	}{
+		{change: tm.Pause, want: Paused},
+		{change: tm.Resume, want: Downloading},
+	}
+	for _, s := range states {
+		if err := s.change(); err != nil {
+			t.Fatal(err)
+		}
+		if state := tm.Stats().State; state != s.want {
+			t.Fatalf("expected %s got %s", s.want, state)
+		}
+	}
+
+	cancel()
+	if err := tm.Wait(context.Background()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+	if err := tm.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != string(tracker.Stopped) {
+		t.Fatalf("expected the last announce to be %q got %q", tracker.Stopped, event)
+	}
+	if _, err := os.Stat(ResumePath(filepath.Join(dir, "test"))); err != nil {
+		t.Fatalf("expected resume data to be saved: %v", err)
+	}
+}
+
+func TestManagerAnnouncesWithoutLock(t *testing.T) {
+	announcing := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(announcing)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	torrent := testTorrent(4, []byte("aaaabbbb"))
+	torrent.Announce = srv.URL
+	tm := NewTorrentManager("00112233445566778899", torrent)
+	tm.Storage = storage.OpenMemory
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan error, 1)
+	go func() { started <- tm.Start(ctx, torrent, filepath.Join(t.TempDir(), "test")) }()
+	<-announcing
+
+	// the manager answers while the tracker takes its time
+	if state := tm.Stats().State; state != Stopped {
+		t.Fatalf("expected %s got %s", Stopped, state)
+	}
+	if err := tm.Start(ctx, torrent, ""); !errors.Is(err, ErrAlreadyStarted) {
+		t.Fatalf("expected %v got %v", ErrAlreadyStarted, err)
+	}
+
+	cancel()
+	if err := <-started; err == nil {
+		t.Fatalf("expected the announce to fail once ctx is done")
+	}
+	if err := tm.Stop(); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("expected %v got %v", ErrNotStarted, err)
+	}
+}
+
+func TestManagerDialsPeersFromDHT(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	// the peer the DHT knows of only has to be dialed
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+		dialed <- struct{}{}
+	}()
+
+	// the DHT node answers every query with that peer
+	node, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			size, from, err := node.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			v, err := encoding.DecodeBencode(encoding.NewBencodeReader(string(buf[:size])))
+			if err != nil {
+				continue
+			}
+			addr := ln.Addr().(*net.TCPAddr)
+			value := binary.BigEndian.AppendUint16(append([]byte{}, addr.IP.To4()...), uint16(addr.Port))
+			r := map[string]interface{}{"id": string(make([]byte, 20)), "values": []interface{}{string(value)}}
+			data, _ := encoding.NewBenEncoder().Encode(map[string]interface{}{"t": v.(map[string]interface{})["t"], "y": "r", "r": r})
+			node.WriteTo(data, from)
+		}
+	}()
+
+	torrent := testTorrent(4, []byte("aaaabbbb"))
+	torrent.Announce = srv.URL
+	tm := NewTorrentManager("00112233445566778899", torrent)
+	tm.Storage = storage.OpenMemory
+	tm.DHT = dht.NewClient()
+	tm.DHT.Bootstrap = []string{node.LocalAddr().String()}
+	defer tm.DHT.Close()
+
+	if err := tm.Start(context.Background(), torrent, filepath.Join(t.TempDir(), "test")); err != nil {
+		t.Fatal(err)
+	}
+	defer tm.Stop()
+	select {
+	case <-dialed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the peer from the dht to be dialed")
+	}
+}
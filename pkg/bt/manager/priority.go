@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+var ErrNoFilesMatched = fmt.Errorf("no files matched")
+
+// FilePriorities maps the paths of files in the torrent, as returned by Torrent.Layout, to their
+// priority. Files that are not in the map have picker.Normal priority.
+type FilePriorities map[string]picker.Priority
+
+func (f FilePriorities) of(path string) picker.Priority {
+	if p, ok := f[path]; ok {
+		return p
+	}
+	return picker.Normal
+}
+
+// OnlyFiles returns priorities that skip every file of the torrent that doesn't match the glob. The glob
+// is matched against the path of the file and against its name.
+func OnlyFiles(torrent *types.Torrent, glob string) (FilePriorities, error) {
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	priorities := FilePriorities{}
+	matched := 0
+	for _, span := range spans {
+		ok, err := filepath.Match(glob, span.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if ok, err = filepath.Match(glob, filepath.Base(span.Path)); err != nil {
+				return nil, err
+			}
+		}
+		if ok {
+			matched++
+		} else {
+			priorities[span.Path] = picker.Skip
+		}
+	}
+	if matched == 0 {
+		return nil, fmt.Errorf("%w %q", ErrNoFilesMatched, glob)
+	}
+	return priorities, nil
+}
+
+// piecePriorities translates file priorities to piece priorities through the file layout. Pieces get the
+// highest priority of the files they hold data of, so a piece on the boundary between a wanted and a
+// skipped file is still downloaded.
+func piecePriorities(torrent *types.Torrent, files FilePriorities) ([]picker.Priority, error) {
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	priorities := make([]picker.Priority, torrent.GetPieceCount())
+	for _, span := range spans {
+		p := files.of(span.Path)
+		first, last := torrent.PieceRange(span)
+		for i := first; i <= last; i++ {
+			if p > priorities[i] {
+				priorities[i] = p
+			}
+		}
+	}
+	return priorities, nil
+}
+
+// writePiece writes the data of the piece to the storage, leaving out the parts that belong to skipped
+// files so that those are never created. It returns the paths of the files that were left out.
+func writePiece(store storage.Storage, torrent *types.Torrent, files FilePriorities, piece *types.Piece) ([]string, error) {
+	start := int64(piece.Index) * int64(torrent.PieceLength)
+	end := start + int64(len(piece.Data))
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	skipped := []string{}
+	for _, span := range spans {
+		from, to := span.Offset, span.Offset+span.Length
+		if to <= start || from >= end {
+			continue
+		}
+		if files.of(span.Path) == picker.Skip {
+			skipped = append(skipped, span.Path)
+			continue
+		}
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		if _, err := store.WriteBlock(piece.Data[from-start:to-start], piece.Index, int(from-start)); err != nil {
+			return nil, err
+		}
+	}
+	return skipped, nil
+}
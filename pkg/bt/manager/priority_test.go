@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func TestOnlyFilesPriorities(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt": []byte("aaaaaa"),
+		"b.iso": []byte("bbbbbb"),
+		"c.txt": []byte("cccccccc"),
+	}
+	// pieces: aaaa | aabb | bbbb | cccc | cccc
+	torrent := multiFileTorrent(4, files, "a.txt", "b.iso", "c.txt")
+
+	only, err := OnlyFiles(torrent, "*.iso")
+	if err != nil {
+		t.Fatalf("failed to match files: %v", err)
+	}
+	want := []picker.Priority{picker.Skip, picker.Normal, picker.Normal, picker.Skip, picker.Skip}
+	priorities, err := piecePriorities(torrent, only)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range priorities {
+		if p != want[i] {
+			t.Errorf("expected piece %d to be %s got %s", i, want[i], p)
+		}
+	}
+
+	only[filepath.Join("dir", "c.txt")] = picker.High
+	if p, _ := piecePriorities(torrent, only); p[3] != picker.High || p[1] != picker.Normal {
+		t.Errorf("incorrect priorities %v", p)
+	}
+
+	if _, err := OnlyFiles(torrent, "*.mkv"); !errors.Is(err, ErrNoFilesMatched) {
+		t.Errorf("expected no files to match got %v", err)
+	}
+}
+
+func TestWritePieceSkipsFiles(t *testing.T) {
+	files := map[string][]byte{
+		"a": []byte("aaaaaa"),
+		"b": []byte("bbbbbb"),
+	}
+	torrent := multiFileTorrent(4, files, "a", "b")
+	priorities := FilePriorities{filepath.Join("dir", "a"): picker.Skip}
+	store := storage.NewMemory(torrent)
+
+	// the boundary piece holds the end of a and the start of b
+	skipped, err := writePiece(store, torrent, priorities, &types.Piece{Index: 1, Data: []byte("aabb")})
+	if err != nil {
+		t.Fatalf("failed to write piece: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0] != filepath.Join("dir", "a") {
+		t.Errorf("expected a to be left out got %v", skipped)
+	}
+	buf := make([]byte, 2)
+	if _, err := store.ReadBlock(buf, 1, 2); err != nil || string(buf) != "bb" {
+		t.Errorf("expected the wanted range to be written got %q: %v", buf, err)
+	}
+	if _, err := store.ReadBlock(buf, 1, 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected the skipped range not to be written got %v", err)
+	}
+}
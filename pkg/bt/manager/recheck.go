@@ -0,0 +1,190 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// RecheckWorkers is the number of pieces that are hashed at the same time when checking existing data
+var RecheckWorkers = runtime.NumCPU()
+
+// FileStatus is the state of a file of the torrent found by Recheck
+type FileStatus int
+
+const (
+	// FileMissing files don't exist
+	FileMissing FileStatus = iota
+	// FileCorrupt files exist but none of their pieces match
+	FileCorrupt
+	// FilePartial files have some of their pieces
+	FilePartial
+	// FileComplete files have all of their pieces
+	FileComplete
+)
+
+func (s FileStatus) String() string {
+	switch s {
+	case FileMissing:
+		return "missing"
+	case FileCorrupt:
+		return "corrupt"
+	case FilePartial:
+		return "partial"
+	case FileComplete:
+		return "complete"
+	}
+	return fmt.Sprintf("FileStatus(%d)", int(s))
+}
+
+// FileCheck is the result of checking a single file of the torrent
+type FileCheck struct {
+	types.FileSpan
+	Status FileStatus
+	// Good is the number of pieces with data of the file that match their hash
+	Good int
+	// Total is the number of pieces with data of the file
+	Total int
+}
+
+// RecheckResult is what Recheck found in the existing data of a torrent
+type RecheckResult struct {
+	// Pieces has a bit set for every piece that matches its hash
+	Pieces *peer.BitField
+	Files  []FileCheck
+}
+
+// Complete reports whether every piece of the torrent is intact
+func (r *RecheckResult) Complete() bool {
+	for _, f := range r.Files {
+		if f.Status != FileComplete {
+			return false
+		}
+	}
+	return true
+}
+
+// Recheck hashes the existing data of the torrent at dst and reports which pieces and files are intact.
+// For single file torrents dst is the file, for torrents with several files it is the directory that
+// holds them. Rechecking stops with the error of ctx when ctx is done.
+func (tm *TorrentManager) Recheck(ctx context.Context, torrent *types.Torrent, dst string) (*RecheckResult, error) {
+	data, err := storage.OpenFiles(torrent, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	pieces, err := hashPieces(ctx, torrent, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	result := &RecheckResult{Pieces: pieces}
+	for _, span := range spans {
+		first, last := torrent.PieceRange(span)
+		check := FileCheck{FileSpan: span, Total: last - first + 1}
+		for p := first; p <= last; p++ {
+			if pieces.Has(p) {
+				check.Good++
+			}
+		}
+
+		path, err := storage.FilePath(torrent, dst, span)
+		if err != nil {
+			return nil, err
+		}
+		_, err = os.Stat(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			check.Status = FileMissing
+		case err != nil:
+			return nil, err
+		case check.Good == check.Total:
+			check.Status = FileComplete
+		case check.Good > 0:
+			check.Status = FilePartial
+		default:
+			check.Status = FileCorrupt
+		}
+		result.Files = append(result.Files, check)
+	}
+
+	return result, nil
+}
+
+// hashPieces hashes the pieces in parallel and returns a bitfield of the ones that match their hash. Only
+// the pieces set in only are hashed, or all of them if only is nil. Once ctx is done the pieces that
+// weren't hashed yet are left out. Pieces without data don't match, but data that can't be read, like
+// files we have no permission for, fails the check rather than counting as corrupt.
+func hashPieces(ctx context.Context, torrent *types.Torrent, data storage.Storage, only *peer.BitField) (*peer.BitField, error) {
+	good := peer.NewBitField(torrent.GetPieceCount())
+	var mu sync.Mutex
+	var readErr error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < RecheckWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, torrent.PieceLength)
+			for idx := range indexes {
+				plan := torrent.BlockPlan(idx, MaxBlockSize)
+				piece := buf[:plan.PieceLength]
+				if _, err := data.ReadBlock(piece, idx, 0); errors.Is(err, io.ErrUnexpectedEOF) {
+					continue
+				} else if err != nil {
+					mu.Lock()
+					if readErr == nil {
+						readErr = fmt.Errorf("failed to read piece %d: %w", idx, err)
+					}
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				if hash := sha1.Sum(piece); bytes.Equal(hash[:], plan.Hash) {
+					mu.Lock()
+					good.Set(idx)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < torrent.GetPieceCount(); i++ {
+		if only != nil && !only.Has(i) {
+			continue
+		}
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if readErr != nil {
+		return nil, readErr
+	}
+	return good, nil
+}
@@ -0,0 +1,110 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func multiFileTorrent(pieceLength int, files map[string][]byte, order ...string) *types.Torrent {
+	t := &types.Torrent{Name: "multi", PieceLength: pieceLength}
+	var data []byte
+	for _, name := range order {
+		t.Files = append(t.Files, &types.FileInfo{Length: len(files[name]), Paths: []string{"dir", name}})
+		data = append(data, files[name]...)
+	}
+	t.Length = len(data)
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[i:end])
+		t.PieceHashes = append(t.PieceHashes, string(hash[:]))
+	}
+	return t
+}
+
+func TestRecheck(t *testing.T) {
+	files := map[string][]byte{
+		"a": []byte("aaaaaa"),
+		"b": []byte("bbbbbb"),
+		"c": []byte("cccccccc"),
+		"d": []byte("dddd"),
+	}
+	// pieces: aaaa | aabb | bbbb | cccc | cccc | dddd
+	torrent := multiFileTorrent(4, files, "a", "b", "c", "d")
+
+	dst := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dst, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(dst, "dir", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", files["a"])
+	write("b", files["b"])
+	write("c", []byte("ccccxxxx"))
+
+	tm := &TorrentManager{}
+	result, err := tm.Recheck(context.Background(), torrent, dst)
+	if err != nil {
+		t.Fatalf("recheck failed: %v", err)
+	}
+
+	for i, want := range []bool{true, true, true, true, false, false} {
+		if result.Pieces.Has(i) != want {
+			t.Errorf("expected piece %d to be %v", i, want)
+		}
+	}
+	want := []FileStatus{FileComplete, FileComplete, FilePartial, FileMissing}
+	for i, f := range result.Files {
+		if f.Status != want[i] {
+			t.Errorf("expected %s to be %s got %s (%d/%d)", f.Path, want[i], f.Status, f.Good, f.Total)
+		}
+	}
+	if result.Complete() {
+		t.Errorf("result should not be complete")
+	}
+
+	write("c", []byte("xxxxxxxx"))
+	write("d", files["d"])
+	result, err = tm.Recheck(context.Background(), torrent, dst)
+	if err != nil {
+		t.Fatalf("recheck failed: %v", err)
+	}
+	if f := result.Files[2]; f.Status != FileCorrupt {
+		t.Errorf("expected %s to be corrupt got %s", f.Path, f.Status)
+	}
+	if f := result.Files[3]; f.Status != FileComplete {
+		t.Errorf("expected %s to be complete got %s", f.Path, f.Status)
+	}
+}
+
+func TestRecheckUnreadableFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read every file")
+	}
+	files := map[string][]byte{"a": []byte("aaaa")}
+	torrent := multiFileTorrent(4, files, "a")
+	dst := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dst, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "dir", "a"), files["a"], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// data we can't read isn't corrupt, we just can't tell
+	tm := &TorrentManager{}
+	if _, err := tm.Recheck(context.Background(), torrent, dst); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected %v got %v", os.ErrPermission, err)
+	}
+}
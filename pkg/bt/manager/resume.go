@@ -0,0 +1,319 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// ResumeSuffix is appended to the destination of a download to get the path of its resume file
+const ResumeSuffix = ".resume"
+
+// ResumeInterval is how often the resume file is written while downloading
+const ResumeInterval = 30 * time.Second
+
+var ErrResumeMismatch = fmt.Errorf("resume data does not belong to the torrent")
+
+// FileState is the size and modification time of a file when the resume data was written. If the file
+// changed since then the pieces the resume data claims are checked again before they are trusted.
+type FileState struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// PartialPiece are the blocks received for a piece that was not complete yet
+type PartialPiece struct {
+	Index  int
+	Blocks []*peer.PieceBlock
+}
+
+// ResumeData is the state of a download that is persisted next to the destination, so that a download
+// that got interrupted only fetches the pieces it is missing when it is started again.
+type ResumeData struct {
+	InfoHash [20]byte
+	// Pieces has a bit set for every piece that was verified and written to the destination
+	Pieces *peer.BitField
+	// Partial holds the blocks of pieces that were in progress. The blocks are not written to the
+	// destination before the piece is complete, so the resume file is the only place they are kept.
+	Partial []*PartialPiece
+	Files   []FileState
+	// Skipped has, by path, the pieces that were stored without their part of the file because the file
+	// was skipped. Those pieces are downloaded again once the file is wanted or read.
+	Skipped map[string]*peer.BitField
+}
+
+func NewResumeData(torrent *types.Torrent) *ResumeData {
+	return &ResumeData{
+		InfoHash: torrent.Hash,
+		Pieces:   peer.NewBitField(torrent.GetPieceCount()),
+		Skipped:  map[string]*peer.BitField{},
+	}
+}
+
+// skip records that the part of the file at path was left out when the piece was stored
+func (r *ResumeData) skip(path string, piece int) {
+	pieces, ok := r.Skipped[path]
+	if !ok {
+		pieces = &peer.BitField{Field: make([]byte, len(r.Pieces.Field))}
+		r.Skipped[path] = pieces
+	}
+	pieces.Set(piece)
+}
+
+// unskip forgets the pieces that were stored without their part of the file at path, so that they are
+// downloaded again, and returns them
+func (r *ResumeData) unskip(path string) []int {
+	pieces, ok := r.Skipped[path]
+	if !ok {
+		return nil
+	}
+	delete(r.Skipped, path)
+	missing := []int{}
+	for i := 0; i < len(pieces.Field)*8; i++ {
+		if pieces.Has(i) && r.Pieces.Has(i) {
+			r.Pieces.Clear(i)
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// ResumePath returns the path of the resume file for the destination
+func ResumePath(dst string) string {
+	return dst + ResumeSuffix
+}
+
+// Matches reports whether the resume data was written for the torrent
+func (r *ResumeData) Matches(torrent *types.Torrent) bool {
+	return r.InfoHash == torrent.Hash && len(r.Pieces.Field) == bt.Ceil(torrent.GetPieceCount(), 8)
+}
+
+func (r *ResumeData) Encode() ([]byte, error) {
+	partial := []interface{}{}
+	for _, p := range r.Partial {
+		blocks := []interface{}{}
+		for _, blk := range p.Blocks {
+			blocks = append(blocks, map[string]interface{}{
+				"begin": blk.Begin,
+				"data":  string(blk.Data),
+			})
+		}
+		partial = append(partial, map[string]interface{}{
+			"piece":  p.Index,
+			"blocks": blocks,
+		})
+	}
+
+	files := []interface{}{}
+	for _, f := range r.Files {
+		files = append(files, map[string]interface{}{
+			"path":  f.Path,
+			"size":  f.Size,
+			"mtime": f.ModTime.UnixNano(),
+		})
+	}
+
+	skipped := map[string]interface{}{}
+	for path, pieces := range r.Skipped {
+		skipped[path] = string(pieces.Field)
+	}
+
+	return encoding.NewBenEncoder().Encode(map[string]interface{}{
+		"info-hash": string(r.InfoHash[:]),
+		"pieces":    string(r.Pieces.Field),
+		"partial":   partial,
+		"files":     files,
+		"skipped":   skipped,
+	})
+}
+
+func DecodeResumeData(data []byte) (*ResumeData, error) {
+	v, err := encoding.DecodeBencode(encoding.NewBencodeReader(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed resume data: %w", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected resume data dictionary but got %T", v)
+	}
+
+	r := &ResumeData{Skipped: map[string]*peer.BitField{}}
+	hash, ok := dict["info-hash"].(string)
+	if !ok || len(hash) != len(r.InfoHash) {
+		return nil, fmt.Errorf("malformed resume data: missing info hash")
+	}
+	copy(r.InfoHash[:], hash)
+
+	pieces, ok := dict["pieces"].(string)
+	if !ok {
+		return nil, fmt.Errorf("malformed resume data: missing pieces")
+	}
+	r.Pieces = &peer.BitField{Field: []byte(pieces)}
+
+	partial, _ := dict["partial"].([]interface{})
+	for _, v := range partial {
+		p, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index, ok := p["piece"].(int)
+		if !ok {
+			continue
+		}
+		piece := &PartialPiece{Index: index}
+		blocks, _ := p["blocks"].([]interface{})
+		for _, v := range blocks {
+			b, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			begin, ok := b["begin"].(int)
+			data, ok2 := b["data"].(string)
+			if !ok || !ok2 {
+				continue
+			}
+			piece.Blocks = append(piece.Blocks, &peer.PieceBlock{Index: index, Begin: begin, Data: []byte(data)})
+		}
+		r.Partial = append(r.Partial, piece)
+	}
+
+	files, _ := dict["files"].([]interface{})
+	for _, v := range files {
+		f, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		path, _ := f["path"].(string)
+		size, _ := f["size"].(int)
+		mtime, _ := f["mtime"].(int)
+		r.Files = append(r.Files, FileState{Path: path, Size: int64(size), ModTime: time.Unix(0, int64(mtime))})
+	}
+
+	skipped, _ := dict["skipped"].(map[string]interface{})
+	for path, v := range skipped {
+		if pieces, ok := v.(string); ok && len(pieces) == len(r.Pieces.Field) {
+			r.Skipped[path] = &peer.BitField{Field: []byte(pieces)}
+		}
+	}
+
+	return r, nil
+}
+
+// LoadResumeData reads the resume file at path
+func LoadResumeData(path string) (*ResumeData, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeResumeData(data)
+}
+
+// Save writes the resume data to path. The data is written to a temporary file first, so an interrupted
+// save leaves the previous resume file intact.
+func (r *ResumeData) Save(path string) error {
+	data, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func statFile(path string) (FileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileState{}, err
+	}
+	return FileState{Path: path, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// fileStates returns the state of the files of a download to dst that exist
+func fileStates(torrent *types.Torrent, dst string) ([]FileState, error) {
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	states := []FileState{}
+	for _, span := range spans {
+		path, err := storage.FilePath(torrent, dst, span)
+		if err != nil {
+			return nil, err
+		}
+		if state, err := statFile(path); err == nil {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+// loadResumeData loads the resume data for a download to dst and checks it against the data that is
+// there. Missing or unusable resume data results in a download that starts from scratch. If the files
+// changed since the resume data was written, the pieces it claims are hashed again and only the ones
+// that still match are kept.
+func loadResumeData(ctx context.Context, torrent *types.Torrent, dst string, data storage.Storage, logger *slog.Logger) *ResumeData {
+	fresh := NewResumeData(torrent)
+	r, err := LoadResumeData(ResumePath(dst))
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh
+	} else if err != nil {
+		logger.Warn("ignoring resume data", "err", err)
+		return fresh
+	}
+	if !r.Matches(torrent) {
+		logger.Warn("ignoring resume data", "err", ErrResumeMismatch)
+		return fresh
+	}
+
+	current, err := fileStates(torrent, dst)
+	if err != nil {
+		logger.Warn("ignoring resume data", "err", err)
+		return fresh
+	}
+	changed := len(current) != len(r.Files)
+	for i := 0; i < len(current) && !changed; i++ {
+		if current[i].Path != r.Files[i].Path || current[i].Size != r.Files[i].Size {
+			changed = true
+		}
+	}
+	if changed {
+		// the blocks of partial pieces live in the resume file, so those are still good
+		fresh.Partial = r.Partial
+		return fresh
+	}
+	for i := range current {
+		if !current[i].ModTime.Equal(r.Files[i].ModTime) {
+			pieces, err := hashPieces(ctx, torrent, data, r.Pieces)
+			if err != nil {
+				logger.Warn("ignoring resume data", "err", err)
+				return fresh
+			}
+			r.Pieces = pieces
+			break
+		}
+	}
+	return r
+}
+
+// missingPlans returns the block plans of the pieces the resume data doesn't have
+func (r *ResumeData) missingPlans(torrent *types.Torrent) []*types.BlockPlan {
+	missing := []*types.BlockPlan{}
+	for _, plan := range torrent.AllBlockPlans(MaxBlockSize) {
+		if !r.Pieces.Has(plan.PieceIndex) {
+			missing = append(missing, plan)
+		}
+	}
+	return missing
+}
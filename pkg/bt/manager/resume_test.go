@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha1"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func testTorrent(pieceLength int, data []byte) *types.Torrent {
+	t := &types.Torrent{
+		Name:        "test",
+		PieceLength: pieceLength,
+		Length:      len(data),
+	}
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[i:end])
+		t.PieceHashes = append(t.PieceHashes, string(hash[:]))
+	}
+	t.Hash = sha1.Sum(data)
+	return t
+}
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	r := &ResumeData{
+		InfoHash: [20]byte{1, 2, 3},
+		Pieces:   &peer.BitField{Field: []byte{0b10100000}},
+		Partial: []*PartialPiece{
+			{Index: 1, Blocks: []*peer.PieceBlock{{Index: 1, Begin: 16384, Data: []byte("block\x00data")}}},
+		},
+		Files:   []FileState{{Path: "out", Size: 42, ModTime: time.Unix(0, 1700000000123456789)}},
+		Skipped: map[string]*peer.BitField{"dir/skipped": {Field: []byte{0b00100000}}},
+	}
+
+	data, err := r.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode resume data: %v", err)
+	}
+	other, err := DecodeResumeData(data)
+	if err != nil {
+		t.Fatalf("failed to decode resume data: %v", err)
+	}
+
+	if other.InfoHash != r.InfoHash || !other.Pieces.Equal(r.Pieces) {
+		t.Errorf("incorrect info hash or pieces: %x %x", other.InfoHash, other.Pieces.Field)
+	}
+	if len(other.Partial) != 1 || other.Partial[0].Index != 1 || len(other.Partial[0].Blocks) != 1 {
+		t.Fatalf("incorrect partial pieces: %#v", other.Partial)
+	}
+	if blk := other.Partial[0].Blocks[0]; blk.Begin != 16384 || string(blk.Data) != "block\x00data" {
+		t.Errorf("incorrect partial block: %#v", blk)
+	}
+	if len(other.Files) != 1 || other.Files[0].Size != 42 || !other.Files[0].ModTime.Equal(r.Files[0].ModTime) {
+		t.Errorf("incorrect files: %#v", other.Files)
+	}
+	if skipped := other.Skipped["dir/skipped"]; skipped == nil || !skipped.Has(2) || skipped.Has(0) {
+		t.Errorf("incorrect skipped pieces: %#v", other.Skipped)
+	}
+}
+
+func TestLoadResumeDataChecksChangedFiles(t *testing.T) {
+	data := []byte("aaaabbbbcc")
+	torrent := testTorrent(4, data)
+	dst := filepath.Join(t.TempDir(), "out")
+
+	// piece 1 is corrupt on disk even though the resume data claims it
+	if err := os.WriteFile(dst, []byte("aaaaxxxxcc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := statFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResumeData(torrent)
+	r.Pieces.Set(0)
+	r.Pieces.Set(1)
+	r.Files = []FileState{state}
+	r.Partial = []*PartialPiece{{Index: 2, Blocks: []*peer.PieceBlock{{Index: 2, Data: []byte("c")}}}}
+	if err := r.Save(ResumePath(dst)); err != nil {
+		t.Fatalf("failed to save resume data: %v", err)
+	}
+
+	store, err := storage.OpenFiles(torrent, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// unchanged files are trusted
+	loaded := loadResumeData(context.Background(), torrent, dst, store, slog.Default())
+	if !loaded.Pieces.Has(0) || !loaded.Pieces.Has(1) || len(loaded.Partial) != 1 {
+		t.Fatalf("expected resume data to be used as is: %x %v", loaded.Pieces.Field, loaded.Partial)
+	}
+
+	later := state.ModTime.Add(time.Second)
+	if err := os.Chtimes(dst, later, later); err != nil {
+		t.Fatal(err)
+	}
+	loaded = loadResumeData(context.Background(), torrent, dst, store, slog.Default())
+	if !loaded.Pieces.Has(0) || loaded.Pieces.Has(1) {
+		t.Fatalf("expected only the intact piece to be kept: %x", loaded.Pieces.Field)
+	}
+	if plans := loaded.missingPlans(torrent); len(plans) != 2 || plans[0].PieceIndex != 1 || plans[1].PieceIndex != 2 {
+		t.Fatalf("expected pieces 1 and 2 to be missing got %d plans", len(plans))
+	}
+
+	// resume data of another torrent is ignored
+	other := testTorrent(4, []byte("something else"))
+	if loaded := loadResumeData(context.Background(), other, dst, store, slog.Default()); loaded.Pieces.Has(0) || len(loaded.Partial) != 0 {
+		t.Fatalf("resume data of another torrent should not be used")
+	}
+}
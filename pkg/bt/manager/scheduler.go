@@ -0,0 +1,544 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// MaxEndgameRequesters is the number of peers a block is requested from at the same time in endgame mode
+const MaxEndgameRequesters = 3
+
+// SuspectAvoidTime is how long the blocks of a piece that failed its hash check go to other peers than
+// the ones that sent them, so that the copies can be compared to find the peer that sent corrupt data
+const SuspectAvoidTime = 30 * time.Second
+
+// blockState tracks a single block of a piece that is being downloaded
+type blockState struct {
+	// requesters are the peers the block is requested from. Outside of endgame mode there is at most one.
+	requesters []*peer.Client
+	data       []byte
+	// from is the peer that sent data, nil for blocks restored from resume data
+	from *types.Peer
+	// avoid is the peer that let a request for this block time out. The block goes to other peers
+	// first until avoidUntil has passed.
+	avoid      string
+	avoidUntil time.Time
+}
+
+// pieceProgress tracks the blocks of a piece that is being downloaded
+type pieceProgress struct {
+	plan     *types.BlockPlan
+	blocks   []blockState
+	received int
+}
+
+func newPieceProgress(plan *types.BlockPlan) *pieceProgress {
+	return &pieceProgress{
+		plan:   plan,
+		blocks: make([]blockState, plan.NumBlocks),
+	}
+}
+
+func (pp *pieceProgress) blockIndex(begin int) (int, bool) {
+	if begin%pp.plan.BlockSize != 0 {
+		return 0, false
+	}
+	i := begin / pp.plan.BlockSize
+	return i, i < pp.plan.NumBlocks
+}
+
+func (b *blockState) requestedBy(c *peer.Client) bool {
+	for _, other := range b.requesters {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blockState) removeRequester(c *peer.Client) {
+	for i, other := range b.requesters {
+		if other == c {
+			b.requesters = append(b.requesters[:i], b.requesters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (pp *pieceProgress) request(i int) *peer.PieceRequest {
+	return &peer.PieceRequest{
+		Index:  pp.plan.PieceIndex,
+		Begin:  i * pp.plan.BlockSize,
+		Length: pp.plan.BlockSizeFor(i),
+	}
+}
+
+// nextRequest assigns c the first block nobody has requested yet. In endgame mode blocks that are
+// already requested from other peers are handed out as well.
+func (pp *pieceProgress) nextRequest(c *peer.Client, endgame bool) (*peer.PieceRequest, bool) {
+	now := time.Now()
+	addr := c.Peer.String()
+	for i := range pp.blocks {
+		b := &pp.blocks[i]
+		if b.data != nil || b.requestedBy(c) {
+			continue
+		}
+		if endgame && len(b.requesters) >= MaxEndgameRequesters {
+			continue
+		}
+		if !endgame && len(b.requesters) > 0 {
+			continue
+		}
+		if b.avoid == addr && now.Before(b.avoidUntil) {
+			continue
+		}
+		b.requesters = append(b.requesters, c)
+		b.avoid = ""
+		return pp.request(i), true
+	}
+	return nil, false
+}
+
+// unrequested reports whether any block still has to be requested from someone
+func (pp *pieceProgress) unrequested() bool {
+	for _, b := range pp.blocks {
+		if b.data == nil && len(b.requesters) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// suspectBlock is a block of a piece that failed its hash check and the peer that sent it
+type suspectBlock struct {
+	block int
+	peer  *types.Peer
+	hash  [20]byte
+}
+
+// suspects returns the blocks of a piece that failed its hash check. When every block came from the
+// same peer there is nothing to compare and that peer is returned as the culprit instead.
+func (pp *pieceProgress) suspects() ([]suspectBlock, *types.Peer) {
+	var suspects []suspectBlock
+	var only *types.Peer
+	single := true
+	for i, b := range pp.blocks {
+		if b.from == nil {
+			single = false
+			continue
+		}
+		if only == nil {
+			only = b.from
+		} else if only.String() != b.from.String() {
+			single = false
+		}
+		suspects = append(suspects, suspectBlock{block: i, peer: b.from, hash: sha1.Sum(b.data)})
+	}
+	if single && only != nil {
+		return nil, only
+	}
+	return suspects, nil
+}
+
+// avoidSuspects hands the blocks of a piece that failed its hash check to other peers than the ones that
+// sent them before
+func (pp *pieceProgress) avoidSuspects(suspects []suspectBlock, until time.Time) {
+	for _, sb := range suspects {
+		b := &pp.blocks[sb.block]
+		b.avoid = sb.peer.String()
+		b.avoidUntil = until
+	}
+}
+
+func (pp *pieceProgress) data() []byte {
+	data := make([]byte, 0, pp.plan.PieceLength)
+	for _, b := range pp.blocks {
+		data = append(data, b.data...)
+	}
+	return data
+}
+
+// blockScheduler hands out the blocks of a torrent to the pipelines of all the peers we download from.
+// Blocks of pieces that are already in progress are handed out first so that pieces complete as soon as
+// possible, after that the picker decides which piece the peer starts on next.
+//
+// Once every remaining block has been requested the scheduler switches to endgame mode. The last blocks
+// are then requested from several peers at once and as soon as one copy arrives the requests to the other
+// peers are cancelled, so that one slow peer can't hold up the end of the download.
+//
+// When a piece fails its hash check the scheduler remembers which peer sent which block and downloads
+// the blocks again from other peers. Once the piece passes, the peers whose blocks differ from the good
+// ones sent corrupt data and are reported on corrupt.
+type blockScheduler struct {
+	sync.Mutex
+
+	picker  *picker.Picker
+	plans   map[int]*types.BlockPlan
+	active  []*pieceProgress
+	endgame bool
+	// downloaded counts the bytes of every block received
+	downloaded bt.Meter
+
+	// suspects are the blocks of the pieces that failed their hash check, by piece
+	suspects map[int][]suspectBlock
+
+	complete chan *types.Piece
+	failed   chan *PieceDownloadFailedErr
+	corrupt  chan []*types.Peer
+	// done is closed once nobody reads complete, failed and corrupt anymore, which drops what is left
+	// to send on them
+	done <-chan struct{}
+
+	log *slog.Logger
+}
+
+// newBlockScheduler creates a scheduler that downloads the planned pieces. Pieces the picker knows about
+// that aren't planned are marked as ones we already have. Sends on complete, failed and corrupt give up
+// once done is closed.
+func newBlockScheduler(plans []*types.BlockPlan, pk *picker.Picker, done <-chan struct{}) *blockScheduler {
+	byIndex := map[int]*types.BlockPlan{}
+	for _, plan := range plans {
+		byIndex[plan.PieceIndex] = plan
+	}
+	for i := 0; i < pk.Len(); i++ {
+		if _, ok := byIndex[i]; !ok {
+			pk.MarkHave(i)
+		}
+	}
+	return &blockScheduler{
+		picker:   pk,
+		plans:    byIndex,
+		suspects: map[int][]suspectBlock{},
+		complete: make(chan *types.Piece, len(plans)),
+		failed:   make(chan *PieceDownloadFailedErr, len(plans)),
+		corrupt:  make(chan []*types.Peer, len(plans)),
+		done:     done,
+		log:      slog.Default(),
+	}
+}
+
+// restore seeds the scheduler with the blocks of a piece that were received before the download got
+// interrupted, so that only the missing blocks are requested
+func (s *blockScheduler) restore(partial *PartialPiece) {
+	s.Lock()
+	defer s.Unlock()
+	plan, ok := s.plans[partial.Index]
+	if !ok || s.progressFor(partial.Index) != nil {
+		return
+	}
+	pp := newPieceProgress(plan)
+	for _, blk := range partial.Blocks {
+		i, ok := pp.blockIndex(blk.Begin)
+		if !ok || pp.blocks[i].data != nil || len(blk.Data) != plan.BlockSizeFor(i) {
+			continue
+		}
+		pp.blocks[i].data = blk.Data
+		pp.received++
+	}
+	// a piece with every block would have been finished, so something is off - download it again
+	if pp.received == 0 || pp.received == plan.NumBlocks {
+		return
+	}
+	s.picker.Reserve(plan.PieceIndex)
+	s.active = append(s.active, pp)
+}
+
+// want makes a piece that was downloaded before wanted again, so that it is downloaded once more
+func (s *blockScheduler) want(plan *types.BlockPlan) {
+	s.Lock()
+	s.plans[plan.PieceIndex] = plan
+	s.Unlock()
+	s.picker.MarkMissing(plan.PieceIndex)
+}
+
+// partial returns the blocks received so far of the pieces that are in progress
+func (s *blockScheduler) partial() []*PartialPiece {
+	s.Lock()
+	defer s.Unlock()
+	partial := []*PartialPiece{}
+	for _, pp := range s.active {
+		if pp.received == 0 {
+			continue
+		}
+		p := &PartialPiece{Index: pp.plan.PieceIndex}
+		for i, b := range pp.blocks {
+			if b.data != nil {
+				p.Blocks = append(p.Blocks, &peer.PieceBlock{Index: p.Index, Begin: i * pp.plan.BlockSize, Data: b.data})
+			}
+		}
+		partial = append(partial, p)
+	}
+	return partial
+}
+
+func (s *blockScheduler) progressFor(index int) *pieceProgress {
+	for _, pp := range s.active {
+		if pp.plan.PieceIndex == index {
+			return pp
+		}
+	}
+	return nil
+}
+
+func (s *blockScheduler) removeActive(pp *pieceProgress) {
+	for i, other := range s.active {
+		if other == pp {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// NextRequest implements peer.BlockSource
+func (s *blockScheduler) NextRequest(c *peer.Client) (*peer.PieceRequest, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	addr := c.Peer.String()
+	allowed := requestable(c)
+	// time critical pieces go before the other pieces in progress
+	for _, critical := range []bool{true, false} {
+		for _, pp := range s.active {
+			if (s.picker.Priority(pp.plan.PieceIndex) == picker.Critical) != critical {
+				continue
+			}
+			if !s.picker.HasPiece(addr, pp.plan.PieceIndex) || (allowed != nil && !allowed.Has(pp.plan.PieceIndex)) {
+				continue
+			}
+			if req, ok := pp.nextRequest(c, false); ok {
+				return req, true
+			}
+		}
+	}
+
+	if idx, ok := s.picker.PickFrom(addr, allowed); ok {
+		pp := newPieceProgress(s.plans[idx])
+		pp.avoidSuspects(s.suspects[idx], time.Now().Add(SuspectAvoidTime))
+		s.active = append(s.active, pp)
+		return pp.nextRequest(c, false)
+	}
+
+	if !s.inEndgame() {
+		return nil, false
+	}
+	for _, pp := range s.active {
+		if !s.picker.HasPiece(addr, pp.plan.PieceIndex) || (allowed != nil && !allowed.Has(pp.plan.PieceIndex)) {
+			continue
+		}
+		if req, ok := pp.nextRequest(c, true); ok {
+			return req, true
+		}
+	}
+	return nil, false
+}
+
+// allowedFastSet is the set of pieces a peer lets us request while it chokes us. It reads the set from
+// the channel, so pieces the peer allows later are picked up as well.
+type allowedFastSet struct {
+	ch *peer.Channel
+}
+
+func (a allowedFastSet) Has(idx int) bool {
+	return a.ch.AllowedFast(idx)
+}
+
+// requestable returns the pieces that may be requested from the peer right now, or nil if there is no
+// restriction. Requests to a choking peer with the fast extension only go out for its allowed fast
+// pieces, anything else would sit in the queue and keep the allowed fast pieces from being requested.
+func requestable(c *peer.Client) picker.PieceSet {
+	if c.Channel.IsFast() && c.Channel.IsChoked() {
+		return allowedFastSet{ch: c.Channel}
+	}
+	return nil
+}
+
+// inEndgame reports whether every remaining block has been requested - the caller has to hold the lock
+func (s *blockScheduler) inEndgame() bool {
+	// pieces that become wanted after the endgame started end it again
+	if s.picker.Remaining() > 0 {
+		s.endgame = false
+		return false
+	}
+	if s.endgame {
+		return true
+	}
+	for _, pp := range s.active {
+		if pp.unrequested() {
+			return false
+		}
+	}
+	s.log.Info("entering endgame", "left", len(s.active))
+	s.endgame = true
+	return true
+}
+
+// BlockReceived implements peer.BlockSource
+func (s *blockScheduler) BlockReceived(c *peer.Client, blk *peer.PieceBlock) {
+	s.downloaded.Add(len(blk.Data))
+	s.Lock()
+	pp := s.progressFor(blk.Index)
+	if pp == nil {
+		s.Unlock()
+		return
+	}
+	i, ok := pp.blockIndex(blk.Begin)
+	if !ok || pp.blocks[i].data != nil || len(blk.Data) != pp.plan.BlockSizeFor(i) {
+		s.Unlock()
+		return
+	}
+	b := &pp.blocks[i]
+	b.data = blk.Data
+	b.from = c.Peer
+	b.removeRequester(c)
+	cancel := b.requesters
+	b.requesters = nil
+	pp.received++
+
+	var piece *types.Piece
+	var failure *PieceDownloadFailedErr
+	var corrupt []*types.Peer
+	if pp.received == pp.plan.NumBlocks {
+		piece, failure, corrupt = s.finish(c, pp)
+	}
+	s.Unlock()
+
+	s.cancel(cancel, pp.request(i))
+	if failure != nil {
+		select {
+		case s.failed <- failure:
+		case <-s.done:
+		}
+	}
+	if len(corrupt) > 0 {
+		select {
+		case s.corrupt <- corrupt:
+		case <-s.done:
+		}
+	}
+	if piece != nil {
+		select {
+		case s.complete <- piece:
+		case <-s.done:
+		}
+	}
+}
+
+// finish verifies a piece that has all its blocks. A piece that fails the hash check is put back to be
+// downloaded again. It also returns the peers that turned out to have sent corrupt data - the caller has
+// to hold the lock.
+func (s *blockScheduler) finish(c *peer.Client, pp *pieceProgress) (*types.Piece, *PieceDownloadFailedErr, []*types.Peer) {
+	s.removeActive(pp)
+
+	index := pp.plan.PieceIndex
+	data := pp.data()
+	hash := sha1.Sum(data)
+	if !bytes.Equal(hash[:], pp.plan.Hash) {
+		s.picker.Unpick(index)
+		failure := &PieceDownloadFailedErr{
+			Err:       fmt.Errorf("hash mismatch from %s", c.Peer.String()),
+			BlockPlan: pp.plan,
+			Peer:      c.Peer.String(),
+		}
+		suspects, culprit := pp.suspects()
+		if culprit != nil {
+			return nil, failure, []*types.Peer{culprit}
+		}
+		s.suspects[index] = append(s.suspects[index], suspects...)
+		return nil, failure, nil
+	}
+	s.picker.MarkHave(index)
+
+	var corrupt []*types.Peer
+	seen := map[string]bool{}
+	for _, sb := range s.suspects[index] {
+		addr := sb.peer.String()
+		if seen[addr] || sha1.Sum(pp.blocks[sb.block].data) == sb.hash {
+			continue
+		}
+		seen[addr] = true
+		corrupt = append(corrupt, sb.peer)
+	}
+	delete(s.suspects, index)
+
+	return &types.Piece{
+		Index: pp.plan.PieceIndex,
+		Peer:  *c.Peer,
+		Size:  pp.plan.PieceLength,
+		Data:  data,
+		Hash:  hash,
+	}, nil, corrupt
+}
+
+// cancel withdraws the request from the peers that were also asked for the block in endgame mode
+func (s *blockScheduler) cancel(clients []*peer.Client, req *peer.PieceRequest) {
+	for _, c := range clients {
+		if err := c.Channel.SendCancel(req.Index, req.Begin, req.Length); err != nil {
+			c.Channel.Logger().Debug("failed to cancel request", bt.PieceKey, req.Index, "err", err)
+		}
+	}
+}
+
+// Abandon implements peer.BlockSource
+func (s *blockScheduler) Abandon(c *peer.Client, reqs []peer.PieceRequest) {
+	s.Lock()
+	defer s.Unlock()
+	for _, req := range reqs {
+		pp := s.progressFor(req.Index)
+		if pp == nil {
+			continue
+		}
+		if i, ok := pp.blockIndex(req.Begin); ok {
+			pp.blocks[i].removeRequester(c)
+		}
+	}
+}
+
+// RequestTimedOut implements peer.BlockSource. The block is handed to other peers, and only goes back to
+// the peer that timed out once those have had as long as that peer had.
+func (s *blockScheduler) RequestTimedOut(c *peer.Client, req peer.PieceRequest, timeout time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	pp := s.progressFor(req.Index)
+	if pp == nil {
+		return nil
+	}
+	if i, ok := pp.blockIndex(req.Begin); ok && pp.blocks[i].data == nil {
+		b := &pp.blocks[i]
+		b.removeRequester(c)
+		b.avoid = c.Peer.String()
+		b.avoidUntil = time.Now().Add(timeout)
+	}
+	return nil
+}
+
+// RequestRejected hands the block back. A peer that rejects while it is unchoking us won't serve the
+// block, so it is avoided like a peer that timed out.
+func (s *blockScheduler) RequestRejected(c *peer.Client, req peer.PieceRequest) error {
+	if c.Channel.IsChoked() {
+		s.Abandon(c, []peer.PieceRequest{req})
+		return nil
+	}
+	return s.RequestTimedOut(c, req, peer.MinRequestTimeout)
+}
+
+// Wants implements peer.BlockSource
+func (s *blockScheduler) Wants(c *peer.Client) bool {
+	return !s.Finished() && s.picker.Interesting(c.Peer.String())
+}
+
+// Finished implements peer.BlockSource. The scheduler is finished once every piece that isn't skipped
+// has been downloaded, which changes when priorities do.
+func (s *blockScheduler) Finished() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.active) == 0 && s.picker.Remaining() == 0
+}
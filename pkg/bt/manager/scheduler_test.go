@@ -0,0 +1,269 @@
+package manager
+
+import (
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func newTestClient(t *testing.T, port int) *peer.Client {
+	t.Helper()
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	// the peer has every piece
+	ch := peer.NewChannel(local, &peer.Handshake{}, &peer.BitField{Field: []byte{0xff}}, nil)
+	t.Cleanup(func() {
+		ch.Close()
+		remote.Close()
+	})
+
+	return &peer.Client{
+		Peer:    &types.Peer{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		Channel: ch,
+	}
+}
+
+func newTestScheduler(plans []*types.BlockPlan, clients ...*peer.Client) *blockScheduler {
+	s := newBlockScheduler(plans, picker.New(len(plans)), nil)
+	for _, c := range clients {
+		s.picker.AddPeer(c.Peer.String(), c.Channel.Pieces())
+	}
+	return s
+}
+
+func testPlan(index int, data []byte, blockSize int) *types.BlockPlan {
+	hash := sha1.Sum(data)
+	numBlocks := (len(data) + blockSize - 1) / blockSize
+	lastBlockSize := len(data) - (numBlocks-1)*blockSize
+	return &types.BlockPlan{
+		PieceIndex:     index,
+		Hash:           hash[:],
+		PieceLength:    len(data),
+		NumBlocks:      numBlocks,
+		BlockSize:      blockSize,
+		LastBlockIndex: numBlocks - 1,
+		LastBlockSize:  lastBlockSize,
+	}
+}
+
+func block(req *peer.PieceRequest, data []byte) *peer.PieceBlock {
+	return &peer.PieceBlock{Index: req.Index, Begin: req.Begin, Data: data[req.Begin : req.Begin+req.Length]}
+}
+
+func TestSchedulerSpansPieces(t *testing.T) {
+	pieces := [][]byte{[]byte("aaaabbbb"), []byte("ccccdd")}
+	c := newTestClient(t, 1)
+	s := newTestScheduler([]*types.BlockPlan{testPlan(0, pieces[0], 4), testPlan(1, pieces[1], 4)}, c)
+
+	var reqs []*peer.PieceRequest
+	for {
+		req, ok := s.NextRequest(c)
+		if !ok {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	if len(reqs) != 4 {
+		t.Fatalf("expected all 4 blocks of both pieces to be requested got %d", len(reqs))
+	}
+
+	for _, req := range reqs {
+		s.BlockReceived(c, block(req, pieces[req.Index]))
+	}
+	if !s.Finished() {
+		t.Fatalf("scheduler should be finished once all blocks are received")
+	}
+	for i := 0; i < 2; i++ {
+		p := <-s.complete
+		if string(p.Data) != string(pieces[p.Index]) {
+			t.Errorf("incorrect data for piece %d: %q", p.Index, p.Data)
+		}
+	}
+}
+
+func TestSchedulerEndgame(t *testing.T) {
+	data := []byte("aaaabbbb")
+	slow := newTestClient(t, 1)
+	fast := newTestClient(t, 2)
+	s := newTestScheduler([]*types.BlockPlan{testPlan(0, data, 4)}, slow, fast)
+
+	first, _ := s.NextRequest(slow)
+	second, _ := s.NextRequest(slow)
+	if _, ok := s.NextRequest(slow); ok {
+		t.Fatalf("no blocks should be left for a peer that requested all of them")
+	}
+
+	// every block is requested now, so the other peer gets the same blocks
+	dup, ok := s.NextRequest(fast)
+	if !ok || *dup != *first {
+		t.Fatalf("expected endgame to hand out %v again got %v", first, dup)
+	}
+	s.BlockReceived(fast, block(dup, data))
+
+	if s.progressFor(0).blocks[0].requesters != nil {
+		t.Fatalf("block should have no requesters left once received")
+	}
+	// the block that arrived isn't handed out again
+	if req, ok := s.NextRequest(fast); !ok || *req != *second {
+		t.Fatalf("expected %v got %v", second, req)
+	}
+
+	s.BlockReceived(slow, block(second, data))
+	if p := <-s.complete; string(p.Data) != string(data) {
+		t.Fatalf("incorrect piece data %q", p.Data)
+	}
+}
+
+func TestSchedulerRetriesFailedPieces(t *testing.T) {
+	data := []byte("aaaa")
+	c := newTestClient(t, 1)
+	s := newTestScheduler([]*types.BlockPlan{testPlan(0, data, 4)}, c)
+
+	req, _ := s.NextRequest(c)
+	s.BlockReceived(c, block(req, []byte("bbbb")))
+	if err := <-s.failed; err.BlockPlan.PieceIndex != 0 {
+		t.Fatalf("expected piece 0 to fail got %d", err.BlockPlan.PieceIndex)
+	}
+	// every block came from the same peer, so it sent the corrupt data
+	if corrupt := <-s.corrupt; len(corrupt) != 1 || corrupt[0] != c.Peer {
+		t.Fatalf("expected %s to have sent corrupt data got %v", c.Peer.String(), corrupt)
+	}
+
+	req, ok := s.NextRequest(c)
+	if !ok {
+		t.Fatalf("failed piece should be requested again")
+	}
+	s.BlockReceived(c, block(req, data))
+	if !s.Finished() {
+		t.Fatalf("scheduler should be finished")
+	}
+}
+
+func TestSchedulerFindsPeersThatSendCorruptData(t *testing.T) {
+	data := []byte("aaaabbbb")
+	good, bad := newTestClient(t, 1), newTestClient(t, 2)
+	s := newTestScheduler([]*types.BlockPlan{testPlan(0, data, 4)}, good, bad)
+
+	first, _ := s.NextRequest(good)
+	second, _ := s.NextRequest(bad)
+	s.BlockReceived(good, block(first, data))
+	s.BlockReceived(bad, block(second, []byte("aaaaxxxx")))
+	<-s.failed
+	select {
+	case corrupt := <-s.corrupt:
+		t.Fatalf("can't know who sent corrupt data after the first failure but got %v", corrupt)
+	default:
+	}
+
+	// the blocks go to the other peer this time
+	retry := map[*peer.Client]*peer.PieceRequest{}
+	for _, c := range []*peer.Client{bad, good} {
+		req, ok := s.NextRequest(c)
+		if !ok {
+			t.Fatalf("failed piece should be requested again")
+		}
+		retry[c] = req
+	}
+	if retry[good].Begin != second.Begin || retry[bad].Begin != first.Begin {
+		t.Fatalf("expected the blocks to be requested from the other peer got %+v", retry)
+	}
+	for c, req := range retry {
+		s.BlockReceived(c, block(req, data))
+	}
+
+	select {
+	case corrupt := <-s.corrupt:
+		if len(corrupt) != 1 || corrupt[0] != bad.Peer {
+			t.Fatalf("expected %s to have sent corrupt data got %v", bad.Peer.String(), corrupt)
+		}
+	default:
+		t.Fatalf("expected the peer that sent corrupt data to be found")
+	}
+}
+
+func TestSchedulerOnlyHandsOutAdvertisedPieces(t *testing.T) {
+	pieces := [][]byte{[]byte("aaaa"), []byte("bbbb")}
+	s := newTestScheduler([]*types.BlockPlan{testPlan(0, pieces[0], 4), testPlan(1, pieces[1], 4)})
+	full := newTestClient(t, 1)
+	partial := newTestClient(t, 2)
+	s.picker.AddPeer(full.Peer.String(), full.Channel.Pieces())
+	s.picker.AddPeer(partial.Peer.String(), &peer.BitField{Field: []byte{0b01000000}})
+
+	req, ok := s.NextRequest(partial)
+	if !ok || req.Index != 1 {
+		t.Fatalf("expected the only piece the peer has to be requested got %v", req)
+	}
+	if _, ok := s.NextRequest(partial); ok {
+		t.Fatalf("peer should not be asked for pieces it doesn't have")
+	}
+
+	s.BlockReceived(partial, block(req, pieces[1]))
+	if s.Wants(partial) {
+		t.Fatalf("peer has nothing left that we want")
+	}
+	if !s.Wants(full) {
+		t.Fatalf("peer still has a piece we want")
+	}
+}
+
+func TestSchedulerRestoresPartialPieces(t *testing.T) {
+	data := []byte("aaaabbbbcc")
+	c := newTestClient(t, 1)
+	s := newTestScheduler([]*types.BlockPlan{testPlan(0, data, 4)}, c)
+	s.restore(&PartialPiece{Index: 0, Blocks: []*peer.PieceBlock{{Index: 0, Begin: 4, Data: []byte("bbbb")}}})
+
+	var reqs []*peer.PieceRequest
+	for {
+		req, ok := s.NextRequest(c)
+		if !ok {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	if len(reqs) != 2 || reqs[0].Begin != 0 || reqs[1].Begin != 8 {
+		t.Fatalf("expected only the missing blocks to be requested got %v", reqs)
+	}
+	if partial := s.partial(); len(partial) != 1 || len(partial[0].Blocks) != 1 {
+		t.Fatalf("expected the restored block to be reported as partial got %v", partial)
+	}
+
+	for _, req := range reqs {
+		s.BlockReceived(c, block(req, data))
+	}
+	if p := <-s.complete; string(p.Data) != string(data) {
+		t.Fatalf("incorrect piece data %q", p.Data)
+	}
+}
+
+func TestSchedulerDoesNotBlockOnceDone(t *testing.T) {
+	data := []byte("aaaa")
+	c := newTestClient(t, 1)
+	done := make(chan struct{})
+	// nothing is planned, so there is no room for the piece that becomes wanted later
+	s := newBlockScheduler(nil, picker.New(1), done)
+	s.picker.AddPeer(c.Peer.String(), c.Channel.Pieces())
+	s.want(testPlan(0, data, 4))
+
+	req, ok := s.NextRequest(c)
+	if !ok {
+		t.Fatalf("expected the wanted piece to be requested")
+	}
+	close(done)
+
+	received := make(chan struct{})
+	go func() {
+		s.BlockReceived(c, block(req, data))
+		close(received)
+	}()
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("BlockReceived blocked after the pool was done")
+	}
+}
@@ -0,0 +1,534 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ipfilter"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/proxy"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/tracker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// HandshakeTimeout is how long a peer that connects to us has to finish the handshake
+const HandshakeTimeout = 10 * time.Second
+
+// DefaultSessionConns is how many peers the torrents of a session stay connected to together
+const DefaultSessionConns = 200
+
+var ErrTorrentExists = fmt.Errorf("torrent is already in the session")
+var ErrTorrentNotFound = fmt.Errorf("torrent is not in the session")
+var ErrSessionClosed = fmt.Errorf("session closed")
+
+// TorrentStatus says whether a torrent of a session is running
+type TorrentStatus int
+
+const (
+	// StatusQueued torrents wait for a download slot
+	StatusQueued TorrentStatus = iota
+	// StatusActive torrents are started
+	StatusActive
+	// StatusPaused torrents were paused and don't start until they are resumed
+	StatusPaused
+	// StatusFailed torrents stopped because of an error and don't start until they are resumed
+	StatusFailed
+	// StatusComplete torrents are downloaded and stopped
+	StatusComplete
+)
+
+func (s TorrentStatus) String() string {
+	switch s {
+	case StatusQueued:
+		return "queued"
+	case StatusActive:
+		return "active"
+	case StatusPaused:
+		return "paused"
+	case StatusFailed:
+		return "failed"
+	case StatusComplete:
+		return "complete"
+	}
+	return fmt.Sprintf("TorrentStatus(%d)", int(s))
+}
+
+// Session runs many torrents at once. The torrents share the peer ID, the tracker client, the socket
+// peers connect to, the connection limit and the bandwidth limits. Only MaxActiveDownloads torrents
+// download at the same time, the others are queued in the order they were added. Torrents are started
+// and stopped in the background, and Close cancels the starts that are still announcing. Nothing is uploaded,
+// so torrents are stopped once they are complete rather than seeded.
+//
+// Peers come from the trackers, from the DHT and from peers that connect to us. The DHT is only read
+// from: torrents are looked up but not announced, and the session doesn't answer other nodes.
+type Session struct {
+	PeerID  string
+	Tracker *tracker.TrackerClient
+	Storage storage.Opener
+	Logger  *slog.Logger
+	// DownloadLimiter and UploadLimiter limit the torrents of the session together. Every torrent gets
+	// a limiter of its own below them.
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	// PeersPerTorrent is how many peers each torrent downloads from at the same time
+	PeersPerTorrent int
+	// MaxActiveDownloads caps how many torrents download at the same time, zero doesn't limit
+	MaxActiveDownloads int
+	// ConnLimit caps the peers all torrents stay connected to together. Every torrent is limited to
+	// MaxConns of its manager below it as well.
+	ConnLimit *peer.ConnLimit
+	// Bans are the peers that sent corrupt data to any of the torrents. They aren't connected to for as
+	// long as the session runs.
+	Bans *peer.BanList
+	// Blocklist are the addresses no torrent talks to, nil doesn't block any
+	Blocklist *ipfilter.Filter
+	// Dialer makes the connections to peers of every torrent, directly when it is nil. Tracker requests
+	// use the Dialer of Tracker.
+	Dialer proxy.Dialer
+	// DHT looks up peers for the torrents that aren't private and is closed with the session. Nil only
+	// uses the trackers.
+	DHT *dht.Client
+
+	// ctx is what torrents run under, Close cancels it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// syncs are the syncs that run in the background
+	syncs sync.WaitGroup
+
+	mu       sync.Mutex
+	torrents []*SessionTorrent
+	listener net.Listener
+	closed   bool
+}
+
+func NewSession(peerID string) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		ctx:             ctx,
+		cancel:          cancel,
+		PeerID:          peerID,
+		Tracker:         tracker.NewClient(),
+		Storage:         storage.OpenFiles,
+		DownloadLimiter: ratelimit.NewLimiter(ratelimit.Unlimited, nil),
+		UploadLimiter:   ratelimit.NewLimiter(ratelimit.Unlimited, nil),
+		PeersPerTorrent: DefaultPeers,
+		ConnLimit:       peer.NewConnLimit(DefaultSessionConns),
+		Bans:            peer.NewBanList(),
+		DHT:             dht.NewClient(),
+	}
+}
+
+// SessionTorrent is a torrent of a session
+type SessionTorrent struct {
+	Torrent *types.Torrent
+	Dst     string
+	// Manager downloads the torrent. Its settings can be changed while the torrent is paused.
+	Manager *TorrentManager
+
+	s *Session
+	// op serializes starting and stopping the manager
+	op      sync.Mutex
+	started bool
+	// suspended is set when the manager is paused rather than stopped
+	suspended bool
+
+	// these are guarded by the lock of the session
+	paused   bool
+	running  bool
+	complete bool
+	removed  bool
+	err      error
+}
+
+// Status returns whether the torrent is running, waiting for a slot, paused, failed or complete
+func (t *SessionTorrent) Status() TorrentStatus {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	switch {
+	case t.paused:
+		return StatusPaused
+	case t.err != nil:
+		return StatusFailed
+	case t.complete:
+		return StatusComplete
+	case t.running:
+		return StatusActive
+	}
+	return StatusQueued
+}
+
+// Err returns the error the torrent failed with
+func (t *SessionTorrent) Err() error {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	return t.err
+}
+
+// Stats returns the progress of the torrent
+func (t *SessionTorrent) Stats() Stats {
+	return t.Manager.Stats()
+}
+
+func (s *Session) log() *slog.Logger {
+	return bt.Logger(s.Logger)
+}
+
+// Add adds the torrent to the session to be downloaded to dst. It is started in the background right
+// away if there is a free download slot, so Add doesn't wait for the trackers.
+func (s *Session) Add(torrent *types.Torrent, dst string) (*SessionTorrent, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if s.find(torrent.Hash) != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %x", ErrTorrentExists, torrent.Hash)
+	}
+	t := &SessionTorrent{
+		Torrent: torrent,
+		Dst:     dst,
+		Manager: &TorrentManager{
+			PeerID:          s.PeerID,
+			Tracker:         s.Tracker,
+			Storage:         s.Storage,
+			Logger:          s.Logger,
+			MaxPeers:        s.PeersPerTorrent,
+			ConnLimit:       s.ConnLimit,
+			Bans:            s.Bans,
+			Blocklist:       s.Blocklist,
+			Dialer:          s.Dialer,
+			DHT:             s.DHT,
+			DownloadLimiter: ratelimit.NewLimiter(ratelimit.Unlimited, s.DownloadLimiter),
+			UploadLimiter:   ratelimit.NewLimiter(ratelimit.Unlimited, s.UploadLimiter),
+		},
+		s: s,
+	}
+	s.torrents = append(s.torrents, t)
+	s.mu.Unlock()
+
+	s.schedule()
+	return t, nil
+}
+
+// Remove stops the torrent and removes it from the session. The downloaded data is left alone.
+func (s *Session) Remove(hash [20]byte) error {
+	s.mu.Lock()
+	t := s.find(hash)
+	if t == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %x", ErrTorrentNotFound, hash)
+	}
+	for i, other := range s.torrents {
+		if other == t {
+			s.torrents = append(s.torrents[:i], s.torrents[i+1:]...)
+			break
+		}
+	}
+	t.running = false
+	t.removed = true
+	s.mu.Unlock()
+
+	t.resync()
+	s.schedule()
+	return nil
+}
+
+// Pause stops requesting pieces for the torrent until it is resumed, which frees its slot for a queued
+// torrent. Its peers stay connected.
+func (s *Session) Pause(hash [20]byte) error {
+	return s.update(hash, func(t *SessionTorrent) { t.paused = true })
+}
+
+// Resume lets a paused or failed torrent run again once there is a free slot. A paused torrent that
+// doesn't get one is stopped until it does.
+func (s *Session) Resume(hash [20]byte) error {
+	return s.update(hash, func(t *SessionTorrent) {
+		t.paused = false
+		t.err = nil
+	})
+}
+
+func (s *Session) update(hash [20]byte, fn func(t *SessionTorrent)) error {
+	s.mu.Lock()
+	t := s.find(hash)
+	if t == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %x", ErrTorrentNotFound, hash)
+	}
+	fn(t)
+	s.mu.Unlock()
+
+	s.schedule()
+	t.resync()
+	return nil
+}
+
+// Torrent returns the torrent of the session with the info hash, or nil if there is none
+func (s *Session) Torrent(hash [20]byte) *SessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.find(hash)
+}
+
+// Torrents returns the torrents of the session in the order they were added
+func (s *Session) Torrents() []*SessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*SessionTorrent{}, s.torrents...)
+}
+
+// find returns the torrent with the info hash - the caller has to hold the lock
+func (s *Session) find(hash [20]byte) *SessionTorrent {
+	for _, t := range s.torrents {
+		if t.Torrent.Hash == hash {
+			return t
+		}
+	}
+	return nil
+}
+
+// schedule hands the free download slots to queued torrents in the order they were added, and starts and
+// stops torrents to match. Running torrents keep their slot until they are complete, paused or the limit
+// is lowered.
+func (s *Session) schedule() {
+	s.mu.Lock()
+	changed := []*SessionTorrent{}
+	downloads := 0
+	slot := func(t *SessionTorrent) bool {
+		if s.closed || t.paused || t.err != nil || t.complete {
+			return false
+		}
+		if s.MaxActiveDownloads == 0 || downloads < s.MaxActiveDownloads {
+			downloads++
+			return true
+		}
+		return false
+	}
+	// first the running torrents keep their slots, then the queued ones get what is left
+	order := []*SessionTorrent{}
+	for _, t := range s.torrents {
+		if t.running {
+			order = append(order, t)
+		}
+	}
+	for _, t := range s.torrents {
+		if !t.running {
+			order = append(order, t)
+		}
+	}
+	for _, t := range order {
+		if run := slot(t); run != t.running {
+			t.running = run
+			changed = append(changed, t)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, t := range changed {
+		t.resync()
+	}
+}
+
+// port returns the port peers can connect to us on
+func (s *Session) port() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		if addr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	return DefaultPort
+}
+
+// resync runs sync in the background, so that starting a torrent doesn't wait for its trackers. Close
+// waits for the syncs that are running.
+func (t *SessionTorrent) resync() {
+	t.s.syncs.Add(1)
+	go func() {
+		defer t.s.syncs.Done()
+		t.sync()
+	}()
+}
+
+// sync starts, pauses, resumes or stops the manager to match whether the torrent should be running
+func (t *SessionTorrent) sync() {
+	t.op.Lock()
+	defer t.op.Unlock()
+
+	t.s.mu.Lock()
+	run := t.running
+	pause := t.paused && t.err == nil && !t.removed && !t.s.closed
+	t.s.mu.Unlock()
+
+	switch {
+	case run && t.suspended:
+		if err := t.Manager.Resume(); err != nil {
+			t.s.log().Warn("failed to resume torrent", bt.InfoHash(t.Torrent.Hash), "err", err)
+		}
+		t.suspended = false
+	case pause && t.started:
+		if !t.suspended {
+			t.Manager.Pause()
+			t.suspended = true
+		}
+	case run && !t.started:
+		t.Manager.Port = t.s.port()
+		if err := t.Manager.Start(t.s.ctx, t.Torrent, t.Dst); err != nil {
+			if t.s.ctx.Err() != nil {
+				// the session was closed while the torrent was starting
+				return
+			}
+			t.s.log().Error("failed to start torrent", bt.InfoHash(t.Torrent.Hash), "err", err)
+			t.fail(err)
+			go t.s.schedule()
+			return
+		}
+		t.started = true
+		go t.watch()
+	case !run && t.started:
+		if err := t.Manager.Stop(); err != nil {
+			t.s.log().Warn("failed to stop torrent", bt.InfoHash(t.Torrent.Hash), "err", err)
+		}
+		t.started = false
+		t.suspended = false
+	}
+}
+
+func (t *SessionTorrent) fail(err error) {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	t.err = err
+	t.running = false
+}
+
+// watch waits for the download to complete, which stops the torrent and frees its slot
+func (t *SessionTorrent) watch() {
+	err := t.Manager.Wait(t.s.ctx)
+	switch {
+	case err == ErrStopped || err == ErrNotStarted || t.s.ctx.Err() != nil:
+		return
+	case err != nil:
+		t.s.log().Error("torrent failed", bt.InfoHash(t.Torrent.Hash), "err", err)
+		t.fail(err)
+		t.sync()
+	default:
+		t.s.mu.Lock()
+		t.complete = true
+		t.s.mu.Unlock()
+	}
+	t.s.schedule()
+}
+
+// Listen opens the socket peers connect to us on and announces its port to trackers. Peers are handed to
+// the torrent they ask for in their handshake.
+func (s *Session) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed || s.listener != nil {
+		s.mu.Unlock()
+		ln.Close()
+		if s.closed {
+			return ErrSessionClosed
+		}
+		return fmt.Errorf("session is already listening")
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	s.log().Info("listening for peers", "addr", ln.Addr().String())
+	go s.accept(ln)
+	return nil
+}
+
+// Addr returns the address of the socket peers connect to, or nil if the session isn't listening
+func (s *Session) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *Session) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle does the handshake with a peer that connected to us and hands it to its torrent
+func (s *Session) handle(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && (s.Bans.Banned(addr.IP) || s.Blocklist.Blocked(addr.IP)) {
+		conn.Close()
+		return
+	}
+	client, torrent, err := peer.Accept(ctx, conn, s.PeerID, s.runningTorrent, s.Logger)
+	if err != nil {
+		s.log().Debug("rejected peer", bt.PeerKey, conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	t := s.Torrent(torrent.Hash)
+	if t == nil {
+		client.Close()
+		return
+	}
+	if err := t.Manager.AddPeer(client); err != nil {
+		s.log().Debug("rejected peer", bt.PeerKey, conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// runningTorrent returns the torrent with the info hash if it is running
+func (s *Session) runningTorrent(hash [20]byte) *types.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.find(hash); t != nil && t.running {
+		return t.Torrent
+	}
+	return nil
+}
+
+// Close stops every torrent and the socket peers connect to. Torrents that are still starting are
+// cancelled.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	ln := s.listener
+	s.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	s.cancel()
+	s.schedule()
+	s.syncs.Wait()
+	if s.DHT != nil {
+		s.DHT.Close()
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// newTestSession returns a session and the announce URL of a tracker for it. The session is closed
+// before dir is removed.
+func newTestSession(t *testing.T) (s *Session, announce string, dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	// the tracker has no peers, so downloads wait for peers that connect to us
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	t.Cleanup(srv.Close)
+
+	s = NewSession("00112233445566778899")
+	// the tests don't go online
+	s.DHT = nil
+	s.Storage = func(torrent *types.Torrent, dst string) (storage.Storage, error) {
+		return storage.NewMemory(torrent), nil
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, srv.URL, dir
+}
+
+// settle waits for the torrents of the session to be started and stopped
+func settle(s *Session) {
+	s.syncs.Wait()
+}
+
+func expectStatus(t *testing.T, torrent *SessionTorrent, want TorrentStatus) {
+	t.Helper()
+	if got := torrent.Status(); got != want {
+		t.Fatalf("expected %s to be %s got %s", torrent.Torrent.Name, want, got)
+	}
+}
+
+func TestSessionQueuesTorrents(t *testing.T) {
+	s, announce, dir := newTestSession(t)
+	s.MaxActiveDownloads = 1
+
+	add := func(name string) *SessionTorrent {
+		torrent := testTorrent(4, []byte(name+" data"))
+		torrent.Name = name
+		torrent.Announce = announce
+		st, err := s.Add(torrent, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	a, b := add("a"), add("b")
+	settle(s)
+	expectStatus(t, a, StatusActive)
+	expectStatus(t, b, StatusQueued)
+
+	if _, err := s.Add(a.Torrent, filepath.Join(dir, "again")); !errors.Is(err, ErrTorrentExists) {
+		t.Fatalf("expected %v got %v", ErrTorrentExists, err)
+	}
+
+	if err := s.Pause(a.Torrent.Hash); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, a, StatusPaused)
+	expectStatus(t, b, StatusActive)
+	// paused torrents keep their peers
+	settle(s)
+	if state := a.Stats().State; state != Paused {
+		t.Fatalf("expected a to be %s got %s", Paused, state)
+	}
+
+	// the slot stays with b until it is done
+	if err := s.Resume(a.Torrent.Hash); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, a, StatusQueued)
+
+	if err := s.Remove(b.Torrent.Hash); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, a, StatusActive)
+	if err := s.Remove(b.Torrent.Hash); !errors.Is(err, ErrTorrentNotFound) {
+		t.Fatalf("expected %v got %v", ErrTorrentNotFound, err)
+	}
+	if torrents := s.Torrents(); len(torrents) != 1 || torrents[0] != a {
+		t.Fatalf("expected only a to be left got %d torrents", len(torrents))
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, a, StatusQueued)
+	if _, err := s.Add(b.Torrent, filepath.Join(dir, "b")); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("expected %v got %v", ErrSessionClosed, err)
+	}
+}
+
+func TestSessionAcceptsPeersForRunningTorrents(t *testing.T) {
+	s, announce, dir := newTestSession(t)
+	s.MaxActiveDownloads = 1
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var torrents []*SessionTorrent
+	for _, name := range []string{"a", "b"} {
+		torrent := testTorrent(4, []byte(name+" data"))
+		torrent.Announce = announce
+		st, err := s.Add(torrent, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrents = append(torrents, st)
+	}
+	settle(s)
+	if port := torrents[0].Manager.Port; port != s.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("expected the port of the listener to be announced got %d", port)
+	}
+
+	tests := []struct {
+		name     string
+		hash     [20]byte
+		accepted bool
+	}{
+		{name: "running torrent", hash: torrents[0].Torrent.Hash, accepted: true},
+		{name: "queued torrent", hash: torrents[1].Torrent.Hash},
+		{name: "unknown torrent", hash: [20]byte{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			h := &peer.Handshake{PeerID: "theirpeerid012345678", Hash: tt.hash}
+			if _, err := conn.Write(h.Payload()); err != nil {
+				t.Fatal(err)
+			}
+			resp := make([]byte, 68)
+			_, err = io.ReadFull(conn, resp)
+			if !tt.accepted {
+				if err == nil {
+					t.Fatalf("expected the connection to be closed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read handshake: %v", err)
+			}
+			var got [20]byte
+			copy(got[:], resp[28:48])
+			if got != tt.hash {
+				t.Fatalf("expected handshake for %x got %x", tt.hash, got)
+			}
+		})
+	}
+}
+
+func TestSessionStopsCompleteTorrents(t *testing.T) {
+	s, announce, dir := newTestSession(t)
+	s.MaxActiveDownloads = 1
+
+	var torrents []*SessionTorrent
+	for _, name := range []string{"a", "b"} {
+		torrent := testTorrent(4, []byte(name+" data"))
+		torrent.Announce = announce
+		st, err := s.Add(torrent, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrents = append(torrents, st)
+	}
+	a, b := torrents[0], torrents[1]
+	expectStatus(t, b, StatusQueued)
+
+	// like watch does once the download is complete
+	s.mu.Lock()
+	a.complete = true
+	s.mu.Unlock()
+	s.schedule()
+
+	expectStatus(t, a, StatusComplete)
+	expectStatus(t, b, StatusActive)
+	settle(s)
+	if err := a.Manager.Wait(context.Background()); !errors.Is(err, ErrNotStarted) && !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected a to be stopped got %v", err)
+	}
+}
+
+func TestSessionAddDoesNotWaitForTrackers(t *testing.T) {
+	announcing := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announcing <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	s, _, dir := newTestSession(t)
+
+	torrent := testTorrent(4, []byte("a data"))
+	torrent.Announce = srv.URL
+	st, err := s.Add(torrent, filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-announcing
+	expectStatus(t, st, StatusActive)
+
+	// closing cancels the announce rather than waiting for the tracker
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Close to cancel the start")
+	}
+	if err := st.Err(); err != nil {
+		t.Fatalf("expected the torrent not to fail got %v", err)
+	}
+}
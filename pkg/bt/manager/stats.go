@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"sort"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+)
+
+// RateWindow is the number of seconds transfer rates are averaged over
+const RateWindow = bt.RateWindow
+
+// Stats is a snapshot of the progress of a download
+type Stats struct {
+	State State
+	// Downloaded and Uploaded are the bytes of piece data received from and sent to peers, including
+	// blocks that were received more than once in endgame mode. Pieces aren't served to peers yet, so
+	// Uploaded and UploadRate stay zero for now.
+	Downloaded int64
+	Uploaded   int64
+	// DownloadRate and UploadRate are in bytes per second over the last RateWindow seconds
+	DownloadRate float64
+	UploadRate   float64
+	// Left is the bytes of the pieces that are missing and not skipped
+	Left int64
+	// ETA is how long the pieces that are left take at the current download rate. It is zero when the
+	// download is complete or nothing is being downloaded.
+	ETA time.Duration
+	// Peers is the number of peers the download uses
+	Peers int
+	// PiecesDone are the pieces in storage, PiecesWanted the ones that aren't skipped and PiecesTotal
+	// all the pieces of the torrent
+	PiecesDone   int
+	PiecesWanted int
+	PiecesTotal  int
+}
+
+// Stats returns the progress of the download. Downloads that haven't been started are Stopped.
+func (tm *TorrentManager) Stats() Stats {
+	d, err := tm.download()
+	if err != nil {
+		return Stats{State: Stopped}
+	}
+	return d.stats()
+}
+
+func (d *download) stats() Stats {
+	d.Lock()
+	defer d.Unlock()
+
+	s := Stats{State: d.state, PiecesTotal: d.torrent.GetPieceCount()}
+	for i := 0; i < s.PiecesTotal; i++ {
+		has := d.resume.Pieces.Has(i)
+		if has {
+			s.PiecesDone++
+		}
+		if d.picker.Priority(i) == picker.Skip && !has {
+			continue
+		}
+		s.PiecesWanted++
+		if !has {
+			s.Left += int64(d.torrent.BlockPlan(i, MaxBlockSize).PieceLength)
+		}
+	}
+
+	if d.pool != nil {
+		s.Downloaded = d.pool.scheduler.downloaded.Total()
+		s.DownloadRate = d.pool.scheduler.downloaded.Rate()
+		s.Uploaded, s.UploadRate = d.pool.uploads()
+		s.Peers = d.pool.tracked.Len()
+	}
+	if s.DownloadRate > 0 {
+		s.ETA = time.Duration(float64(s.Left) / s.DownloadRate * float64(time.Second))
+	}
+	return s
+}
+
+// Peers returns the statistics of the peers the download is connected to, the fastest first
+func (tm *TorrentManager) Peers() []peer.Stats {
+	d, err := tm.download()
+	if err != nil || d.conns == nil {
+		return nil
+	}
+	peers := []peer.Stats{}
+	for _, c := range d.conns.Clients() {
+		peers = append(peers, c.Channel.Stats())
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].DownloadRate > peers[j].DownloadRate
+	})
+	return peers
+}
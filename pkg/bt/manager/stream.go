@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+)
+
+// StreamReadahead is how much data ahead of the read position of a stream is downloaded with time
+// critical priority
+const StreamReadahead = 4 * 1024 * 1024
+
+var ErrFileNotFound = fmt.Errorf("file not found in torrent")
+
+// waitPiece blocks until the piece is verified and in storage
+func (d *download) waitPiece(ctx context.Context, idx int) error {
+	for {
+		d.Lock()
+		has, changed := d.resume.Pieces.Has(idx), d.changed
+		d.Unlock()
+		if has {
+			return nil
+		}
+		if d.pool == nil {
+			return ErrStopped
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.pool.done:
+			return ErrStopped
+		case <-changed:
+		}
+	}
+}
+
+// setCritical moves the pieces a reader needs right away from the old range to the new one. Pieces keep
+// time critical priority for as long as any reader needs them and get their old priority back after.
+// Ranges are inclusive and empty when last < first.
+func (d *download) setCritical(old, new [2]int) {
+	d.Lock()
+	for i := old[0]; i <= old[1]; i++ {
+		if i >= new[0] && i <= new[1] {
+			continue
+		}
+		d.critical[i]--
+		if d.critical[i] <= 0 {
+			delete(d.critical, i)
+			d.picker.SetPriority(i, d.base[i])
+		}
+	}
+	for i := new[0]; i <= new[1]; i++ {
+		if i >= old[0] && i <= old[1] {
+			continue
+		}
+		d.critical[i]++
+		d.picker.SetPriority(i, picker.Critical)
+	}
+	d.Unlock()
+
+	if d.pool != nil {
+		d.pool.notify()
+	}
+	d.updateState()
+}
+
+// readAt reads the data of the torrent at off, which has to be in storage already
+func (d *download) readAt(p []byte, off int64) (int, error) {
+	n := 0
+	pieceLength := int64(d.torrent.PieceLength)
+	for n < len(p) {
+		pos := off + int64(n)
+		piece := int(pos / pieceLength)
+		begin := int(pos % pieceLength)
+		count := bt.Min(len(p)-n, int(pieceLength)-begin)
+		read, err := d.store.ReadBlock(p[n:n+count], piece, begin)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ServeHTTP serves the files of the torrent that is being downloaded. Each file is served at its path in
+// the torrent with support for Range requests, and requests block until the data they need is
+// downloaded. The root lists the files.
+func (tm *TorrentManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, err := tm.download()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "" {
+		spans, err := d.torrent.Layout()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<pre>\n")
+		for _, span := range spans {
+			link := filepath.ToSlash(span.Path)
+			fmt.Fprintf(w, "<a href=\"/%s\">%s</a> %d\n", html.EscapeString(link), html.EscapeString(link), span.Length)
+		}
+		fmt.Fprintf(w, "</pre>\n")
+		return
+	}
+
+	f, err := d.openFile(r.Context(), filepath.FromSlash(path))
+	if errors.Is(err, ErrFileNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, filepath.Base(f.Path()), time.Time{}, f)
+}
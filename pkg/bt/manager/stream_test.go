@@ -0,0 +1,164 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/picker"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func testDownload(torrent *types.Torrent) *download {
+	base, _ := piecePriorities(torrent, FilePriorities{})
+	d := &download{
+		torrent:  torrent,
+		store:    storage.NewMemory(torrent),
+		picker:   picker.New(torrent.GetPieceCount()),
+		resume:   NewResumeData(torrent),
+		files:    FilePriorities{},
+		read:     map[string]bool{},
+		base:     base,
+		critical: map[int]int{},
+		changed:  make(chan struct{}),
+		lastSave: time.Now(),
+		events:   &events{},
+		log:      slog.Default(),
+	}
+	d.pool = NewDownloaderPool(1, nil, d.picker, d.resume.missingPlans(torrent))
+	return d
+}
+
+func TestStreamBlocksUntilPiecesAreStored(t *testing.T) {
+	data := []byte("aaaabbbbccccdd")
+	torrent := testTorrent(4, data)
+	d := testDownload(torrent)
+
+	f, err := d.openFile(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	read := make(chan result)
+	go func() {
+		buf := make([]byte, 6)
+		n, err := io.ReadFull(f, buf)
+		read <- result{buf[:n], err}
+	}()
+
+	// the read position and everything up to the readahead is needed right away
+	deadline := time.Now().Add(time.Second)
+	for d.picker.Priority(1) != picker.Critical && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < torrent.GetPieceCount(); i++ {
+		if d.picker.Priority(i) != picker.Critical {
+			t.Errorf("expected piece %d to be critical got %v", i, d.picker.Priority(i))
+		}
+	}
+	if d.picker.Priority(0) != picker.Normal {
+		t.Errorf("expected piece 0 before the read position to stay normal")
+	}
+
+	for _, idx := range []int{2, 1} {
+		select {
+		case r := <-read:
+			t.Fatalf("read returned before piece %d was stored: %q %v", idx, r.data, r.err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		piece := &types.Piece{Index: idx, Data: append([]byte{}, data[idx*4:idx*4+4]...)}
+		if err := d.storePiece(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := <-read
+	if r.err != nil || string(r.data) != "bbbccc" {
+		t.Fatalf("expected bbbccc got %q %v", r.data, r.err)
+	}
+
+	f.Close()
+	for i := 0; i < torrent.GetPieceCount(); i++ {
+		if d.picker.Priority(i) != picker.Normal {
+			t.Errorf("expected piece %d to be normal after close got %v", i, d.picker.Priority(i))
+		}
+	}
+}
+
+func TestReadSkippedFile(t *testing.T) {
+	files := map[string][]byte{
+		"a": []byte("aaaaaa"),
+		"b": []byte("bbbbbb"),
+	}
+	// pieces: aaaa | aabb | bbbb
+	torrent := multiFileTorrent(4, files, "a", "b")
+	d := testDownload(torrent)
+	skipped := filepath.Join("dir", "b")
+	d.files[skipped] = picker.Skip
+
+	// the boundary piece is stored without the part of the skipped file
+	for i, data := range []string{"aaaa", "aabb"} {
+		if err := d.storePiece(&types.Piece{Index: i, Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !d.resume.Pieces.Has(1) || !d.resume.Skipped[skipped].Has(1) {
+		t.Fatalf("expected piece 1 to be stored without %s", skipped)
+	}
+
+	f, err := d.openFile(context.Background(), skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if d.resume.Pieces.Has(1) || d.picker.Remaining() == 0 {
+		t.Fatalf("expected piece 1 to be downloaded again once %s is read", skipped)
+	}
+
+	read := make(chan string)
+	go func() {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- string(b)
+	}()
+	for i, data := range []string{"aabb", "bbbb"} {
+		if err := d.storePiece(&types.Piece{Index: i + 1, Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b := <-read; b != "bbbbbb" {
+		t.Errorf("expected bbbbbb got %q", b)
+	}
+}
+
+func TestStreamReadCancelled(t *testing.T) {
+	torrent := testTorrent(4, []byte("aaaabbbb"))
+	d := testDownload(torrent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f, err := d.openFile(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := f.Read(make([]byte, 4)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected read to be cancelled got %v", err)
+	}
+	if _, err := d.openFile(ctx, "other"); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected file not found got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package bt
+
+import (
+	"sync"
+	"time"
+)
+
+// RateWindow is the number of seconds transfer rates are averaged over
+const RateWindow = 10
+
+// Meter counts bytes and measures the rate they come in at over the last RateWindow seconds. The zero
+// value is ready to use.
+type Meter struct {
+	mu    sync.Mutex
+	total int64
+	// buckets are the bytes per second, last is the second the newest bucket is for
+	buckets [RateWindow]int64
+	last    int64
+}
+
+// advance clears the buckets of the seconds that passed since the last update
+func (m *Meter) advance(now int64) {
+	for m.last < now {
+		m.last++
+		m.buckets[m.last%RateWindow] = 0
+		if now-m.last >= RateWindow {
+			m.buckets = [RateWindow]int64{}
+			m.last = now
+		}
+	}
+}
+
+// Add counts n bytes that came in now
+func (m *Meter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	m.advance(now)
+	m.buckets[now%RateWindow] += int64(n)
+	m.total += int64(n)
+}
+
+// Total returns all the bytes counted so far
+func (m *Meter) Total() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Rate returns the average bytes per second over the last RateWindow seconds
+func (m *Meter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(time.Now().Unix())
+	var sum int64
+	for _, n := range m.buckets {
+		sum += n
+	}
+	return float64(sum) / RateWindow
+}
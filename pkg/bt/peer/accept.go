@@ -0,0 +1,50 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+var ErrUnknownTorrent = fmt.Errorf("peer asked for a torrent we don't have")
+
+// Accept does the handshake for a connection a peer opened to us. The peer says which torrent it wants
+// in its handshake and torrentFor looks it up, returning nil for torrents we don't have. The handshake
+// has to be done before ctx is.
+func Accept(ctx context.Context, conn net.Conn, peerID string, torrentFor func(hash [20]byte) *types.Torrent, logger *slog.Logger) (*Client, *types.Torrent, error) {
+	logger = bt.Logger(logger)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	them, err := readHandshake(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	torrent := torrentFor(them.Hash)
+	if torrent == nil {
+		return nil, nil, fmt.Errorf("%w: %x", ErrUnknownTorrent, them.Hash)
+	}
+	logger.Debug("accepted handshake", bt.PeerKey, conn.RemoteAddr().String(), bt.InfoHash(them.Hash))
+	if _, err := writeHandshake(conn, peerID, them.Hash); err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	ch := NewChannel(conn, them, NewBitField(torrent.GetPieceCount()), logger)
+	if err := ch.greet(); err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+
+	p := &types.Peer{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		p = &types.Peer{IP: addr.IP, Port: addr.Port}
+	}
+	return &Client{PeerID: peerID, Peer: p, Channel: ch, Logger: ch.Logger()}, torrent, nil
+}
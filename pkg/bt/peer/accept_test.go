@@ -0,0 +1,82 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func TestAccept(t *testing.T) {
+	torrent := &types.Torrent{Hash: [20]byte{1, 2, 3}, PieceLength: 4, Length: 8}
+	torrentFor := func(hash [20]byte) *types.Torrent {
+		if hash == torrent.Hash {
+			return torrent
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		hash    [20]byte
+		wantErr error
+	}{
+		{name: "known torrent", hash: torrent.Hash},
+		{name: "unknown torrent", hash: [20]byte{9}, wantErr: ErrUnknownTorrent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer remote.Close()
+
+			type result struct {
+				client  *Client
+				torrent *types.Torrent
+				err     error
+			}
+			done := make(chan result, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				client, torrent, err := Accept(ctx, local, "ourpeerid01234567890", torrentFor, nil)
+				done <- result{client, torrent, err}
+			}()
+
+			// no reserved bits, so nothing but the handshake comes back
+			them := &Handshake{PeerID: "theirpeerid012345678", Hash: tt.hash}
+			if _, err := remote.Write(them.Payload()); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantErr != nil {
+				res := <-done
+				if !errors.Is(res.err, tt.wantErr) {
+					t.Fatalf("expected %v got %v", tt.wantErr, res.err)
+				}
+				return
+			}
+
+			us, err := readHandshake(remote)
+			if err != nil {
+				t.Fatalf("failed to read our handshake: %v", err)
+			}
+			if us.Hash != torrent.Hash || us.PeerID != "ourpeerid01234567890" {
+				t.Fatalf("unexpected handshake %#v", us)
+			}
+			res := <-done
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			defer res.client.Close()
+			if res.torrent != torrent {
+				t.Fatalf("expected the torrent the peer asked for")
+			}
+			if res.client.Channel.Handshake.PeerID != them.PeerID {
+				t.Fatalf("expected channel for %q got %q", them.PeerID, res.client.Channel.Handshake.PeerID)
+			}
+		})
+	}
+}
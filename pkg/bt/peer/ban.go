@@ -0,0 +1,48 @@
+package peer
+
+import (
+	"net"
+	"sync"
+)
+
+// BanList is the set of peers we don't connect to, by IP address since a peer that reconnects may use
+// another port. A nil BanList bans nobody. Share one to ban peers from several downloads at once.
+type BanList struct {
+	mu  sync.Mutex
+	ips map[string]struct{}
+}
+
+func NewBanList() *BanList {
+	return &BanList{ips: map[string]struct{}{}}
+}
+
+// Ban bans the IP address
+func (b *BanList) Ban(ip net.IP) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ips[ip.String()] = struct{}{}
+}
+
+// Banned reports whether the IP address is banned
+func (b *BanList) Banned(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.ips[ip.String()]
+	return ok
+}
+
+// Len returns the number of banned IP addresses
+func (b *BanList) Len() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.ips)
+}
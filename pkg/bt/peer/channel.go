@@ -3,35 +3,41 @@ package peer
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/proxy"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ratelimit"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
-	"golang.org/x/sync/semaphore"
 )
 
 type MessageHandler func(msg Message) error
 
-const MaxSendMessages = 1
+// MaxSendMessages is how many messages can be queued up for the writer. It has to be big enough to
+// queue a pipeline worth of requests without every sender waiting on the previous write.
+const MaxSendMessages = 64
 
+// ChannelState describes the lifecycle of the underlying connection. It says nothing about
+// whether either side is choking or interested - see PeerState for that.
 type ChannelState int
 
-var Choked ChannelState = 1
-var Unchoked ChannelState = 2
-var ErrorState ChannelState = 3
-var Closed ChannelState = 4
+var Connected ChannelState = 1
+var ErrorState ChannelState = 2
+var Closed ChannelState = 3
 
 func (s ChannelState) String() string {
 	switch s {
-	case Choked:
-		return "Choked"
-	case Unchoked:
-		return "Unchoked"
+	case Connected:
+		return "Connected"
 	case ErrorState:
 		return "ErrorState"
 	case Closed:
@@ -41,9 +47,45 @@ func (s ChannelState) String() string {
 	return "Unknown"
 }
 
-var ErrPieceUnavailable error = fmt.Errorf("peer does not have requested piece")
+// PeerState holds the four flags every peer wire connection carries. Both sides start out
+// choking and not interested.
+type PeerState struct {
+	// AmChoking is true when we refuse to serve requests from the peer
+	AmChoking bool
+	// AmInterested is true when we told the peer we want pieces it has
+	AmInterested bool
+	// PeerChoking is true when the peer refuses to serve our requests
+	PeerChoking bool
+	// PeerInterested is true when the peer told us it wants pieces we have
+	PeerInterested bool
+}
 
-var DEBUG = false
+func NewPeerState() PeerState {
+	return PeerState{
+		AmChoking:   true,
+		PeerChoking: true,
+	}
+}
+
+func (s PeerState) String() string {
+	return fmt.Sprintf("am_choking=%t am_interested=%t peer_choking=%t peer_interested=%t",
+		s.AmChoking, s.AmInterested, s.PeerChoking, s.PeerInterested)
+}
+
+const (
+	// IdleTimeout is how long a connection may stay silent before we consider it dead. Peers send a
+	// keep alive at least every two minutes, so anything slower than that is not a peer we want.
+	IdleTimeout = 3 * time.Minute
+	// KeepAliveInterval is how long we stay silent before sending the peer a keep alive
+	KeepAliveInterval = 90 * time.Second
+	// SnubTimeout is how long a peer may leave our requests unanswered before it is marked as snubbing us
+	SnubTimeout = 60 * time.Second
+)
+
+var ErrPieceUnavailable error = fmt.Errorf("peer does not have requested piece")
+var ErrRequestRejected error = fmt.Errorf("peer rejected request")
+var ErrNothingWanted error = fmt.Errorf("peer has no pieces we want")
+var ErrSnubbed error = fmt.Errorf("peer snubbed us - no blocks received in %s", SnubTimeout)
 
 type Channel struct {
 	ConnectedTo string
@@ -51,36 +93,110 @@ type Channel struct {
 	BitField    *BitField
 
 	sync.Mutex
-	chokeCond     *sync.Cond
-	sendSemaphore semaphore.Weighted
 
-	conn  net.Conn
-	state *atomic.Value
+	conn      net.Conn
+	state     *atomic.Value
+	peerState PeerState
+
+	// requests holds the requests written to the peer that have not been answered yet and when they were sent
+	requests map[PieceRequest]time.Time
+	// deferred holds requests that have to wait for the peer to unchoke us before they can be sent
+	deferred []PieceRequest
+	// reqq is the number of outstanding requests the peer is willing to queue
+	reqq int
+	// fast is true when both sides support the Fast Extension (BEP 6)
+	fast bool
+	// allowedFast are the pieces the peer lets us request while it chokes us
+	allowedFast map[int]bool
+	// predictedFast is the canonical allowed fast set for our address. Peers that use the canonical
+	// algorithm allow these pieces without telling us, the others reject them and they are dropped.
+	predictedFast map[int]bool
+	// latency is a moving average of the time it takes the peer to answer a request
+	latency time.Duration
+	// minLatency is the fastest the peer has ever answered a request, which is the closest we get
+	// to the round trip time of the link without any queueing on the peer side
+	minLatency time.Duration
+	// waitingSince is when we started waiting on the peer for a block - either when it sent us the
+	// last one or when we sent a request while not waiting on anything. It's zero when we are not
+	// waiting on the peer at all and is what snubbing is measured against.
+	waitingSince time.Time
+	// unchoked is how long the peer unchoked us for before unchokedSince, which is when it last
+	// unchoked us or zero while it chokes us
+	unchoked      time.Duration
+	unchokedSince time.Time
+
+	// piecesChanged is closed and replaced whenever the peer tells us about pieces it has
+	piecesChanged chan struct{}
 
 	send chan Message
 	Done chan struct{}
 
 	onRecvHooks map[MessageTag]MessageHandler
 
+	logger *slog.Logger
+
+	connectedAt time.Time
+	counters    counters
+	stats       *messageStats
+	downLimit   *ratelimit.Limiter
+	upLimit     *ratelimit.Limiter
+	// ctx is cancelled when the channel is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	Err error
 }
 
-func NewHandshakedChannel(ctx context.Context, peerID string, p *types.Peer, torrent *types.Torrent) (*Channel, error) {
-	dialer := &net.Dialer{}
-	conn, err := dialer.DialContext(ctx, "tcp", p.String())
+// NewHandshakedChannel connects to the peer and does the handshake for the torrent. Everything about the
+// connection is logged to logger, or the default logger if it is nil.
+func NewHandshakedChannel(ctx context.Context, peerID string, p *types.Peer, torrent *types.Torrent, logger *slog.Logger) (*Channel, error) {
+	return DialHandshakedChannel(ctx, nil, peerID, p, torrent, logger)
+}
+
+// DialHandshakedChannel is NewHandshakedChannel with the connection made by dialer, or directly when it is
+// nil
+func DialHandshakedChannel(ctx context.Context, dialer proxy.Dialer, peerID string, p *types.Peer, torrent *types.Torrent, logger *slog.Logger) (*Channel, error) {
+	logger = bt.Logger(logger)
+	conn, err := proxy.Direct(dialer).DialContext(ctx, "tcp", p.String())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
-	h, err := doHandshake(ctx, conn, peerID, torrent.Hash)
-	fieldSize := bt.Ceil(torrent.GetPieceCount(), 8)
-	bitField := &BitField{Field: make([]byte, fieldSize)}
-	return NewChannel(conn, h, bitField), err
+	h, err := doHandshake(ctx, conn, peerID, torrent.Hash, logger.With(bt.PeerKey, p.String(), bt.InfoHash(torrent.Hash)))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ch := NewChannel(conn, h, NewBitField(torrent.GetPieceCount()), logger)
+	if err := ch.greet(); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// greet sends what has to follow the handshake
+func (ch *Channel) greet() error {
+	// with the fast extension a bitfield is mandatory, and since we don't serve pieces there is
+	// nothing to advertise
+	if ch.IsFast() {
+		if err := ch.queue(&HaveNone{}); err != nil {
+			return err
+		}
+	}
+
+	if ch.Handshake.SupportsExtensions() {
+		return ch.SendExtendedHandshake()
+	}
+	return nil
 }
 
-func NewChannel(conn net.Conn, handshake *Handshake, bitField *BitField) *Channel {
+// NewChannel runs the peer wire protocol over a connection that completed the handshake. The logger gets
+// the peer and info hash attached, the default logger is used if it is nil.
+func NewChannel(conn net.Conn, handshake *Handshake, bitField *BitField, logger *slog.Logger) *Channel {
 	var state atomic.Value
-	state.Store(Unchoked)
+	state.Store(Connected)
+	ctx, cancel := context.WithCancel(context.Background())
 	ch := &Channel{
 		Mutex:       sync.Mutex{},
 		ConnectedTo: conn.RemoteAddr().String(),
@@ -90,10 +206,27 @@ func NewChannel(conn net.Conn, handshake *Handshake, bitField *BitField) *Channe
 		send:        make(chan Message, MaxSendMessages),
 		Done:        make(chan struct{}),
 
-		chokeCond: sync.NewCond(&sync.Mutex{}),
 		state:     &state,
+		peerState: NewPeerState(),
+		requests:  map[PieceRequest]time.Time{},
+		reqq:      DefaultReqq,
+
+		fast:          handshake.SupportsFast() && DefaultReserved[7]&fastExtensionBit != 0,
+		allowedFast:   map[int]bool{},
+		predictedFast: map[int]bool{},
+
+		piecesChanged: make(chan struct{}),
 
 		onRecvHooks: map[MessageTag]MessageHandler{},
+
+		logger: bt.Logger(logger).With(bt.PeerKey, conn.RemoteAddr().String(), bt.InfoHash(handshake.Hash)),
+
+		connectedAt: time.Now(),
+		stats:       newMessageStats(),
+		downLimit:   ratelimit.NewLimiter(ratelimit.Unlimited, nil),
+		upLimit:     ratelimit.NewLimiter(ratelimit.Unlimited, nil),
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 
 	go ch.reader()
@@ -102,42 +235,148 @@ func NewChannel(conn net.Conn, handshake *Handshake, bitField *BitField) *Channe
 	return ch
 }
 
+// queue hands the message to the writer. It fails instead of blocking forever when the channel
+// gets closed while we wait.
+func (ch *Channel) queue(m Message) error {
+	select {
+	case <-ch.Done:
+		return ErrChannelClosed
+	case ch.send <- m:
+		return nil
+	}
+}
+
+func (ch *Channel) SendChoke() error {
+	if !ch.IsValid() {
+		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
+	}
+	ch.Lock()
+	ch.peerState.AmChoking = true
+	ch.Unlock()
+	return ch.queue(&Choke{})
+}
+
 func (ch *Channel) SendUnchoke() error {
 	if !ch.IsValid() {
 		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
 	}
-	ch.send <- &Unchoke{}
-	return nil
+	ch.Lock()
+	ch.peerState.AmChoking = false
+	ch.Unlock()
+	return ch.queue(&Unchoke{})
 }
 
+// SendInterested tells the peer we want pieces it has. Nothing is sent if we already told it so.
 func (ch *Channel) SendInterested() error {
 	if !ch.IsValid() {
 		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
 	}
+	ch.Lock()
+	already := ch.peerState.AmInterested
+	ch.peerState.AmInterested = true
+	ch.Unlock()
+	if already {
+		return nil
+	}
+	return ch.queue(&Interested{})
+}
 
-	ch.send <- &Interested{}
-	return nil
+// SendNotInterested tells the peer it has nothing we want. Nothing is sent if it already knows.
+func (ch *Channel) SendNotInterested() error {
+	if !ch.IsValid() {
+		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
+	}
+	ch.Lock()
+	already := !ch.peerState.AmInterested
+	ch.peerState.AmInterested = false
+	ch.Unlock()
+	if already {
+		return nil
+	}
+	return ch.queue(&NotInterested{})
 }
 
+// SendPieceRequest requests a block from the peer. While the peer is choking us the request is held
+// back and only sent once we get unchoked, unless the peer allows the piece to be requested while choked.
 func (ch *Channel) SendPieceRequest(index, begin, length int) error {
 	if !ch.IsValid() {
 		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
 	}
-	ch.send <- &PieceRequest{
+	req := PieceRequest{
 		Index:  index,
 		Begin:  begin,
 		Length: length,
 	}
 
-	return nil
+	ch.Lock()
+	if ch.peerState.PeerChoking && !ch.allowedWhileChoked(index) {
+		ch.deferred = append(ch.deferred, req)
+		ch.Unlock()
+		return nil
+	}
+	ch.trackRequest(req, time.Now())
+	ch.Unlock()
+
+	return ch.queue(&req)
+}
+
+func (ch *Channel) SendExtendedHandshake() error {
+	if !ch.IsValid() {
+		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
+	}
+	h := &ExtendedHandshake{
+		V:    ClientVersion,
+		Reqq: DefaultReqq,
+	}
+	msg, err := h.Message()
+	if err != nil {
+		return err
+	}
+	return ch.queue(msg)
+}
+
+// SendCancel withdraws a request. A request that was still held back because we are choked is simply
+// dropped, otherwise the peer is told not to bother sending the block.
+func (ch *Channel) SendCancel(index, begin, length int) error {
+	if !ch.IsValid() {
+		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
+	}
+	req := PieceRequest{
+		Index:  index,
+		Begin:  begin,
+		Length: length,
+	}
+
+	ch.Lock()
+	for i, other := range ch.deferred {
+		if other == req {
+			ch.deferred = append(ch.deferred[:i], ch.deferred[i+1:]...)
+			ch.Unlock()
+			return nil
+		}
+	}
+	_, sent := ch.requests[req]
+	delete(ch.requests, req)
+	if len(ch.requests) == 0 {
+		ch.waitingSince = time.Time{}
+	}
+	ch.Unlock()
+
+	if !sent {
+		return nil
+	}
+	return ch.queue(&Cancel{
+		Index:  index,
+		Begin:  begin,
+		Length: length,
+	})
 }
 
 func (ch *Channel) SendHave(index int) error {
 	if !ch.IsValid() {
 		return fmt.Errorf("[%s] in invalid state", ch.ConnectedTo)
 	}
-	ch.send <- &Have{index}
-	return nil
+	return ch.queue(&Have{index})
 }
 
 func (ch *Channel) WaitFor(ctx context.Context, tag MessageTag) error {
@@ -161,7 +400,7 @@ func (ch *Channel) WaitFor(ctx context.Context, tag MessageTag) error {
 }
 
 func (ch *Channel) handleMessage(msg Message) error {
-	ch.debug("<- %s", msg.String())
+	ch.logger.Debug("received", bt.MessageKey, msg.String())
 	switch m := msg.(type) {
 	case *Choke:
 		{
@@ -199,13 +438,37 @@ func (ch *Channel) handleMessage(msg Message) error {
 		{
 			return ch.handleCancel(m)
 		}
+	case *Suggest:
+		{
+			return ch.handleSuggest(m)
+		}
+	case *HaveAll:
+		{
+			return ch.handleHaveAll(m)
+		}
+	case *HaveNone:
+		{
+			return ch.handleHaveNone(m)
+		}
+	case *Reject:
+		{
+			return ch.handleReject(m)
+		}
+	case *AllowedFast:
+		{
+			return ch.handleAllowedFast(m)
+		}
+	case *Extended:
+		{
+			return ch.handleExtended(m)
+		}
 	case *KeepAlive:
 		{
 			return ch.handleKeepAlive(m)
 		}
 	default:
 		{
-			ch.log("no handler for message: %s", m.String())
+			ch.logger.Warn("no handler for message", bt.MessageKey, m.String())
 		}
 	}
 
@@ -232,8 +495,117 @@ func (ch *Channel) IsState(v ...ChannelState) bool {
 	return false
 }
 
+// PeerState returns a snapshot of the choke and interest flags of the connection
+func (ch *Channel) PeerState() PeerState {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.peerState
+}
+
+// IsChoked reports whether the peer is currently choking us
 func (ch *Channel) IsChoked() bool {
-	return ch.IsState(Choked) && ch.IsValid()
+	return ch.PeerState().PeerChoking && ch.IsValid()
+}
+
+// IsFast reports whether the Fast Extension (BEP 6) is enabled on the connection
+func (ch *Channel) IsFast() bool {
+	return ch.fast
+}
+
+// AllowedFast reports whether the peer lets us request the piece while it chokes us, because it said so
+// or because the piece is in the canonical set PredictAllowedFast computed
+func (ch *Channel) AllowedFast(idx int) bool {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.allowedWhileChoked(idx)
+}
+
+// allowedWhileChoked reports whether the piece may be requested while the peer chokes us - the caller
+// has to hold the lock
+func (ch *Channel) allowedWhileChoked(idx int) bool {
+	return ch.allowedFast[idx] || ch.predictedFast[idx]
+}
+
+// PredictAllowedFast computes the canonical allowed fast set (BEP 6) the peer most likely grants us, from
+// the address we are connected from and the number of pieces in the torrent. The pieces can be requested
+// while the peer chokes us before it sends AllowedFast for them. Nothing is predicted without the fast
+// extension or an IPv4 address.
+func (ch *Channel) PredictAllowedFast(numPieces int) {
+	if !ch.fast {
+		return
+	}
+	addr, ok := ch.conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	set := GenerateAllowedFast(AllowedFastSetSize, numPieces, ch.Handshake.Hash, addr.IP)
+	ch.Lock()
+	defer ch.Unlock()
+	for _, idx := range set {
+		ch.predictedFast[idx] = true
+	}
+}
+
+// PendingRequests returns the number of requests that have not been answered yet, including the
+// ones that are waiting on the peer to unchoke us
+func (ch *Channel) PendingRequests() int {
+	ch.Lock()
+	defer ch.Unlock()
+	return len(ch.requests) + len(ch.deferred)
+}
+
+// TakePendingRequests hands back every request that has not been answered yet. The channel forgets
+// about them, so blocks that still arrive for them are treated as unrequested.
+func (ch *Channel) TakePendingRequests() []PieceRequest {
+	ch.Lock()
+	defer ch.Unlock()
+	pending := make([]PieceRequest, 0, len(ch.requests)+len(ch.deferred))
+	for req := range ch.requests {
+		pending = append(pending, req)
+	}
+	pending = append(pending, ch.deferred...)
+	ch.requests = map[PieceRequest]time.Time{}
+	ch.deferred = nil
+	ch.waitingSince = time.Time{}
+	return pending
+}
+
+// TakeExpiredRequests hands back the requests that have been waiting on the peer for longer than
+// timeout. The channel forgets about them like it does in TakePendingRequests.
+func (ch *Channel) TakeExpiredRequests(timeout time.Duration) []PieceRequest {
+	ch.Lock()
+	defer ch.Unlock()
+	var expired []PieceRequest
+	for req, sent := range ch.requests {
+		if time.Since(sent) > timeout {
+			expired = append(expired, req)
+			delete(ch.requests, req)
+		}
+	}
+	return expired
+}
+
+// IsSnubbed reports whether we have been waiting on the peer for a block for longer than SnubTimeout.
+// Requests that expired still count as waiting, but requests held back because the peer is choking
+// us don't.
+func (ch *Channel) IsSnubbed() bool {
+	ch.Lock()
+	defer ch.Unlock()
+	return !ch.waitingSince.IsZero() && time.Since(ch.waitingSince) > SnubTimeout
+}
+
+// MaxRequests returns the number of outstanding requests the peer allows
+func (ch *Channel) MaxRequests() int {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.reqq
+}
+
+// RequestLatency returns the average and the minimum time it took the peer to answer a request
+func (ch *Channel) RequestLatency() (avg time.Duration, min time.Duration) {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.latency, ch.minLatency
 }
 
 func (ch *Channel) IsValid() bool {
@@ -241,162 +613,244 @@ func (ch *Channel) IsValid() bool {
 }
 
 func (ch *Channel) writer() {
-	buf := bufio.NewWriter(ch.conn)
+	buf := bufio.NewWriter(&countingWriter{w: ch.conn, n: &ch.counters.out})
 	defer ch.Close()
-	defer ch.debug("<<< writer exiting >>>")
+	defer ch.logger.Debug("writer exiting")
+
+	keepAlive := time.NewTicker(KeepAliveInterval / 3)
+	defer keepAlive.Stop()
+	lastWrite := time.Now()
+
+	write := func(m Message) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		err := WriteMessage(ctx, buf, m)
+		// batch up whatever is queued right behind this message into one write
+		if err == nil && len(ch.send) == 0 {
+			err = buf.Flush()
+		}
+		lastWrite = time.Now()
+		ch.logger.Debug("sent", bt.MessageKey, m.String())
+		return err
+	}
 
-	ctx := context.Background()
 	for {
+		var m Message
 		select {
 		case <-ch.Done:
 			return
-		case m := <-ch.send:
-			{
-				if m == nil {
-					ch.log("got nil message - ignoring")
-					continue
-				}
-				ch.chokeCond.L.Lock()
-				if ch.IsChoked() {
-					ch.log("choked - waiting")
-					ch.chokeCond.Wait()
-				}
-				ch.chokeCond.L.Unlock()
-
-				ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
-				err := WriteMessage(ctx, buf, m)
-				cancel()
-				buf.Flush()
-				ch.debug("-> %s", m.String())
-				if err != nil {
-					ch.setError(err)
-					if err == ctx.Err() {
-						return
-					}
-					ch.log("failed to write message: %v\n", err)
-				}
-
+		case <-keepAlive.C:
+			if time.Since(lastWrite) < KeepAliveInterval {
+				continue
+			}
+			m = &KeepAlive{}
+		case m = <-ch.send:
+			if m == nil {
+				ch.logger.Warn("ignoring nil message")
+				continue
+			}
+			// a choke discards every request that is in flight, including the ones still
+			// waiting to be written, so those have already been moved back to deferred. With the
+			// fast extension the peer rejects them explicitly instead.
+			if _, ok := m.(*PieceRequest); ok && ch.IsChoked() && !ch.IsFast() {
+				ch.logger.Debug("dropping request while choked", bt.MessageKey, m.String())
+				continue
 			}
 		}
+
+		if err := ch.limit(ch.upLimit, m); err != nil {
+			return
+		}
+		if blk, ok := m.(*PieceBlock); ok {
+			ch.counters.payloadOut.Add(int64(len(blk.Data)))
+		}
+		ch.stats.sent(m)
+		if err := write(m); err != nil {
+			ch.logger.Warn("failed to write message", bt.MessageKey, m.String(), "err", err)
+			ch.setError(err)
+			return
+		}
 	}
 }
 
+// reader decodes messages from the peer until the connection fails. There is no deadline on single
+// messages since a slow peer can take a while to send a block - only a connection that stays silent
+// for IdleTimeout is given up on.
 func (ch *Channel) reader() {
-	buf := bufio.NewReader(ch.conn)
+	buf := bufio.NewReader(&countingReader{r: ch.conn, n: &ch.counters.in})
 	defer ch.Close()
 
-	defer ch.debug("<<< reader exiting >>>")
+	defer ch.logger.Debug("reader exiting")
 
-	ctx := context.Background()
 	for {
 		select {
 		case <-ch.Done:
 			return
 		default:
-			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			msg, err := DecodeMessage(ctx, buf)
-			cancel()
-			if err != nil {
-				ch.setError(err)
-				if err == ctx.Err() {
-					ch.debug("context Deadline exceeded - returning")
-					return
-				} else if err == io.EOF {
-					ch.debug("EOF - returning")
-					return
-				} else {
-					ch.log("failed to decode raw message: %v", err)
-					continue
-				}
+		}
 
+		ch.conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		msg, err := DecodeMessage(context.Background(), buf)
+		if err == ErrUnknownMessage {
+			ch.logger.Debug("ignoring unknown message")
+			continue
+		} else if err != nil {
+			ch.setError(err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				ch.logger.Debug("connection idle", "timeout", IdleTimeout)
+			} else if errors.Is(err, io.EOF) {
+				ch.logger.Debug("connection closed by peer")
+			} else {
+				ch.logger.Warn("failed to decode message", "err", err)
 			}
+			return
+		}
+		if blk, ok := msg.(*PieceBlock); ok {
+			ch.counters.payloadIn.Add(int64(len(blk.Data)))
+		}
+		ch.stats.received(msg)
+		// not reading while the limit is reached holds the peer back through TCP flow control
+		if err := ch.limit(ch.downLimit, msg); err != nil {
+			return
+		}
 
-			ch.handleMessage(msg)
+		if err := ch.handleMessage(msg); err != nil {
+			ch.logger.Warn("failed to handle message", bt.MessageKey, msg.String(), "err", err)
 		}
 	}
-
 }
 
 func (ch *Channel) setError(err error) {
 	ch.Lock()
 	defer ch.Unlock()
+	// once closed the connection errors are a consequence of the close, not the cause
+	if ch.IsState(Closed) {
+		return
+	}
 	ch.SetState(ErrorState)
 	ch.Err = err
 }
 
-func (ch *Channel) debug(format string, args ...any) {
-	if DEBUG {
-		prefix := fmt.Sprintf("[%s]", ch.ConnectedTo)
-		value := fmt.Sprintf(format, args...)
-		fmt.Printf("%s %s\n", prefix, value)
-	}
-}
-
-func (ch *Channel) log(format string, args ...any) {
-	prefix := fmt.Sprintf("[%s]", ch.ConnectedTo)
-	value := fmt.Sprintf(format, args...)
-	fmt.Printf("%s %s\n", prefix, value)
+// Logger returns the logger of the channel, which has the peer and info hash attached
+func (ch *Channel) Logger() *slog.Logger {
+	return ch.logger
 }
 
 func (ch *Channel) RegisterReceiveHook(tag MessageTag, h MessageHandler) {
 	ch.Lock()
-	ch.onRecvHooks[tag] = h
 	defer ch.Unlock()
+	ch.onRecvHooks[tag] = h
 }
 
 func (ch *Channel) RemoveReceiveHook(tag MessageTag) {
 	ch.Lock()
-	delete(ch.onRecvHooks, tag)
 	defer ch.Unlock()
+	delete(ch.onRecvHooks, tag)
 }
 
 func (ch *Channel) Close() {
 	ch.Lock()
 	defer ch.Unlock()
-	if !ch.IsState(Closed) {
+	select {
+	case <-ch.Done:
+		ch.logger.Debug("already closed")
+	default:
 		ch.SetState(Closed)
 		close(ch.Done)
-		close(ch.send)
-		ch.debug("closed")
-	} else {
-		ch.debug("already Closed")
+		ch.cancel()
+		ch.conn.Close()
+		ch.logger.Debug("closed")
 	}
 }
 
+// handleChoke marks us as choked. The peer discards every request it has not answered yet when it
+// chokes us, so all outstanding requests are moved back to deferred to be issued again on unchoke.
+// With the fast extension the peer sends a Reject for every request it discards, so those are left
+// alone.
 func (ch *Channel) handleChoke(msg Message) error {
-	ch.chokeCond.L.Lock()
-	ch.SetState(Choked)
-	defer ch.chokeCond.L.Unlock()
+	ch.Lock()
+	ch.peerState.PeerChoking = true
+	if !ch.unchokedSince.IsZero() {
+		ch.unchoked += time.Since(ch.unchokedSince)
+		ch.unchokedSince = time.Time{}
+	}
+	if ch.fast {
+		ch.Unlock()
+		ch.fireReceiveHook(msg)
+		return nil
+	}
+	discarded := make([]PieceRequest, 0, len(ch.requests))
+	for req := range ch.requests {
+		discarded = append(discarded, req)
+	}
+	ch.requests = map[PieceRequest]time.Time{}
+	ch.waitingSince = time.Time{}
+	sort.Slice(discarded, func(i, j int) bool {
+		if discarded[i].Index != discarded[j].Index {
+			return discarded[i].Index < discarded[j].Index
+		}
+		return discarded[i].Begin < discarded[j].Begin
+	})
+	ch.deferred = append(discarded, ch.deferred...)
+	ch.Unlock()
+
 	ch.fireReceiveHook(msg)
 	return nil
 }
+
+// handleUnchoke marks us as unchoked and issues all the requests that were held back while we were choked
 func (ch *Channel) handleUnchoke(msg Message) error {
-	ch.chokeCond.L.Lock()
-	defer ch.chokeCond.L.Unlock()
-	if ch.IsChoked() {
-		ch.SetState(Unchoked)
-		ch.chokeCond.Signal()
+	ch.Lock()
+	ch.peerState.PeerChoking = false
+	if ch.unchokedSince.IsZero() {
+		ch.unchokedSince = time.Now()
+	}
+	reissue := ch.deferred
+	ch.deferred = nil
+	now := time.Now()
+	for _, req := range reissue {
+		ch.trackRequest(req, now)
+	}
+	ch.Unlock()
+
+	for i := range reissue {
+		if err := ch.queue(&reissue[i]); err != nil {
+			return err
+		}
 	}
+
 	ch.fireReceiveHook(msg)
 	return nil
 }
 
 func (ch *Channel) fireReceiveHook(msg Message) {
+	ch.Lock()
 	fn, ok := ch.onRecvHooks[msg.Tag()]
+	ch.Unlock()
 	if ok {
 		fn(msg)
 	}
 }
 
 func (ch *Channel) handleInterested(msg Message) error {
+	ch.Lock()
+	ch.peerState.PeerInterested = true
+	ch.Unlock()
 	ch.fireReceiveHook(msg)
 	return nil
 }
 func (ch *Channel) handleNotInterested(msg Message) error {
+	ch.Lock()
+	ch.peerState.PeerInterested = false
+	ch.Unlock()
 	ch.fireReceiveHook(msg)
 	return nil
 }
-func (ch *Channel) handleHave(msg Message) error {
+func (ch *Channel) handleHave(msg *Have) error {
+	ch.Lock()
+	ch.BitField.Set(msg.Index)
+	ch.notifyPiecesChanged()
+	ch.Unlock()
 	ch.fireReceiveHook(msg)
 	return nil
 }
@@ -408,18 +862,134 @@ func (ch *Channel) handleBitField(msg Message) error {
 	}
 	ch.Lock()
 	ch.BitField = v
-	defer ch.Unlock()
+	ch.notifyPiecesChanged()
+	ch.Unlock()
 	ch.fireReceiveHook(msg)
 	return nil
 }
 func (ch *Channel) handlePieceBlock(blk *PieceBlock) error {
+	req := PieceRequest{Index: blk.Index, Begin: blk.Begin, Length: len(blk.Data)}
+	ch.Lock()
+	if sent, ok := ch.requests[req]; ok {
+		delete(ch.requests, req)
+		ch.recordLatency(time.Since(sent))
+	}
+	if len(ch.requests) > 0 {
+		ch.waitingSince = time.Now()
+	} else {
+		ch.waitingSince = time.Time{}
+	}
+	ch.Unlock()
 	ch.fireReceiveHook(blk)
 	return nil
 }
-func (ch *Channel) handlePieceRequest(msg Message) error {
+
+// trackRequest records that the request was sent - the caller has to hold the lock
+func (ch *Channel) trackRequest(req PieceRequest, sent time.Time) {
+	if ch.waitingSince.IsZero() {
+		ch.waitingSince = sent
+	}
+	ch.requests[req] = sent
+}
+
+// recordLatency adds the sample to the moving average - the caller has to hold the lock
+func (ch *Channel) recordLatency(sample time.Duration) {
+	if ch.latency == 0 {
+		ch.latency = sample
+	} else {
+		ch.latency = (ch.latency*7 + sample) / 8
+	}
+	if ch.minLatency == 0 || sample < ch.minLatency {
+		ch.minLatency = sample
+	}
+}
+
+func (ch *Channel) handleExtended(msg *Extended) error {
+	if msg.ExtendedID == ExtendedHandshakeID {
+		h, err := DecodeExtendedHandshake(msg)
+		if err != nil {
+			return err
+		}
+		if h.Reqq > 0 {
+			ch.Lock()
+			ch.reqq = h.Reqq
+			ch.Unlock()
+		}
+	}
+	ch.fireReceiveHook(msg)
+	return nil
+}
+
+// handlePieceRequest rejects the request when the fast extension is on, since we don't serve pieces
+func (ch *Channel) handlePieceRequest(msg *PieceRequest) error {
+	if ch.fast {
+		if err := ch.queue(&Reject{Index: msg.Index, Begin: msg.Begin, Length: msg.Length}); err != nil {
+			return err
+		}
+	}
+	ch.fireReceiveHook(msg)
+	return nil
+}
+
+// handleHaveAll replaces the bitfield with one that has every piece. Hooks for BitField are fired with
+// the result, so listeners don't have to tell the two apart.
+func (ch *Channel) handleHaveAll(msg *HaveAll) error {
+	ch.Lock()
+	field := ch.BitField.Copy()
+	for i := range field.Field {
+		field.Field[i] = 0xff
+	}
+	ch.BitField = field
+	ch.notifyPiecesChanged()
+	ch.Unlock()
+	ch.fireReceiveHook(msg)
+	ch.fireReceiveHook(field.Copy())
+	return nil
+}
+
+// handleHaveNone replaces the bitfield with an empty one, firing the hooks for BitField as well
+func (ch *Channel) handleHaveNone(msg *HaveNone) error {
+	ch.Lock()
+	field := &BitField{Field: make([]byte, len(ch.BitField.Field))}
+	ch.BitField = field
+	ch.notifyPiecesChanged()
+	ch.Unlock()
+	ch.fireReceiveHook(msg)
+	ch.fireReceiveHook(field.Copy())
+	return nil
+}
+
+// handleSuggest only passes the suggestion on to the hooks, see Suggest
+func (ch *Channel) handleSuggest(msg *Suggest) error {
 	ch.fireReceiveHook(msg)
 	return nil
 }
+
+func (ch *Channel) handleAllowedFast(msg *AllowedFast) error {
+	ch.Lock()
+	ch.allowedFast[msg.Index] = true
+	ch.Unlock()
+	ch.fireReceiveHook(msg)
+	return nil
+}
+
+// handleReject forgets the rejected request, it will never be answered. A predicted allowed fast piece
+// that is rejected while the peer chokes us isn't in its set after all.
+func (ch *Channel) handleReject(msg *Reject) error {
+	req := PieceRequest{Index: msg.Index, Begin: msg.Begin, Length: msg.Length}
+	ch.Lock()
+	if ch.peerState.PeerChoking && !ch.allowedFast[msg.Index] {
+		delete(ch.predictedFast, msg.Index)
+	}
+	delete(ch.requests, req)
+	if len(ch.requests) == 0 {
+		ch.waitingSince = time.Time{}
+	}
+	ch.Unlock()
+	ch.fireReceiveHook(msg)
+	return nil
+}
+
 func (ch *Channel) handleCancel(msg Message) error {
 	ch.fireReceiveHook(msg)
 	return nil
@@ -430,18 +1000,49 @@ func (ch *Channel) handleKeepAlive(msg Message) error {
 }
 
 func (ch *Channel) HasPiece(idx int) bool {
-	byteIdx := idx / 8
-	offset := idx % 8
 	ch.Lock()
 	defer ch.Unlock()
-	return ch.BitField.Field[byteIdx]>>(7-offset)&1 != 0
+	return ch.BitField.Has(idx)
+}
+
+// notifyPiecesChanged wakes up everyone waiting in WaitForPiece - the caller has to hold the lock
+func (ch *Channel) notifyPiecesChanged() {
+	close(ch.piecesChanged)
+	ch.piecesChanged = make(chan struct{})
+}
+
+// WaitForPiece waits until the peer tells us it has the piece. Peers send their bitfield right after the
+// handshake, but we might get to ask before it has arrived.
+func (ch *Channel) WaitForPiece(ctx context.Context, idx int) error {
+	for {
+		ch.Lock()
+		has := ch.BitField.Has(idx)
+		changed := ch.piecesChanged
+		ch.Unlock()
+		if has {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch.Done:
+			return ErrChannelClosed
+		case <-changed:
+		}
+	}
+}
+
+// Pieces returns a copy of the pieces the peer told us it has
+func (ch *Channel) Pieces() *BitField {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.BitField.Copy()
 }
 
 func (ch *Channel) SetPiece(idx int) {
-	byteIdx := idx / 8
-	offset := idx % 8
 	ch.Lock()
 	defer ch.Unlock()
-	ch.BitField.Field[byteIdx] |= 1 << (7 - offset)
-	ch.log("setting piece %d in bitfield", idx)
+	ch.BitField.Set(idx)
+	ch.logger.Debug("setting piece in bitfield", bt.PieceKey, idx)
 }
@@ -0,0 +1,235 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+type remotePeer struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestChannel(t *testing.T) (*Channel, *remotePeer) {
+	t.Helper()
+	local, remote := net.Pipe()
+	ch := NewChannel(local, &Handshake{}, &BitField{Field: make([]byte, 1)}, nil)
+	t.Cleanup(func() {
+		ch.Close()
+		remote.Close()
+	})
+
+	return ch, &remotePeer{t: t, conn: remote, r: bufio.NewReader(remote)}
+}
+
+func (p *remotePeer) send(m Message) {
+	p.t.Helper()
+	if _, err := p.conn.Write(EncodeMessage(m)); err != nil {
+		p.t.Fatalf("failed to write %s to channel: %v", m.String(), err)
+	}
+}
+
+func (p *remotePeer) expect(want Message) {
+	p.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, err := DecodeMessage(ctx, p.r)
+	if err != nil {
+		p.t.Fatalf("expected %s but failed to read message: %v", want.String(), err)
+	}
+	if !msg.Equal(want) {
+		p.t.Fatalf("expected %#v but got %#v", want, msg)
+	}
+}
+
+func TestChannelStartsChoked(t *testing.T) {
+	ch, _ := newTestChannel(t)
+
+	if state := ch.PeerState(); state != NewPeerState() {
+		t.Fatalf("incorrect initial state: %s", state)
+	}
+	if !ch.IsChoked() {
+		t.Fatalf("channel should start out choked")
+	}
+	if !ch.IsState(Connected) {
+		t.Fatalf("expected channel to be %s got %s", Connected, ch.GetState())
+	}
+}
+
+func TestChannelOnlyHoldsBackRequestsWhileChoked(t *testing.T) {
+	ch, remote := newTestChannel(t)
+
+	if err := ch.SendPieceRequest(0, 0, 16); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	if err := ch.SendInterested(); err != nil {
+		t.Fatalf("failed to send interested: %v", err)
+	}
+
+	// the request is held back, so Interested has to be the first thing on the wire
+	remote.expect(&Interested{})
+	if n := ch.PendingRequests(); n != 1 {
+		t.Fatalf("expected 1 pending request got %d", n)
+	}
+
+	remote.send(&Unchoke{})
+	remote.expect(&PieceRequest{Index: 0, Begin: 0, Length: 16})
+
+	if state := ch.PeerState(); state.PeerChoking || !state.AmInterested {
+		t.Fatalf("incorrect state after unchoke: %s", state)
+	}
+}
+
+func TestChannelReissuesRequestsAfterChoke(t *testing.T) {
+	ch, remote := newTestChannel(t)
+
+	remote.send(&Unchoke{})
+	if err := ch.SendPieceRequest(1, 0, 16); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	remote.expect(&PieceRequest{Index: 1, Begin: 0, Length: 16})
+
+	remote.send(&Choke{})
+	remote.send(&Unchoke{})
+	remote.expect(&PieceRequest{Index: 1, Begin: 0, Length: 16})
+
+	remote.send(&PieceBlock{Index: 1, Begin: 0, Data: make([]byte, 16)})
+	deadline := time.Now().Add(time.Second)
+	for ch.PendingRequests() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request still pending after block was received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestChannelExpiresUnansweredRequests(t *testing.T) {
+	ch, remote := newTestChannel(t)
+
+	remote.send(&Unchoke{})
+	if err := ch.SendPieceRequest(2, 0, 16); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	remote.expect(&PieceRequest{Index: 2, Begin: 0, Length: 16})
+
+	if expired := ch.TakeExpiredRequests(time.Minute); len(expired) != 0 {
+		t.Fatalf("expected no expired requests got %v", expired)
+	}
+	time.Sleep(10 * time.Millisecond)
+	expired := ch.TakeExpiredRequests(time.Millisecond)
+	if len(expired) != 1 || expired[0] != (PieceRequest{Index: 2, Begin: 0, Length: 16}) {
+		t.Fatalf("expected request to have expired got %v", expired)
+	}
+	if n := ch.PendingRequests(); n != 0 {
+		t.Fatalf("expired request should no longer be pending - got %d pending", n)
+	}
+	if ch.IsSnubbed() {
+		t.Fatalf("channel should not be snubbed before %s", SnubTimeout)
+	}
+}
+
+func TestChannelCancelsRequests(t *testing.T) {
+	ch, remote := newTestChannel(t)
+
+	// held back requests are dropped without telling the peer
+	if err := ch.SendPieceRequest(0, 0, 16); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	if err := ch.SendCancel(0, 0, 16); err != nil {
+		t.Fatalf("failed to cancel request: %v", err)
+	}
+	if n := ch.PendingRequests(); n != 0 {
+		t.Fatalf("expected no pending requests got %d", n)
+	}
+
+	remote.send(&Unchoke{})
+	if err := ch.SendPieceRequest(0, 16, 16); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	remote.expect(&PieceRequest{Index: 0, Begin: 16, Length: 16})
+	if err := ch.SendCancel(0, 16, 16); err != nil {
+		t.Fatalf("failed to cancel request: %v", err)
+	}
+	remote.expect(&Cancel{Index: 0, Begin: 16, Length: 16})
+	if n := ch.PendingRequests(); n != 0 {
+		t.Fatalf("expected no pending requests got %d", n)
+	}
+}
+
+// syncBuffer collects logs from the goroutines of a channel
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestChannelLogsWithPeer(t *testing.T) {
+	buf := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ch := NewChannel(local, &Handshake{Hash: [20]byte{0xab}}, &BitField{Field: make([]byte, 1)}, logger)
+
+	ch.SetPiece(3)
+	ch.Close()
+	<-ch.Done
+
+	out := buf.String()
+	for _, want := range []string{"peer=pipe", "info_hash=ab00", "piece=3", `msg=closed`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in logs: %s", want, out)
+		}
+	}
+}
+
+func TestDialTimesOutWithoutHandshake(t *testing.T) {
+	// the peer accepts the connection but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(5 * time.Second)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	p := &types.Peer{IP: addr.IP, Port: addr.Port}
+	torrent := &types.Torrent{Hash: [20]byte{1}, PieceLength: 4, Length: 8}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := DialHandshakedChannel(ctx, nil, "00112233445566778899", p, torrent, nil); err == nil {
+		t.Fatalf("expected the handshake to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the handshake to stop at the deadline of ctx, took %s", elapsed)
+	}
+}
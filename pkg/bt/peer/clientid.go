@@ -0,0 +1,55 @@
+package peer
+
+import (
+	"strings"
+)
+
+// clients are the two letter codes of Azureus-style peer IDs
+var clients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+}
+
+// ClientName returns the client and version an Azureus-style peer ID like -qB4250- stands for, or an
+// empty string for other peer IDs. Clients with an unknown code are named by their code.
+func ClientName(peerID string) string {
+	if len(peerID) < 8 || peerID[0] != '-' || peerID[7] != '-' {
+		return ""
+	}
+	code, version := peerID[1:3], peerID[3:7]
+	for _, c := range code + version {
+		if !isAlnum(c) {
+			return ""
+		}
+	}
+
+	name, ok := clients[code]
+	if !ok {
+		name = code
+	}
+	// the version is one character per component, trailing zeros are left out
+	parts := []string{}
+	for _, c := range version {
+		parts = append(parts, string(c))
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return name + " " + strings.Join(parts, ".")
+}
+
+func isAlnum(c rune) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
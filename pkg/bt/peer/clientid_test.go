@@ -0,0 +1,23 @@
+package peer
+
+import "testing"
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		peerID string
+		want   string
+	}{
+		{peerID: "-qB4250-abcdefghijkl", want: "qBittorrent 4.2.5"},
+		{peerID: "-TR3000-abcdefghijkl", want: "Transmission 3.0"},
+		{peerID: "-UT355W-abcdefghijkl", want: "µTorrent 3.5.5.W"},
+		{peerID: "-XX1200-abcdefghijkl", want: "XX 1.2"},
+		{peerID: "M7-4-0--abcdefghijkl", want: ""},
+		{peerID: "00112233445566778899", want: ""},
+		{peerID: "-qB4", want: ""},
+	}
+	for _, tt := range tests {
+		if got := ClientName(tt.peerID); got != tt.want {
+			t.Errorf("ClientName(%q): expected %q got %q", tt.peerID, tt.want, got)
+		}
+	}
+}
@@ -35,12 +35,13 @@ func read(reader *bufio.Reader, data []byte) (n int, err error) {
 }
 
 func DecodeRawMessage(r *bufio.Reader) (*RawMessage, error) {
-	prefix := make([]byte, 5)
+	prefix := make([]byte, 4)
 	if _, err := read(r, prefix); err != nil {
 		return nil, err
 	}
 
-	length := binary.BigEndian.Uint32(prefix[0:4])
+	// a keep-alive is only the length, the next byte already belongs to the following message
+	length := binary.BigEndian.Uint32(prefix)
 	if length == 0 {
 		return &RawMessage{
 			Tag:     uint(KeepAliveType),
@@ -49,9 +50,12 @@ func DecodeRawMessage(r *bufio.Reader) (*RawMessage, error) {
 		}, nil
 	}
 
-	tag := uint(prefix[4])
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
 	msg := &RawMessage{
-		Tag:     tag,
+		Tag:     uint(tag),
 		Length:  length,
 		Payload: nil,
 	}
@@ -59,10 +63,8 @@ func DecodeRawMessage(r *bufio.Reader) (*RawMessage, error) {
 	if length > 1 {
 		msg.Payload = make([]byte, length-1) // -1  because we don't want the message tag
 		if n, err := read(r, msg.Payload); err != nil {
-			fmt.Printf("error reading payload: %v (%T)\n", err, err)
 			if errors.Is(err, io.EOF) {
 				msg.Payload = msg.Payload[:n]
-				println("EOF reached while reading payload - read", n)
 			} else {
 				return nil, err
 			}
@@ -72,6 +74,43 @@ func DecodeRawMessage(r *bufio.Reader) (*RawMessage, error) {
 	return msg, nil
 }
 
+func decodeHave(msg *RawMessage) (*Have, error) {
+	if len(msg.Payload) < 4 {
+		return nil, fmt.Errorf("payload too short - expected 4 bytes got %d", len(msg.Payload))
+	}
+
+	return &Have{Index: int(binary.BigEndian.Uint32(msg.Payload[0:4]))}, nil
+}
+
+func decodeSuggest(msg *RawMessage) (*Suggest, error) {
+	have, err := decodeHave(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &Suggest{Index: have.Index}, nil
+}
+
+func decodeAllowedFast(msg *RawMessage) (*AllowedFast, error) {
+	have, err := decodeHave(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &AllowedFast{Index: have.Index}, nil
+}
+
+func decodeReject(msg *RawMessage) (*Reject, error) {
+	req, err := decodePieceRequest(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reject{
+		Index:  req.Index,
+		Begin:  req.Begin,
+		Length: req.Length,
+	}, nil
+}
+
 func decodeBitField(msg *RawMessage) (*BitField, error) {
 	var result BitField
 	result.Field = msg.Payload
@@ -81,8 +120,8 @@ func decodeBitField(msg *RawMessage) (*BitField, error) {
 func decodePieceRequest(msg *RawMessage) (*PieceRequest, error) {
 	var req PieceRequest
 
-	if len(msg.Payload) == 0 {
-		return nil, fmt.Errorf("payload is empty")
+	if len(msg.Payload) < 12 {
+		return nil, fmt.Errorf("payload too short - expected 12 bytes got %d", len(msg.Payload))
 	}
 	req.Index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))   // 4 bytes
 	req.Begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))   // 4 bytes
@@ -91,11 +130,24 @@ func decodePieceRequest(msg *RawMessage) (*PieceRequest, error) {
 	return &req, nil
 }
 
+func decodeCancel(msg *RawMessage) (*Cancel, error) {
+	req, err := decodePieceRequest(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cancel{
+		Index:  req.Index,
+		Begin:  req.Begin,
+		Length: req.Length,
+	}, nil
+}
+
 func decodePiece(msg *RawMessage) (*PieceBlock, error) {
 	var block PieceBlock
 
-	if len(msg.Payload) == 0 {
-		return nil, fmt.Errorf("payload is empty")
+	if len(msg.Payload) < 8 {
+		return nil, fmt.Errorf("payload too short - expected at least 8 bytes got %d", len(msg.Payload))
 	}
 	block.Index = int(binary.BigEndian.Uint32(msg.Payload[0:4])) // 4 bytes
 	block.Begin = int(binary.BigEndian.Uint32(msg.Payload[4:8])) // 4 bytes
@@ -105,6 +157,17 @@ func decodePiece(msg *RawMessage) (*PieceBlock, error) {
 	return &block, nil
 }
 
+func decodeExtended(msg *RawMessage) (*Extended, error) {
+	if len(msg.Payload) == 0 {
+		return nil, fmt.Errorf("payload is empty")
+	}
+
+	return &Extended{
+		ExtendedID: msg.Payload[0],
+		Data:       msg.Payload[1:],
+	}, nil
+}
+
 func decodeHandshake(data []byte) (*Handshake, error) {
 	if len(data) < HandshakeLength {
 		return nil, fmt.Errorf("malformed handshake - expected length %d got %d", HandshakeLength, len(data))
@@ -127,8 +190,9 @@ func decodeHandshake(data []byte) (*Handshake, error) {
 		return nil, fmt.Errorf("incorrect protocol - expected %q got %q", BitTorrentProtocol, proto)
 	}
 
-	// skip 8 bytes ahead since that is reserved and we don't care yet about that
-	buf.Next(8)
+	// the 8 reserved bytes advertise which protocol extensions the peer supports
+	var reserved [8]byte
+	copy(reserved[:], buf.Next(8))
 
 	if buf.Len()+20 > len(data) {
 		return nil, fmt.Errorf("not enough data in handshake - cannot read info_hash")
@@ -145,8 +209,9 @@ func decodeHandshake(data []byte) (*Handshake, error) {
 	part = buf.Next(20)
 
 	return &Handshake{
-		PeerID: string(part[:]),
-		Hash:   hash,
+		PeerID:   string(part[:]),
+		Hash:     hash,
+		Reserved: reserved,
 	}, nil
 }
 
@@ -176,7 +241,7 @@ func DecodeMessage(ctx context.Context, r *bufio.Reader) (Message, error) {
 		}
 	case HaveType:
 		{
-			return &Have{}, nil
+			return decodeHave(msg)
 		}
 	case BitFieldType:
 		{
@@ -192,7 +257,31 @@ func DecodeMessage(ctx context.Context, r *bufio.Reader) (Message, error) {
 		}
 	case CancelType:
 		{
-			return &Cancel{}, nil
+			return decodeCancel(msg)
+		}
+	case SuggestType:
+		{
+			return decodeSuggest(msg)
+		}
+	case HaveAllType:
+		{
+			return &HaveAll{}, nil
+		}
+	case HaveNoneType:
+		{
+			return &HaveNone{}, nil
+		}
+	case RejectType:
+		{
+			return decodeReject(msg)
+		}
+	case AllowedFastType:
+		{
+			return decodeAllowedFast(msg)
+		}
+	case ExtendedType:
+		{
+			return decodeExtended(msg)
 		}
 	case KeepAliveType:
 		{
@@ -200,6 +289,5 @@ func DecodeMessage(ctx context.Context, r *bufio.Reader) (Message, error) {
 		}
 	}
 
-	fmt.Printf("TAG: %d\n", msg.Tag)
 	return nil, ErrUnknownMessage
 }
@@ -35,8 +35,8 @@ func TestDecodeMessage(t *testing.T) {
 		},
 		{
 			"decoding Have",
-			[]byte{0, 0, 0, 1, byte(HaveType)},
-			&Have{},
+			[]byte{0, 0, 0, 5, byte(HaveType), 0, 0, 1, 2},
+			&Have{Index: 258},
 		},
 		{
 			"decoding BitField",
@@ -55,8 +55,8 @@ func TestDecodeMessage(t *testing.T) {
 		},
 		{
 			"decoding Cancel",
-			[]byte{0, 0, 0, 1, byte(CancelType)},
-			&Cancel{},
+			[]byte{0, 0, 0, 13, byte(CancelType), 0, 0, 0, 1, 0, 0, 64, 0, 0, 0, 64, 0},
+			&Cancel{Index: 1, Begin: 16384, Length: 16384},
 		},
 	}
 
@@ -77,12 +77,56 @@ func TestDecodeMessage(t *testing.T) {
 	}
 }
 
+func TestDecodeKeepAliveThenMessage(t *testing.T) {
+	data := append(EncodeMessage(&KeepAlive{}), EncodeMessage(&Have{Index: 7})...)
+	r := bufio.NewReader(bytes.NewBuffer(data))
+
+	wanted := []Message{&KeepAlive{}, &Have{Index: 7}}
+	for _, want := range wanted {
+		msg, err := DecodeMessage(context.TODO(), r)
+		if err != nil {
+			t.Fatalf("failed to decode message: %v", err)
+		}
+		if !msg.Equal(want) {
+			t.Fatalf("expected %#v got %#v", want, msg)
+		}
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("expected all data to be read, %d bytes left", r.Buffered())
+	}
+}
+
+func TestDecodeShortPayload(t *testing.T) {
+	tt := []struct {
+		name string
+		data []byte
+	}{
+		{"Piece without begin", []byte{0, 0, 0, 5, byte(PieceType), 0, 0, 0, 1}},
+		{"Piece with short begin", []byte{0, 0, 0, 8, byte(PieceType), 0, 0, 0, 1, 0, 0, 1}},
+		{"Request without length", []byte{0, 0, 0, 9, byte(RequestType), 0, 0, 0, 1, 0, 0, 0, 1}},
+		{"Have without index", []byte{0, 0, 0, 1, byte(HaveType)}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if msg, err := DecodeMessage(context.TODO(), bufio.NewReader(bytes.NewBuffer(tc.data))); err == nil {
+				t.Errorf("expected an error got %#v", msg)
+			}
+		})
+	}
+}
+
 func TestEncodeMessage(t *testing.T) {
 	tt := []struct {
 		name    string
 		message Message
 		wanted  []byte
 	}{
+		{
+			"encode KeepAlive",
+			&KeepAlive{},
+			[]byte{0, 0, 0, 0},
+		},
 		{
 			"encode Choke",
 			&Choke{},
@@ -127,6 +171,42 @@ func TestEncodeAndDecodeOfSameMsg(t *testing.T) {
 			"encode/decode Piece Block",
 			&PieceBlock{Index: 1, Begin: 1, Data: []byte("william")},
 		},
+		{
+			"encode/decode Have",
+			&Have{Index: 7},
+		},
+		{
+			"encode/decode BitField",
+			&BitField{Field: []byte{0b10100000, 0b1}},
+		},
+		{
+			"encode/decode Cancel",
+			&Cancel{Index: 3, Begin: 16384, Length: 100},
+		},
+		{
+			"encode/decode Extended",
+			&Extended{ExtendedID: 3, Data: []byte("d1:ai1ee")},
+		},
+		{
+			"encode/decode Suggest",
+			&Suggest{Index: 12},
+		},
+		{
+			"encode/decode HaveAll",
+			&HaveAll{},
+		},
+		{
+			"encode/decode HaveNone",
+			&HaveNone{},
+		},
+		{
+			"encode/decode Reject",
+			&Reject{Index: 2, Begin: 32768, Length: 16384},
+		},
+		{
+			"encode/decode AllowedFast",
+			&AllowedFast{Index: 1059},
+		},
 	}
 
 	for _, tc := range tt {
@@ -142,3 +222,38 @@ func TestEncodeAndDecodeOfSameMsg(t *testing.T) {
 		})
 	}
 }
+
+func TestExtendedHandshake(t *testing.T) {
+	h := &ExtendedHandshake{
+		M:    map[string]int{"ut_pex": 1},
+		V:    ClientVersion,
+		Reqq: 500,
+	}
+	msg, err := h.Message()
+	if err != nil {
+		t.Fatalf("failed to create extended handshake message: %v", err)
+	}
+
+	other, err := DecodeExtendedHandshake(msg)
+	if err != nil {
+		t.Fatalf("failed to decode extended handshake: %v", err)
+	}
+
+	if other.Reqq != h.Reqq || other.V != h.V || other.M["ut_pex"] != 1 {
+		t.Errorf("extended handshake after encode/decode not equal to original: %#v != %#v", other, h)
+	}
+}
+
+func TestHandshakeReserved(t *testing.T) {
+	h := &Handshake{PeerID: "00112233445566778899", Reserved: DefaultReserved}
+	other, err := decodeHandshake(h.Payload())
+	if err != nil {
+		t.Fatalf("failed to decode handshake: %v", err)
+	}
+	if !other.SupportsExtensions() {
+		t.Errorf("expected decoded handshake to support extensions: %x", other.Reserved)
+	}
+	if !other.SupportsFast() {
+		t.Errorf("expected decoded handshake to support the fast extension: %x", other.Reserved)
+	}
+}
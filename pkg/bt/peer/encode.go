@@ -11,6 +11,10 @@ func EncodeMessage(m Message) []byte {
 		panic("Message cannot be nil")
 	}
 	tag := m.Tag()
+	// a keep alive is nothing but a zero length prefix
+	if tag == KeepAliveType {
+		return make([]byte, 4)
+	}
 	payload := m.Payload()
 	data := make([]byte, 4+1+len(payload))
 
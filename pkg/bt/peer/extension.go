@@ -0,0 +1,84 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
+)
+
+// ExtendedHandshakeID is the extended message id of the extension handshake
+const ExtendedHandshakeID = 0
+
+// DefaultReqq is the number of outstanding requests we assume a peer allows when it doesn't tell us
+const DefaultReqq = 250
+
+// ClientVersion is sent to peers in the extension handshake
+const ClientVersion = "bt-go 0.1"
+
+// ExtendedHandshake is the dictionary exchanged in the extension handshake (BEP 10)
+type ExtendedHandshake struct {
+	// M maps the names of the extension messages supported to the id they should be sent with
+	M map[string]int
+	// V is the name and version of the client
+	V string
+	// Reqq is the number of outstanding requests the peer allows without dropping any
+	Reqq int
+}
+
+func (e *ExtendedHandshake) Message() (*Extended, error) {
+	m := map[string]interface{}{}
+	for k, v := range e.M {
+		m[k] = v
+	}
+	dict := map[string]interface{}{
+		"m": m,
+	}
+	if e.V != "" {
+		dict["v"] = e.V
+	}
+	if e.Reqq > 0 {
+		dict["reqq"] = e.Reqq
+	}
+
+	data, err := encoding.NewBenEncoder().Encode(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Extended{
+		ExtendedID: ExtendedHandshakeID,
+		Data:       data,
+	}, nil
+}
+
+func DecodeExtendedHandshake(msg *Extended) (*ExtendedHandshake, error) {
+	if msg.ExtendedID != ExtendedHandshakeID {
+		return nil, fmt.Errorf("expected extended handshake but got extended message %d", msg.ExtendedID)
+	}
+
+	v, err := encoding.DecodeBencode(encoding.NewBencodeReader(string(msg.Data)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed extended handshake: %w", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected extended handshake dictionary but got %T", v)
+	}
+
+	h := &ExtendedHandshake{M: map[string]int{}}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for k, v := range m {
+			if id, ok := v.(int); ok {
+				h.M[k] = id
+			}
+		}
+	}
+	if v, ok := dict["v"].(string); ok {
+		h.V = v
+	}
+	if v, ok := dict["reqq"].(int); ok {
+		h.Reqq = v
+	}
+
+	return h, nil
+}
@@ -0,0 +1,146 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+)
+
+// Messages of the Fast Extension (BEP 6). They are only sent to peers that set fastExtensionBit in
+// their handshake.
+const (
+	SuggestType     MessageTag = 13
+	HaveAllType     MessageTag = 14
+	HaveNoneType    MessageTag = 15
+	RejectType      MessageTag = 16
+	AllowedFastType MessageTag = 17
+)
+
+// fastExtensionBit is set in reserved byte 7 by peers supporting the Fast Extension (BEP 6)
+const fastExtensionBit = 0x04
+
+// AllowedFastSetSize is the number of pieces peers usually allow us to request while choked
+const AllowedFastSetSize = 10
+
+// Suggest tells us a piece the peer would like us to download, usually because it has it cached. It is
+// only advice, our picker already knows which pieces are rare and we don't act on it.
+type Suggest struct {
+	Index int
+}
+
+// HaveAll replaces the bitfield of a peer that has every piece
+type HaveAll struct{}
+
+// HaveNone replaces the bitfield of a peer that has no pieces
+type HaveNone struct{}
+
+// Reject tells us the peer will not answer a request
+type Reject struct {
+	// Index is the zero index of the piece
+	Index int
+	// Begin is the zero based offset of with in the piece
+	Begin int
+	// Length is the length of the block in bytes
+	Length int
+}
+
+// AllowedFast tells us a piece we may request even while the peer is choking us
+type AllowedFast struct {
+	Index int
+}
+
+// SupportsFast reports whether the Fast Extension (BEP 6) is advertised in the handshake
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[7]&fastExtensionBit != 0
+}
+
+// GenerateAllowedFast computes the canonical allowed fast set from BEP 6 for a peer with the given
+// IPv4 address. Peers that use the canonical algorithm allow us exactly these pieces while choked.
+func GenerateAllowedFast(k int, numPieces int, hash [20]byte, ip net.IP) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = bt.Min(k, numPieces)
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, hash[:]...)
+
+	set := make([]int, 0, k)
+	seen := map[int]bool{}
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			index := int(y % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
+
+func (s *Suggest) Equal(m Message) bool {
+	v, ok := m.(*Suggest)
+	return ok && v.Index == s.Index
+}
+func (s *Suggest) Tag() MessageTag { return SuggestType }
+func (s *Suggest) String() string  { return "Suggest" }
+func (s *Suggest) Payload() []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data[0:4], uint32(s.Index))
+	return data
+}
+
+func (h *HaveAll) Equal(m Message) bool {
+	_, ok := m.(*HaveAll)
+	return ok
+}
+func (h *HaveAll) Tag() MessageTag { return HaveAllType }
+func (h *HaveAll) String() string  { return "HaveAll" }
+func (h *HaveAll) Payload() []byte { return nil }
+
+func (h *HaveNone) Equal(m Message) bool {
+	_, ok := m.(*HaveNone)
+	return ok
+}
+func (h *HaveNone) Tag() MessageTag { return HaveNoneType }
+func (h *HaveNone) String() string  { return "HaveNone" }
+func (h *HaveNone) Payload() []byte { return nil }
+
+func (r *Reject) Equal(m Message) bool {
+	v, ok := m.(*Reject)
+	if !ok {
+		return false
+	}
+
+	return v.Index == r.Index && v.Begin == r.Begin && v.Length == r.Length
+}
+func (r *Reject) Tag() MessageTag { return RejectType }
+func (r *Reject) String() string  { return "Reject" }
+func (r *Reject) Payload() []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:4], uint32(r.Index))
+	binary.BigEndian.PutUint32(data[4:8], uint32(r.Begin))
+	binary.BigEndian.PutUint32(data[8:12], uint32(r.Length))
+	return data
+}
+
+func (a *AllowedFast) Equal(m Message) bool {
+	v, ok := m.(*AllowedFast)
+	return ok && v.Index == a.Index
+}
+func (a *AllowedFast) Tag() MessageTag { return AllowedFastType }
+func (a *AllowedFast) String() string  { return "AllowedFast" }
+func (a *AllowedFast) Payload() []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data[0:4], uint32(a.Index))
+	return data
+}
@@ -0,0 +1,145 @@
+package peer
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGenerateAllowedFast(t *testing.T) {
+	var hash [20]byte
+	for i := range hash {
+		hash[i] = 0xaa
+	}
+	ip := net.IPv4(80, 4, 4, 200)
+
+	// the example from BEP 6
+	tt := []struct {
+		k    int
+		want []int
+	}{
+		{7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+	for _, tc := range tt {
+		got := GenerateAllowedFast(tc.k, 1313, hash, ip)
+		if len(got) != len(tc.want) {
+			t.Fatalf("expected %v got %v", tc.want, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("expected %v got %v", tc.want, got)
+			}
+		}
+	}
+
+	if got := GenerateAllowedFast(AllowedFastSetSize, 3, hash, ip); len(got) != 3 {
+		t.Errorf("set can't be larger than the number of pieces: %v", got)
+	}
+}
+
+func newFastTestChannel(t *testing.T) (*Channel, *remotePeer) {
+	t.Helper()
+	h := &Handshake{}
+	h.Reserved[7] = fastExtensionBit
+	local, remote := net.Pipe()
+	ch := NewChannel(local, h, NewBitField(16), nil)
+	t.Cleanup(func() {
+		ch.Close()
+		remote.Close()
+	})
+
+	return ch, &remotePeer{t: t, conn: remote, r: bufio.NewReader(remote)}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFastChannelRequestsAllowedFastWhileChoked(t *testing.T) {
+	ch, remote := newFastTestChannel(t)
+	if !ch.IsFast() {
+		t.Fatalf("fast extension should be enabled")
+	}
+
+	remote.send(&HaveAll{})
+	remote.send(&AllowedFast{Index: 3})
+	waitFor(t, "allowed fast piece", func() bool { return ch.AllowedFast(3) })
+	if !ch.HasPiece(15) {
+		t.Fatalf("HaveAll should set every piece")
+	}
+
+	if err := ch.SendPieceRequest(1, 0, 16); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	if err := ch.SendPieceRequest(3, 0, 16); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	// only the allowed fast piece goes out while choked
+	remote.expect(&PieceRequest{Index: 3, Begin: 0, Length: 16})
+
+	remote.send(&Reject{Index: 3, Begin: 0, Length: 16})
+	waitFor(t, "rejected request to be dropped", func() bool { return ch.PendingRequests() == 1 })
+
+	remote.send(&Unchoke{})
+	remote.expect(&PieceRequest{Index: 1, Begin: 0, Length: 16})
+}
+
+func TestFastChannelRejectsRequests(t *testing.T) {
+	ch, remote := newFastTestChannel(t)
+
+	remote.send(&PieceRequest{Index: 0, Begin: 0, Length: 16})
+	remote.expect(&Reject{Index: 0, Begin: 0, Length: 16})
+
+	remote.send(&HaveAll{})
+	waitFor(t, "every piece to be set", func() bool { return ch.HasPiece(0) })
+	remote.send(&HaveNone{})
+	waitFor(t, "every piece to be cleared", func() bool { return !ch.HasPiece(0) })
+}
+
+func TestFastChannelPredictsAllowedFast(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	local, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	h := &Handshake{Hash: [20]byte{1, 2, 3}}
+	h.Reserved[7] = fastExtensionBit
+	ch := NewChannel(local, h, NewBitField(16), nil)
+	defer ch.Close()
+	ch.PredictAllowedFast(16)
+
+	set := GenerateAllowedFast(AllowedFastSetSize, 16, h.Hash, net.IPv4(127, 0, 0, 1))
+	inSet := map[int]bool{}
+	for _, idx := range set {
+		inSet[idx] = true
+	}
+	for i := 0; i < 16; i++ {
+		if ch.AllowedFast(i) != inSet[i] {
+			t.Fatalf("expected the predicted set %v got piece %d allowed %v", set, i, ch.AllowedFast(i))
+		}
+	}
+
+	// a peer that doesn't use the canonical set rejects the piece
+	p := &remotePeer{t: t, conn: remote, r: bufio.NewReader(remote)}
+	p.send(&Reject{Index: set[0], Begin: 0, Length: 16})
+	waitFor(t, "rejected piece to be dropped", func() bool { return !ch.AllowedFast(set[0]) })
+}
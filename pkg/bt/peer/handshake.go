@@ -5,11 +5,19 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
+	"time"
 )
 
 const HandshakeType MessageTag = 98
 
+// extensionProtocolBit is set in reserved byte 5 by peers supporting the extension protocol (BEP 10)
+const extensionProtocolBit = 0x10
+
+// DefaultReserved are the reserved handshake bytes we send to advertise what we support
+var DefaultReserved = [8]byte{0, 0, 0, 0, 0, extensionProtocolBit, 0, fastExtensionBit}
+
 func (h *Handshake) Equal(m Message) bool {
 	other, ok := m.(*Handshake)
 	if !ok {
@@ -25,26 +33,38 @@ func (h *Handshake) Payload() []byte {
 
 	buf.WriteByte(byte(19))
 	buf.Write([]byte(BitTorrentProtocol))
-	buf.Write(bytes.Repeat([]byte{0}, 8))
+	buf.Write(h.Reserved[:])
 	buf.Write(h.Hash[:])
 	buf.Write([]byte(h.PeerID))
 
 	return buf.Bytes()
 }
 
-func doHandshake(ctx context.Context, conn net.Conn, peerID string, hash [20]byte) (*Handshake, error) {
-	println("writing handshake")
+// SupportsExtensions reports whether the extension protocol (BEP 10) is advertised in the handshake
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&extensionProtocolBit != 0
+}
+
+// doHandshake sends our handshake and reads the one of the peer. The deadline of ctx applies to conn until
+// the handshake is done.
+func doHandshake(ctx context.Context, conn net.Conn, peerID string, hash [20]byte, logger *slog.Logger) (*Handshake, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	logger.Debug("writing handshake")
 	us, err := writeHandshake(conn, peerID, hash)
 	if err != nil {
 		return nil, err
 	}
-	println("reading handshake")
+	logger.Debug("reading handshake")
 	them, err := readHandshake(conn)
 	if err != nil {
 		return nil, err
 	}
 
-	println("comparing handshakes")
+	logger.Debug("comparing handshakes")
 
 	if !us.Equal(them) {
 		return nil, fmt.Errorf("handshake mismatch\nsent: %x\nreceived: %x", us.Hash, them.Hash)
@@ -55,8 +75,9 @@ func doHandshake(ctx context.Context, conn net.Conn, peerID string, hash [20]byt
 
 func writeHandshake(conn net.Conn, peerID string, hash [20]byte) (*Handshake, error) {
 	handshake := &Handshake{
-		PeerID: peerID,
-		Hash:   hash,
+		PeerID:   peerID,
+		Hash:     hash,
+		Reserved: DefaultReserved,
 	}
 
 	w := bufio.NewWriter(conn)
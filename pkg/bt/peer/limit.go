@@ -0,0 +1,49 @@
+package peer
+
+import "sync"
+
+// ConnLimit caps the connections of several ConnManagers together, like those of every torrent of a
+// session. Connections that are being dialed count as well. A nil ConnLimit doesn't limit.
+type ConnLimit struct {
+	mu   sync.Mutex
+	max  int
+	used int
+}
+
+func NewConnLimit(max int) *ConnLimit {
+	return &ConnLimit{max: max}
+}
+
+// Used returns the number of connections that count against the limit
+func (l *ConnLimit) Used() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used
+}
+
+// take takes a connection from the limit and reports whether there was one left
+func (l *ConnLimit) take() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.used >= l.max {
+		return false
+	}
+	l.used++
+	return true
+}
+
+// put hands back a connection take returned
+func (l *ConnLimit) put() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used--
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
 )
 
 const (
@@ -17,6 +19,7 @@ const (
 	RequestType       MessageTag = 6
 	PieceType         MessageTag = 7
 	CancelType        MessageTag = 8
+	ExtendedType      MessageTag = 20
 )
 
 type MessageTag uint8
@@ -25,8 +28,9 @@ var ErrNotImplemented = fmt.Errorf("not implemented")
 var ErrUnknownMessage = fmt.Errorf("unknown message")
 
 type Handshake struct {
-	PeerID string
-	Hash   [20]byte
+	PeerID   string
+	Hash     [20]byte
+	Reserved [8]byte
 }
 
 type Message interface {
@@ -71,7 +75,22 @@ type PieceBlock struct {
 	// Length is the length of the block in bytes
 	Data []byte
 }
-type Cancel struct{}
+type Cancel struct {
+	// Index is the zero index of the piece
+	Index int
+	// Begin is the zero based offset of with in the piece
+	Begin int
+	// Length is the length of the block in bytes
+	Length int
+}
+
+// Extended carries a message of the extension protocol (BEP 10)
+type Extended struct {
+	// ExtendedID identifies the extension message. 0 is the extension handshake
+	ExtendedID uint8
+	// Data is the bencoded payload of the extension message
+	Data []byte
+}
 
 func (k *KeepAlive) Equal(m Message) bool {
 	_, ok := m.(*KeepAlive)
@@ -126,8 +145,8 @@ func (n *NotInterested) Payload() []byte {
 }
 
 func (h *Have) Equal(m Message) bool {
-	_, ok := m.(*Have)
-	return ok
+	v, ok := m.(*Have)
+	return ok && v.Index == h.Index
 }
 func (h *Have) Tag() MessageTag { return HaveType }
 func (h *Have) String() string  { return "Have" }
@@ -143,7 +162,49 @@ func (b *BitField) Equal(m Message) bool {
 }
 func (b *BitField) Tag() MessageTag { return BitFieldType }
 func (b *BitField) String() string  { return "BitField" }
-func (b *BitField) Payload() []byte { return nil }
+func (b *BitField) Payload() []byte { return b.Field }
+
+// NewBitField creates an empty bitfield big enough for the given number of pieces
+func NewBitField(pieces int) *BitField {
+	return &BitField{Field: make([]byte, bt.Ceil(pieces, 8))}
+}
+
+// Has reports whether the bit for the piece is set. Pieces outside the field are never set.
+func (b *BitField) Has(idx int) bool {
+	byteIdx := idx / 8
+	if idx < 0 || byteIdx >= len(b.Field) {
+		return false
+	}
+	offset := idx % 8
+	return b.Field[byteIdx]>>(7-offset)&1 != 0
+}
+
+// Set sets the bit for the piece. Pieces outside the field are ignored.
+func (b *BitField) Set(idx int) {
+	byteIdx := idx / 8
+	if idx < 0 || byteIdx >= len(b.Field) {
+		return
+	}
+	offset := idx % 8
+	b.Field[byteIdx] |= 1 << (7 - offset)
+}
+
+// Clear clears the bit for the piece. Pieces outside the field are ignored.
+func (b *BitField) Clear(idx int) {
+	byteIdx := idx / 8
+	if idx < 0 || byteIdx >= len(b.Field) {
+		return
+	}
+	offset := idx % 8
+	b.Field[byteIdx] &^= 1 << (7 - offset)
+}
+
+// Copy returns a bitfield with its own copy of the bits
+func (b *BitField) Copy() *BitField {
+	field := make([]byte, len(b.Field))
+	copy(field, b.Field)
+	return &BitField{Field: field}
+}
 
 func (r *PieceRequest) Equal(m Message) bool {
 	v, ok := m.(*PieceRequest)
@@ -182,9 +243,32 @@ func (p *PieceBlock) Payload() []byte {
 }
 
 func (c *Cancel) Equal(m Message) bool {
-	_, ok := m.(*Cancel)
-	return ok
+	v, ok := m.(*Cancel)
+	if !ok {
+		return false
+	}
+
+	return v.Index == c.Index && v.Begin == c.Begin && v.Length == c.Length
 }
 func (c *Cancel) Tag() MessageTag { return CancelType }
 func (c *Cancel) String() string  { return "Cancel" }
-func (c *Cancel) Payload() []byte { return nil }
+func (c *Cancel) Payload() []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:4], uint32(c.Index))
+	binary.BigEndian.PutUint32(data[4:8], uint32(c.Begin))
+	binary.BigEndian.PutUint32(data[8:12], uint32(c.Length))
+	return data
+}
+
+func (e *Extended) Equal(m Message) bool {
+	v, ok := m.(*Extended)
+	return ok && v.ExtendedID == e.ExtendedID && bytes.Equal(v.Data, e.Data)
+}
+func (e *Extended) Tag() MessageTag { return ExtendedType }
+func (e *Extended) String() string  { return "Extended" }
+func (e *Extended) Payload() []byte {
+	data := make([]byte, 1+len(e.Data))
+	data[0] = e.ExtendedID
+	copy(data[1:], e.Data)
+	return data
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/sha1"
 	"fmt"
+	"log/slog"
 	"sort"
 	"time"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/proxy"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
 )
 
@@ -16,6 +19,9 @@ const (
 
 )
 
+// BitFieldTimeout is how long we wait for a peer to tell us it has a piece before giving up on it
+const BitFieldTimeout = 5 * time.Second
+
 var ErrChannelClosed = fmt.Errorf("Channel Closed")
 
 type Client struct {
@@ -23,6 +29,8 @@ type Client struct {
 	Peer   *types.Peer
 
 	Channel *Channel
+	// Logger has the peer and info hash attached
+	Logger *slog.Logger
 }
 
 type Result[T any] struct {
@@ -30,10 +38,17 @@ type Result[T any] struct {
 	Err error
 }
 
-func NewClient(ctx context.Context, peerID string, peer *types.Peer, torrent *types.Torrent) (*Client, error) {
+// NewClient connects to the peer. The logger is used for the client and its channel, the default logger is
+// used when it is nil.
+func NewClient(ctx context.Context, peerID string, peer *types.Peer, torrent *types.Torrent, logger *slog.Logger) (*Client, error) {
+	return DialClient(ctx, nil, peerID, peer, torrent, logger)
+}
+
+// DialClient connects to the peer with dialer, like through a proxy, or directly when dialer is nil
+func DialClient(ctx context.Context, dialer proxy.Dialer, peerID string, peer *types.Peer, torrent *types.Torrent, logger *slog.Logger) (*Client, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	channel, err := NewHandshakedChannel(ctx, peerID, peer, torrent)
+	channel, err := DialHandshakedChannel(ctx, dialer, peerID, peer, torrent, logger)
 
 	if err != nil {
 		return nil, err
@@ -42,6 +57,7 @@ func NewClient(ctx context.Context, peerID string, peer *types.Peer, torrent *ty
 		PeerID:  peerID,
 		Peer:    peer,
 		Channel: channel,
+		Logger:  channel.Logger(),
 	}, nil
 }
 
@@ -94,66 +110,114 @@ func assembleData(blocks []*PieceBlock) ([]byte, error) {
 	return data, nil
 }
 
+// pieceSource is a BlockSource for the blocks of a single piece
+type pieceSource struct {
+	plan     *types.BlockPlan
+	queue    types.Queue[int]
+	blocks   []*PieceBlock
+	received int
+}
+
+func newPieceSource(plan *types.BlockPlan) *pieceSource {
+	queue := types.NewSliceQueue[int]()
+	for i := 0; i < plan.NumBlocks; i++ {
+		queue.Add(i)
+	}
+	return &pieceSource{
+		plan:   plan,
+		queue:  queue,
+		blocks: make([]*PieceBlock, plan.NumBlocks),
+	}
+}
+
+func (s *pieceSource) NextRequest(_ *Client) (*PieceRequest, bool) {
+	i, ok := s.queue.Pop()
+	if !ok {
+		return nil, false
+	}
+	return &PieceRequest{
+		Index:  s.plan.PieceIndex,
+		Begin:  i * s.plan.BlockSize,
+		Length: s.plan.BlockSizeFor(i),
+	}, true
+}
+
+func (s *pieceSource) BlockReceived(_ *Client, blk *PieceBlock) {
+	if blk.Index != s.plan.PieceIndex || blk.Begin%s.plan.BlockSize != 0 {
+		return
+	}
+	i := blk.Begin / s.plan.BlockSize
+	if i >= len(s.blocks) || s.blocks[i] != nil {
+		return
+	}
+	s.blocks[i] = blk
+	s.received++
+}
+
+func (s *pieceSource) Abandon(_ *Client, reqs []PieceRequest) {
+	for _, req := range reqs {
+		if req.Index == s.plan.PieceIndex {
+			s.queue.AddFirst(req.Begin / s.plan.BlockSize)
+		}
+	}
+}
+
+func (s *pieceSource) RequestTimedOut(c *Client, req PieceRequest, timeout time.Duration) error {
+	// there is no other peer to ask, so rather than waiting forever the piece fails
+	return &BlockTimeoutErr{
+		Peer:    c.Peer.String(),
+		Request: req,
+		Timeout: timeout,
+	}
+}
+
+func (s *pieceSource) RequestRejected(c *Client, req PieceRequest) error {
+	// a choking peer rejects everything that is queued, so the block is asked for again on unchoke
+	if c.Channel.IsChoked() {
+		s.Abandon(c, []PieceRequest{req})
+		return nil
+	}
+	return fmt.Errorf("[%s] block %d@%d of piece %d: %w", c.Peer.String(), req.Length, req.Begin, req.Index, ErrRequestRejected)
+}
+
+func (s *pieceSource) Wants(c *Client) bool {
+	return c.Channel.HasPiece(s.plan.PieceIndex)
+}
+
+func (s *pieceSource) Finished() bool {
+	return s.received == s.plan.NumBlocks
+}
+
 func (c *Client) DownloadPiece(plan *types.BlockPlan) (*types.Piece, error) {
 	// 1. bitfield
 	// 2. interested
 	// 3. unchoke
 	// 4. request
 	// 5. piece
-	if err := c.Channel.SendUnchoke(); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), BitFieldTimeout)
+	err := c.Channel.WaitForPiece(ctx, plan.PieceIndex)
+	cancel()
+	if err == context.DeadlineExceeded {
+		return nil, ErrPieceUnavailable
+	} else if err != nil {
 		return nil, err
 	}
+
 	if err := c.Channel.SendInterested(); err != nil {
 		return nil, err
 	}
 
-	// if c.Channel.HasPiece(plan.PieceIndex) {
-	// 	return nil, ErrPieceUnavailable
-	// }
-
-	downloaded := make([]*PieceBlock, 0, plan.NumBlocks)
-	result := make(chan *PieceBlock, plan.NumBlocks)
-	defer close(result)
-
-	c.Channel.RegisterReceiveHook(PieceType, func(msg Message) error {
-		blk, ok := msg.(*PieceBlock)
-
-		if !ok {
-			fmt.Printf("expected pieceblock but got %T", msg)
-		}
-
-		result <- blk
-		return nil
-	})
-
-	go func() {
-		for i := 0; i < plan.NumBlocks; i++ {
-			c.Channel.SendPieceRequest(plan.PieceIndex, i*plan.BlockSize, plan.BlockSizeFor(i))
-		}
-	}()
-
-Download:
-	for {
-		select {
-		case <-c.Channel.Done:
-			{
-				fmt.Printf("[%s] Channel Closed\n", c.Peer.String())
-				return nil, ErrChannelClosed
-			}
-		case blk := <-result:
-			fmt.Printf("[%s] receive Piece %d from peer (%d/%d)\n", c.Peer.String(), plan.PieceIndex, len(downloaded), plan.NumBlocks)
-			downloaded = append(downloaded, blk)
-
-			if len(downloaded) == plan.NumBlocks {
-				break Download
-			}
+	source := newPieceSource(plan)
+	if err := NewPipeline(c, source).Run(context.Background()); err != nil {
+		if err == ErrChannelClosed {
+			c.Channel.Logger().Debug("channel closed", bt.PieceKey, plan.PieceIndex)
 		}
+		return nil, err
 	}
 
 	c.Channel.SendHave(plan.PieceIndex)
-	c.Channel.RemoveReceiveHook(PieceType)
 
-	data, err := assembleData(downloaded)
+	data, err := assembleData(source.blocks)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,240 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+)
+
+const (
+	// MaxBlockSize is the largest block peers are willing to serve for a single request
+	MaxBlockSize = 16 * 1024
+	// MinQueueDepth is the number of requests kept outstanding before we know anything about the link
+	MinQueueDepth = 4
+	// MaxQueueDepth caps the number of outstanding requests even when the peer allows more
+	MaxQueueDepth = 500
+	// QueueTime is how much data, measured in time at the current download rate, is kept queued up
+	// at the peer on top of what is on the wire
+	QueueTime = 2 * time.Second
+	// MinRequestTimeout is the least amount of time a peer gets to answer a request. Peers that are
+	// usually slow get more time, see Pipeline.requestTimeout.
+	MinRequestTimeout = 20 * time.Second
+
+	pipelineTick   = 250 * time.Millisecond
+	adjustInterval = time.Second
+)
+
+// BlockTimeoutErr is returned when a peer does not answer a block request in time
+type BlockTimeoutErr struct {
+	Peer    string
+	Request PieceRequest
+	Timeout time.Duration
+}
+
+func (e *BlockTimeoutErr) Error() string {
+	return e.String()
+}
+
+func (e *BlockTimeoutErr) String() string {
+	return fmt.Sprintf("[%s] block %d@%d of piece %d not received within %s", e.Peer, e.Request.Length, e.Request.Begin, e.Request.Index, e.Timeout)
+}
+
+// BlockSource decides which blocks a Pipeline requests from its peer. A source shared between
+// pipelines has to be safe for concurrent use.
+type BlockSource interface {
+	// NextRequest returns the next block to request from the client's peer. ok is false when there
+	// is nothing to request from this peer right now.
+	NextRequest(c *Client) (req *PieceRequest, ok bool)
+	// BlockReceived is called for every block the peer sends us
+	BlockReceived(c *Client, blk *PieceBlock)
+	// Abandon hands back requests the pipeline will no longer wait on so they can be requested again
+	Abandon(c *Client, reqs []PieceRequest)
+	// RequestTimedOut is called when the peer failed to answer the request in time. The request is no
+	// longer outstanding and should preferably be requested from another peer. Returning an error
+	// stops the pipeline with that error.
+	RequestTimedOut(c *Client, req PieceRequest, timeout time.Duration) error
+	// RequestRejected is called when the peer rejected the request (BEP 6). The request is no longer
+	// outstanding. Returning an error stops the pipeline with that error.
+	RequestRejected(c *Client, req PieceRequest) error
+	// Wants reports whether the client's peer has anything we still need. A pipeline with nothing
+	// outstanding stops once its peer has nothing left that we want.
+	Wants(c *Client) bool
+	// Finished reports whether all the blocks have been received, which stops the pipeline
+	Finished() bool
+}
+
+// Pipeline keeps a number of block requests outstanding with a peer so that the peer always has the
+// next block queued up when it finishes sending the current one. The requests are not tied to a
+// single piece - whatever the BlockSource hands out gets requested.
+//
+// The queue depth adapts to the link: it covers the bandwidth-delay product measured from the download
+// rate and request latency plus QueueTime worth of data, and never exceeds what the peer advertised in reqq.
+type Pipeline struct {
+	client *Client
+	source BlockSource
+
+	target   int
+	rate     float64
+	received int
+}
+
+func NewPipeline(c *Client, source BlockSource) *Pipeline {
+	return &Pipeline{
+		client: c,
+		source: source,
+		target: MinQueueDepth,
+	}
+}
+
+// Target returns the number of requests the pipeline currently tries to keep outstanding
+func (p *Pipeline) Target() int {
+	return p.target
+}
+
+// Rate returns the download rate in bytes per second measured by the pipeline
+func (p *Pipeline) Rate() float64 {
+	return p.rate
+}
+
+// Run requests blocks from the source until the source is finished, the context is cancelled, the
+// channel closes, the peer snubs us or has nothing left we want. Requests that are still outstanding
+// when Run returns are handed back to the source.
+func (p *Pipeline) Run(ctx context.Context) error {
+	ch := p.client.Channel
+
+	blocks := make(chan *PieceBlock, MaxQueueDepth)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ch.RegisterReceiveHook(PieceType, func(msg Message) error {
+		blk, ok := msg.(*PieceBlock)
+		if !ok {
+			return nil
+		}
+		select {
+		case blocks <- blk:
+		case <-stop:
+		}
+		return nil
+	})
+	defer ch.RemoveReceiveHook(PieceType)
+
+	rejected := make(chan *Reject, MaxQueueDepth)
+	ch.RegisterReceiveHook(RejectType, func(msg Message) error {
+		r, ok := msg.(*Reject)
+		if !ok {
+			return nil
+		}
+		select {
+		case rejected <- r:
+		case <-stop:
+		}
+		return nil
+	})
+	defer ch.RemoveReceiveHook(RejectType)
+	defer func() {
+		if pending := ch.TakePendingRequests(); len(pending) > 0 {
+			p.source.Abandon(p.client, pending)
+		}
+	}()
+
+	tick := time.NewTicker(pipelineTick)
+	defer tick.Stop()
+	lastAdjust := time.Now()
+
+	for {
+		if p.source.Finished() {
+			return nil
+		}
+		if err := p.fill(); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch.Done:
+			return ErrChannelClosed
+		case blk := <-blocks:
+			p.received += len(blk.Data)
+			p.source.BlockReceived(p.client, blk)
+		case r := <-rejected:
+			req := PieceRequest{Index: r.Index, Begin: r.Begin, Length: r.Length}
+			if err := p.source.RequestRejected(p.client, req); err != nil {
+				return err
+			}
+		case now := <-tick.C:
+			if err := p.expire(); err != nil {
+				return err
+			}
+			if ch.IsSnubbed() {
+				return ErrSnubbed
+			}
+			if ch.PendingRequests() == 0 && !p.source.Wants(p.client) {
+				return ErrNothingWanted
+			}
+			if elapsed := now.Sub(lastAdjust); elapsed >= adjustInterval {
+				p.adjust(elapsed)
+				lastAdjust = now
+			}
+		}
+	}
+}
+
+// fill tops up the outstanding requests to the target depth
+func (p *Pipeline) fill() error {
+	ch := p.client.Channel
+	for ch.PendingRequests() < p.target {
+		req, ok := p.source.NextRequest(p.client)
+		if !ok {
+			return nil
+		}
+		if err := ch.SendPieceRequest(req.Index, req.Begin, req.Length); err != nil {
+			p.source.Abandon(p.client, []PieceRequest{*req})
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requestTimeout is how long the peer gets to answer a request. Requests queue up at the peer, so a peer
+// that is always slow to answer gets a multiple of its usual latency rather than a fixed timeout.
+func (p *Pipeline) requestTimeout() time.Duration {
+	avg, _ := p.client.Channel.RequestLatency()
+	return time.Duration(bt.Max(int(MinRequestTimeout), int(4*avg)))
+}
+
+// expire hands the requests the peer failed to answer in time back to the source
+func (p *Pipeline) expire() error {
+	timeout := p.requestTimeout()
+	for _, req := range p.client.Channel.TakeExpiredRequests(timeout) {
+		if err := p.source.RequestTimedOut(p.client, req, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjust updates the measured rate and recomputes the target depth from it
+func (p *Pipeline) adjust(elapsed time.Duration) {
+	sample := float64(p.received) / elapsed.Seconds()
+	p.received = 0
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = (p.rate*3 + sample) / 4
+	}
+
+	// the minimum latency is used since the average includes the time requests spend queued at the
+	// peer, which grows with the depth itself
+	_, rtt := p.client.Channel.RequestLatency()
+	window := rtt + QueueTime
+	depth := int(math.Ceil(p.rate * window.Seconds() / MaxBlockSize))
+
+	limit := bt.Min(MaxQueueDepth, p.client.Channel.MaxRequests())
+	p.target = bt.Min(bt.Max(depth, MinQueueDepth), limit)
+}
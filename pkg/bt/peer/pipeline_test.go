@@ -0,0 +1,59 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func TestPipelineKeepsRequestsOutstanding(t *testing.T) {
+	ch, remote := newTestChannel(t)
+	client := &Client{Peer: &types.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6881}, Channel: ch}
+
+	blockSize := 4
+	numBlocks := MinQueueDepth * 2
+	piece := bytes.Repeat([]byte("abcd"), numBlocks)
+	plan := &types.BlockPlan{
+		PieceIndex:     0,
+		PieceLength:    len(piece),
+		NumBlocks:      numBlocks,
+		BlockSize:      blockSize,
+		LastBlockIndex: numBlocks - 1,
+		LastBlockSize:  blockSize,
+	}
+
+	go func() {
+		remote.send(&BitField{Field: []byte{0b10000000}})
+		remote.send(&Unchoke{})
+	}()
+
+	result := make(chan Result[*types.Piece])
+	go func() {
+		p, err := client.DownloadPiece(plan)
+		result <- Result[*types.Piece]{R: p, Err: err}
+	}()
+
+	remote.expect(&Interested{})
+
+	// the pipeline has to request a full queue before the first block is answered
+	for i := 0; i < MinQueueDepth; i++ {
+		remote.expect(&PieceRequest{Index: 0, Begin: i * blockSize, Length: blockSize})
+	}
+	for i := 0; i < numBlocks; i++ {
+		begin := i * blockSize
+		remote.send(&PieceBlock{Index: 0, Begin: begin, Data: piece[begin : begin+blockSize]})
+		if next := i + MinQueueDepth; next < numBlocks {
+			remote.expect(&PieceRequest{Index: 0, Begin: next * blockSize, Length: blockSize})
+		}
+	}
+
+	r := <-result
+	if r.Err != nil {
+		t.Fatalf("failed to download piece: %v", r.Err)
+	}
+	if !bytes.Equal(r.R.Data, piece) {
+		t.Fatalf("incorrect piece data: %q", r.R.Data)
+	}
+}
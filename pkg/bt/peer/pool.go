@@ -3,85 +3,488 @@ package peer
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ipfilter"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/proxy"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
-	"github.com/jackc/puddle"
 )
 
-type peerPool struct {
-	peerID string
-	peers  *types.PeerSpec
-	pool   *puddle.Pool
-}
+const (
+	// DefaultMaxConns is how many peers a ConnManager stays connected to when MaxConns isn't set
+	DefaultMaxConns = 30
+	// DefaultMaxHalfOpen is how many connections a ConnManager dials at the same time when MaxHalfOpen
+	// isn't set
+	DefaultMaxHalfOpen = 8
+	// ReconnectBackoff is how long a peer that failed once is left alone. Every failure after that
+	// doubles it, up to MaxReconnectBackoff.
+	ReconnectBackoff    = 5 * time.Second
+	MaxReconnectBackoff = 10 * time.Minute
+	// MaxFailures is how many times in a row a peer may fail before it is forgotten
+	MaxFailures = 8
+	// ReplaceInterval is how often the worst peer is swapped for one we haven't tried, and how long a
+	// peer gets to prove itself before it can be swapped
+	ReplaceInterval = 30 * time.Second
+
+	manageInterval = time.Second
+)
+
+var ErrNoPeers = fmt.Errorf("no peers to connect to")
+var ErrPoolClosed = fmt.Errorf("peer pool closed")
 
 type Pool interface {
+	// Get returns a connected client that nobody else is using and the function that hands it back
 	Get(ctx context.Context) (*Client, func(), error)
+	// AddClient adds a client that is connected already, like a peer that connected to us
+	AddClient(c *Client)
+	// Close disconnects every peer
+	Close()
+}
+
+// Source is where we learned about a peer
+type Source string
+
+const (
+	SourceTracker Source = "tracker"
+	SourceDHT     Source = "dht"
+	SourcePEX     Source = "pex"
+	SourceInbound Source = "inbound"
+)
+
+// candidate is a peer we know of, connected or not
+type candidate struct {
+	peer   *types.Peer
+	source Source
+
+	client    *Client
+	busy      bool
+	dialing   bool
+	since     time.Time
+	failures  int
+	nextRetry time.Time
+	// downloaded and connected add up the previous connections to the peer, for its score
+	downloaded int64
+	connected  time.Duration
+}
+
+// score is the rate the peer sent us piece data at over all the time we were connected, which is cut
+// down by every failure in a row
+func (c *candidate) score(now time.Time) float64 {
+	downloaded, connected := c.downloaded, c.connected
+	if c.client != nil {
+		downloaded += c.client.Channel.Traffic().PayloadIn
+		connected += now.Sub(c.since)
+	}
+	if connected <= 0 {
+		return 0
+	}
+	rate := float64(downloaded) / connected.Seconds()
+	return rate / float64(1+c.failures)
+}
+
+// backoff returns how long to wait before dialing a peer that failed that many times in a row
+func backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	d := ReconnectBackoff
+	for i := 1; i < failures && d < MaxReconnectBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxReconnectBackoff {
+		return MaxReconnectBackoff
+	}
+	return d
+}
+
+// ConnManager keeps connections to the peers of a torrent. Peers can come from any source and are dialed
+// in the background, no more than MaxHalfOpen at a time, until MaxConns are connected. Peers that fail
+// are retried with exponential backoff, and every ReplaceInterval the peer with the lowest score is
+// disconnected to make room for one we haven't tried yet.
+type ConnManager struct {
+	MaxConns    int
+	MaxHalfOpen int
+	// Limit caps the connections of this and other managers together, only MaxConns applies when it
+	// is nil
+	Limit *ConnLimit
+	// Logger is handed to the clients, the default logger is used when it is nil
+	Logger *slog.Logger
+	// Bans and Blocklist are the peers that are never dialed and are turned away when they connect to us
+	Bans      *BanList
+	Blocklist *ipfilter.Filter
+	// Dialer makes the connections to peers, they are made directly when it is nil
+	Dialer proxy.Dialer
+
+	peerID  string
+	torrent *types.Torrent
+	// dial connects to a peer, it is replaced in tests
+	dial func(ctx context.Context, p *types.Peer) (*Client, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	peers       map[string]*candidate
+	halfOpen    int
+	lastReplace time.Time
+	// changed is closed and replaced when a client becomes available
+	changed chan struct{}
+	// wake tells the manager to dial right away instead of on its next round
+	wake chan struct{}
+}
+
+func NewConnManager(peerID string, torrent *types.Torrent, logger *slog.Logger) *ConnManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &ConnManager{
+		MaxConns:    DefaultMaxConns,
+		MaxHalfOpen: DefaultMaxHalfOpen,
+		Logger:      logger,
+		peerID:      peerID,
+		torrent:     torrent,
+		ctx:         ctx,
+		cancel:      cancel,
+		peers:       map[string]*candidate{},
+		lastReplace: time.Now(),
+		changed:     make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+	}
+	m.dial = func(ctx context.Context, p *types.Peer) (*Client, error) {
+		return DialClient(ctx, m.Dialer, m.peerID, p, m.torrent, m.log())
+	}
+	return m
+}
+
+// Start starts dialing peers in the background until Close is called. Set MaxConns and MaxHalfOpen
+// before calling it.
+func (m *ConnManager) Start() {
+	go m.run()
+}
+
+func (m *ConnManager) log() *slog.Logger {
+	return bt.Logger(m.Logger)
+}
+
+// Add adds peers to dial. Peers we know of already are left as they are.
+func (m *ConnManager) Add(source Source, peers ...*types.Peer) {
+	m.mu.Lock()
+	for _, p := range peers {
+		if m.blocked(p.IP) {
+			continue
+		}
+		key := p.String()
+		if _, ok := m.peers[key]; !ok {
+			m.peers[key] = &candidate{peer: p, source: source}
+		}
+	}
+	m.mu.Unlock()
+	m.poke()
+}
+
+// AddClient adds a peer that is connected already. It is disconnected when we are connected to the peer
+// already or to MaxConns peers.
+func (m *ConnManager) AddClient(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil || m.connections() >= m.MaxConns || m.blocked(c.Peer.IP) {
+		c.Close()
+		return
+	}
+	key := c.Peer.String()
+	cand, ok := m.peers[key]
+	if (ok && cand.client != nil) || !m.Limit.take() {
+		c.Close()
+		return
+	}
+	if !ok {
+		cand = &candidate{peer: c.Peer, source: SourceInbound}
+		m.peers[key] = cand
+	}
+	m.connected(cand, c)
+}
+
+// Get waits for a connected peer that isn't in use. It returns ErrNoPeers right away when there are no
+// peers to connect to.
+func (m *ConnManager) Get(ctx context.Context) (*Client, func(), error) {
+	noop := func() {}
+	for {
+		m.mu.Lock()
+		if m.ctx.Err() != nil {
+			m.mu.Unlock()
+			return nil, noop, ErrPoolClosed
+		}
+		if len(m.peers) == 0 {
+			m.mu.Unlock()
+			return nil, noop, ErrNoPeers
+		}
+		now := time.Now()
+		var best *candidate
+		for _, cand := range m.peers {
+			if cand.client == nil || cand.busy {
+				continue
+			}
+			if !cand.client.Channel.IsValid() {
+				m.disconnect(cand, true)
+				continue
+			}
+			if best == nil || cand.score(now) > best.score(now) {
+				best = cand
+			}
+		}
+		if best != nil {
+			best.busy = true
+			client := best.client
+			m.mu.Unlock()
+			return client, func() { m.release(client) }, nil
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		m.poke()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, noop, ctx.Err()
+		}
+	}
 }
 
-func NewPool(peerID string, peers *types.PeerSpec, torrent *types.Torrent) (Pool, error) {
-	peerQueue := types.NewSyncQueue[*types.Peer]()
-	peerQueue.AddAll(peers.Peers...)
+// release hands back a client that Get returned. Clients that broke in the meantime are disconnected.
+func (m *ConnManager) release(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cand, ok := m.peers[c.Peer.String()]
+	if !ok || cand.client != c {
+		// the peer was replaced while it was in use
+		return
+	}
+	cand.busy = false
+	if !c.Channel.IsValid() {
+		c.Logger.Debug("connection failed - disconnecting")
+		m.disconnect(cand, true)
+		return
+	}
+	m.notify()
+}
 
-	var ctor puddle.Constructor = func(ctx context.Context) (any, error) {
-		peer, ok := peerQueue.Pop()
-		if !ok {
-			return nil, fmt.Errorf("not peers left to construct")
+// Clients returns the peers that are connected
+func (m *ConnManager) Clients() []*Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clients := []*Client{}
+	for _, cand := range m.peers {
+		if cand.client != nil {
+			clients = append(clients, cand.client)
 		}
+	}
+	return clients
+}
+
+// Done is closed once Close is called
+func (m *ConnManager) Done() <-chan struct{} {
+	return m.ctx.Done()
+}
 
-		fmt.Printf("\n\n[%s] constructing peer client\n\n", peer.String())
-		client, err := NewClient(ctx, peerID, peer, torrent)
-		if err != nil {
-			fmt.Printf("failed to create handshaked client(%s): %v(%T)\n", peer.String(), err, err)
-			peerQueue.Add(peer)
-			return nil, err
+// Close disconnects every peer and stops dialing
+func (m *ConnManager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cancel()
+	for _, cand := range m.peers {
+		if cand.client != nil {
+			m.disconnect(cand, false)
 		}
-		return client, err
 	}
+	m.notify()
+}
 
-	var dtor puddle.Destructor = func(res interface{}) {
-		if res == nil {
+func (m *ConnManager) run() {
+	tick := time.NewTicker(manageInterval)
+	defer tick.Stop()
+	for {
+		now := time.Now()
+		m.mu.Lock()
+		if now.Sub(m.lastReplace) >= ReplaceInterval {
+			m.lastReplace = now
+			m.replaceWorst(now)
+		}
+		m.dialMore(now)
+		m.mu.Unlock()
+
+		select {
+		case <-m.ctx.Done():
 			return
+		case <-tick.C:
+		case <-m.wake:
 		}
-		if client, ok := res.(*Client); ok {
-			fmt.Println("destroying - ", client.Peer.String())
-			client.Close()
-			peerQueue.Add(client.Peer)
+	}
+}
+
+// poke makes the manager dial right away
+func (m *ConnManager) poke() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// notify wakes up Get - the caller has to hold the lock
+func (m *ConnManager) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// connections returns the peers that are connected or being dialed - the caller has to hold the lock
+func (m *ConnManager) connections() int {
+	n := m.halfOpen
+	for _, cand := range m.peers {
+		if cand.client != nil {
+			n++
 		}
 	}
+	return n
+}
 
-	return &peerPool{
-		peerID: peerID,
-		peers:  peers,
-		pool:   puddle.NewPool(ctor, dtor, int32(len(peers.Peers))),
-	}, nil
+// blocked reports whether we don't talk to the address because it is banned or on the blocklist
+func (m *ConnManager) blocked(ip net.IP) bool {
+	return m.Bans.Banned(ip) || m.Blocklist.Blocked(ip)
 }
 
-func (p *peerPool) Get(ctx context.Context) (*Client, func(), error) {
-	noop := func() {}
-	res, err := p.pool.Acquire(ctx)
-	if err != nil {
-		return nil, noop, err
+// dialable reports whether the peer can be dialed now - the caller has to hold the lock
+func (m *ConnManager) dialable(cand *candidate, now time.Time) bool {
+	return cand.client == nil && !cand.dialing && !now.Before(cand.nextRetry) && !m.blocked(cand.peer.IP)
+}
+
+// dialMore dials the best peers that aren't connected while there is room - the caller has to hold the
+// lock
+func (m *ConnManager) dialMore(now time.Time) {
+	if m.ctx.Err() != nil {
+		return
+	}
+	for m.halfOpen < m.MaxHalfOpen && m.connections() < m.MaxConns {
+		var best *candidate
+		for _, cand := range m.peers {
+			if !m.dialable(cand, now) {
+				continue
+			}
+			if best == nil || cand.score(now) > best.score(now) {
+				best = cand
+			}
+		}
+		if best == nil || !m.Limit.take() {
+			return
+		}
+		best.dialing = true
+		m.halfOpen++
+		go m.connect(best)
+	}
+}
+
+func (m *ConnManager) connect(cand *candidate) {
+	m.log().Debug("connecting", bt.PeerKey, cand.peer.String())
+	client, err := m.dial(m.ctx, cand.peer)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.halfOpen--
+	cand.dialing = false
+	switch {
+	case err != nil:
+		m.log().Debug("failed to connect", bt.PeerKey, cand.peer.String(), "err", err)
+		m.Limit.put()
+		m.failed(cand, time.Now())
+	case m.ctx.Err() != nil || m.blocked(cand.peer.IP):
+		m.Limit.put()
+		client.Close()
+	default:
+		m.connected(cand, client)
 	}
+	m.poke()
+}
 
-	client, ok := res.Value().(*Client)
-	if !ok {
-		res.Destroy()
-		return nil, noop, fmt.Errorf("expected *peer.Client but got %T", res.Value())
+// connected takes note of a new connection to the peer - the caller has to hold the lock
+func (m *ConnManager) connected(cand *candidate, c *Client) {
+	cand.client = c
+	cand.busy = false
+	cand.since = time.Now()
+	cand.failures = 0
+	m.notify()
+	go m.watch(cand, c)
+}
+
+// watch disconnects the peer as soon as its connection closes, so that a dead connection doesn't count
+// against MaxConns until Get runs into it. Clients that are in use are disconnected when they are
+// released.
+func (m *ConnManager) watch(cand *candidate, c *Client) {
+	select {
+	case <-c.Channel.Done:
+	case <-m.ctx.Done():
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cand.client != c || cand.busy {
+		return
 	}
+	c.Logger.Debug("connection closed - disconnecting")
+	m.disconnect(cand, true)
+	m.poke()
+}
 
-	if !client.Channel.IsValid() {
-		res.Destroy()
-		return nil, noop, fmt.Errorf("[%s] client is invalid - destroying", client.Peer.String())
+// failed backs off from the peer, and forgets it after MaxFailures - the caller has to hold the lock
+func (m *ConnManager) failed(cand *candidate, now time.Time) {
+	cand.failures++
+	if cand.failures >= MaxFailures {
+		delete(m.peers, cand.peer.String())
+		return
 	}
+	cand.nextRetry = now.Add(backoff(cand.failures))
+}
 
-	release := func() {
-		if !client.Channel.IsValid() {
-			fmt.Printf("(pool) client[%s] is invalid - destroying\n", client.Peer.String())
-			res.Destroy()
-		} else {
-			res.Release()
-		}
+// disconnect closes the connection to the peer and hands it back to Limit. Peers whose connection broke
+// count as failed. - the caller has to hold the lock
+func (m *ConnManager) disconnect(cand *candidate, broken bool) {
+	now := time.Now()
+	c := cand.client
+	c.Close()
+	m.Limit.put()
+	cand.downloaded += c.Channel.Traffic().PayloadIn
+	cand.connected += now.Sub(cand.since)
+	cand.client = nil
+	cand.busy = false
+	if broken {
+		m.failed(cand, now)
 	}
+}
 
-	return client, release, nil
+// replaceWorst disconnects the connected peer with the lowest score when all the connections are used
+// and there is a peer we could dial instead. Peers get ReplaceInterval to prove themselves first. - the
+// caller has to hold the lock
+func (m *ConnManager) replaceWorst(now time.Time) {
+	if m.connections() < m.MaxConns {
+		return
+	}
+	waiting := false
+	var worst *candidate
+	for _, cand := range m.peers {
+		if m.dialable(cand, now) {
+			waiting = true
+		}
+		if cand.client == nil || now.Sub(cand.since) < ReplaceInterval {
+			continue
+		}
+		if worst == nil || cand.score(now) < worst.score(now) {
+			worst = cand
+		}
+	}
+	if !waiting || worst == nil {
+		return
+	}
+	m.log().Debug("replacing worst peer", bt.PeerKey, worst.peer.String(), "rate", worst.score(now))
+	m.disconnect(worst, false)
+	// give the others a go before the peer is dialed again
+	worst.nextRetry = now.Add(ReplaceInterval)
 }
@@ -0,0 +1,256 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func newPipeClient(t *testing.T, p *types.Peer) *Client {
+	t.Helper()
+	local, remote := net.Pipe()
+	ch := NewChannel(local, &Handshake{}, &BitField{Field: make([]byte, 1)}, nil)
+	t.Cleanup(func() {
+		ch.Close()
+		remote.Close()
+	})
+	return &Client{Peer: p, Channel: ch, Logger: ch.Logger()}
+}
+
+func testPeers(n int) []*types.Peer {
+	peers := []*types.Peer{}
+	for i := 0; i < n; i++ {
+		peers = append(peers, &types.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 7000 + i})
+	}
+	return peers
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 1, want: ReconnectBackoff},
+		{failures: 2, want: 2 * ReconnectBackoff},
+		{failures: 4, want: 8 * ReconnectBackoff},
+		{failures: 20, want: MaxReconnectBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d): expected %s got %s", tt.failures, tt.want, got)
+		}
+	}
+}
+
+func TestConnManagerLimitsHalfOpenConnections(t *testing.T) {
+	m := NewConnManager("00112233445566778899", &types.Torrent{}, nil)
+	defer m.Close()
+	m.MaxHalfOpen = 2
+	dials := make(chan *types.Peer, 10)
+	m.dial = func(ctx context.Context, p *types.Peer) (*Client, error) {
+		dials <- p
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	m.Add(SourceTracker, testPeers(5)...)
+
+	m.mu.Lock()
+	m.dialMore(time.Now())
+	halfOpen := m.halfOpen
+	m.mu.Unlock()
+	if halfOpen != 2 {
+		t.Fatalf("expected 2 connections to be dialed got %d", halfOpen)
+	}
+	for i := 0; i < 2; i++ {
+		<-dials
+	}
+}
+
+func TestConnManagerSharesLimit(t *testing.T) {
+	limit := NewConnLimit(3)
+	var managers []*ConnManager
+	for i := 0; i < 2; i++ {
+		m := NewConnManager("00112233445566778899", &types.Torrent{}, nil)
+		defer m.Close()
+		m.Limit = limit
+		m.dial = func(ctx context.Context, p *types.Peer) (*Client, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		m.Add(SourceTracker, testPeers(5)...)
+		managers = append(managers, m)
+	}
+
+	halfOpen := 0
+	for _, m := range managers {
+		m.mu.Lock()
+		m.dialMore(time.Now())
+		halfOpen += m.halfOpen
+		m.mu.Unlock()
+	}
+	if halfOpen != 3 || limit.Used() != 3 {
+		t.Fatalf("expected 3 connections to be dialed got %d using %d", halfOpen, limit.Used())
+	}
+
+	// the connections of a closed manager are handed back
+	managers[0].Close()
+	managers[1].Close()
+	deadline := time.Now().Add(time.Second)
+	for limit.Used() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the connections to be handed back got %d in use", limit.Used())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnManagerBacksOffFailedPeers(t *testing.T) {
+	m := NewConnManager("00112233445566778899", &types.Torrent{}, nil)
+	defer m.Close()
+	failed := make(chan struct{})
+	m.dial = func(ctx context.Context, p *types.Peer) (*Client, error) {
+		defer close(failed)
+		return nil, errors.New("connection refused")
+	}
+	peers := testPeers(1)
+	m.Add(SourceTracker, peers...)
+
+	start := time.Now()
+	m.mu.Lock()
+	m.dialMore(start)
+	m.mu.Unlock()
+	<-failed
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		m.mu.Lock()
+		cand, halfOpen := m.peers[peers[0].String()], m.halfOpen
+		m.mu.Unlock()
+		if halfOpen == 0 {
+			if cand.failures != 1 || cand.nextRetry.Before(start.Add(ReconnectBackoff)) {
+				t.Fatalf("expected one failure and a retry after %s got %d and %s", ReconnectBackoff, cand.failures, cand.nextRetry.Sub(start))
+			}
+			if m.dialable(cand, start) {
+				t.Fatalf("peer should not be dialed again before its backoff is over")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnManagerGetAndRelease(t *testing.T) {
+	m := NewConnManager("00112233445566778899", &types.Torrent{}, nil)
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := m.Get(ctx); err != ErrNoPeers {
+		t.Fatalf("expected %v got %v", ErrNoPeers, err)
+	}
+
+	c := newPipeClient(t, testPeers(1)[0])
+	m.AddClient(c)
+	got, release, err := m.Get(ctx)
+	if err != nil || got != c {
+		t.Fatalf("expected the inbound client got %v %v", got, err)
+	}
+	// the client is in use until it is released
+	if _, _, err := m.Get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v got %v", context.DeadlineExceeded, err)
+	}
+	release()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if got, _, err := m.Get(ctx); err != nil || got != c {
+		t.Fatalf("expected the released client got %v %v", got, err)
+	}
+}
+
+func TestConnManagerReplacesWorstPeer(t *testing.T) {
+	m := NewConnManager("00112233445566778899", &types.Torrent{}, nil)
+	defer m.Close()
+	m.MaxConns = 2
+	peers := testPeers(3)
+
+	now := time.Now()
+	rates := []int64{1000, 10}
+	for i, rate := range rates {
+		m.AddClient(newPipeClient(t, peers[i]))
+		cand := m.peers[peers[i].String()]
+		cand.since = now.Add(-ReplaceInterval)
+		cand.downloaded = rate * int64(ReplaceInterval/time.Second)
+	}
+	m.Add(SourceTracker, peers[2])
+
+	m.mu.Lock()
+	m.replaceWorst(now)
+	fast, slow := m.peers[peers[0].String()], m.peers[peers[1].String()]
+	m.mu.Unlock()
+	if fast.client == nil {
+		t.Errorf("expected the fast peer to stay connected")
+	}
+	if slow.client != nil {
+		t.Errorf("expected the slow peer to be replaced")
+	}
+	if m.dialable(slow, now) {
+		t.Errorf("expected the replaced peer to wait before it is dialed again")
+	}
+}
+
+func TestConnManagerSkipsBannedPeers(t *testing.T) {
+	m := NewConnManager("00112233445566778899", &types.Torrent{}, nil)
+	defer m.Close()
+	m.Bans = NewBanList()
+	peers := testPeers(2)
+	m.Bans.Ban(peers[0].IP)
+
+	m.Add(SourceTracker, peers[0])
+	m.mu.Lock()
+	known := len(m.peers)
+	m.mu.Unlock()
+	if known != 0 {
+		t.Fatalf("expected the banned peer not to be added got %d peers", known)
+	}
+
+	c := newPipeClient(t, peers[1])
+	m.AddClient(c)
+	if c.Channel.IsValid() {
+		t.Fatalf("expected the banned peer to be disconnected when it connects")
+	}
+}
+
+func TestConnManagerDropsClosedConnections(t *testing.T) {
+	m := NewConnManager("00112233445566778899", &types.Torrent{}, nil)
+	defer m.Close()
+	m.MaxConns = 1
+	peers := testPeers(2)
+
+	c := newPipeClient(t, peers[0])
+	m.AddClient(c)
+	c.Channel.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for len(m.Clients()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the closed connection to be dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the dead connection no longer takes up the only slot
+	other := newPipeClient(t, peers[1])
+	m.AddClient(other)
+	if !other.Channel.IsValid() {
+		t.Fatalf("expected a new peer to be accepted")
+	}
+}
@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
+)
+
+// MessageCount is how many messages of a type went over a connection and the bytes they took on the wire
+type MessageCount struct {
+	Messages int64
+	Bytes    int64
+}
+
+// Stats is a snapshot of a connection to a peer
+type Stats struct {
+	Peer string
+	// Client is the client the peer runs, decoded from its peer ID. It is empty when the peer ID doesn't
+	// say.
+	Client      string
+	ConnectedAt time.Time
+	Traffic
+	// In and Out count the messages by type, like "PieceBlock" or "Have"
+	In  map[string]MessageCount
+	Out map[string]MessageCount
+	// DownloadRate and UploadRate are the piece data rates in bytes per second over the last
+	// bt.RateWindow seconds
+	DownloadRate float64
+	UploadRate   float64
+	// Latency is the average time the peer takes to answer a request and MinLatency the fastest it ever
+	// did
+	Latency    time.Duration
+	MinLatency time.Duration
+	// Unchoked is how long the peer let us request pieces in total
+	Unchoked time.Duration
+	State    PeerState
+	// PendingRequests are the requests the peer hasn't answered yet and Pieces the pieces it has
+	PendingRequests int
+	Pieces          int
+}
+
+// messageStats counts the messages that go over a connection by type
+type messageStats struct {
+	mu       sync.Mutex
+	in, out  map[string]MessageCount
+	downRate bt.Meter
+	upRate   bt.Meter
+}
+
+func newMessageStats() *messageStats {
+	return &messageStats{in: map[string]MessageCount{}, out: map[string]MessageCount{}}
+}
+
+func (s *messageStats) count(counts map[string]MessageCount, rate *bt.Meter, m Message) {
+	if blk, ok := m.(*PieceBlock); ok {
+		rate.Add(len(blk.Data))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := counts[m.String()]
+	c.Messages++
+	c.Bytes += int64(messageSize(m))
+	counts[m.String()] = c
+}
+
+func (s *messageStats) received(m Message) {
+	s.count(s.in, &s.downRate, m)
+}
+
+func (s *messageStats) sent(m Message) {
+	s.count(s.out, &s.upRate, m)
+}
+
+func (s *messageStats) copy() (in, out map[string]MessageCount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, out = map[string]MessageCount{}, map[string]MessageCount{}
+	for k, v := range s.in {
+		in[k] = v
+	}
+	for k, v := range s.out {
+		out[k] = v
+	}
+	return in, out
+}
+
+// messageSize returns the size of the message on the wire without encoding it, which would copy the data
+// of blocks
+func messageSize(m Message) int {
+	switch msg := m.(type) {
+	case *KeepAlive:
+		return 4
+	case *PieceBlock:
+		return 4 + 1 + 8 + len(msg.Data)
+	}
+	return 4 + 1 + len(m.Payload())
+}
+
+// Stats returns a snapshot of the connection
+func (ch *Channel) Stats() Stats {
+	in, out := ch.stats.copy()
+	s := Stats{
+		Peer:         ch.ConnectedTo,
+		Client:       ClientName(ch.Handshake.PeerID),
+		ConnectedAt:  ch.connectedAt,
+		Traffic:      ch.Traffic(),
+		In:           in,
+		Out:          out,
+		DownloadRate: ch.stats.downRate.Rate(),
+		UploadRate:   ch.stats.upRate.Rate(),
+	}
+
+	ch.Lock()
+	defer ch.Unlock()
+	s.Latency, s.MinLatency = ch.latency, ch.minLatency
+	s.Unchoked = ch.unchoked
+	if !ch.unchokedSince.IsZero() {
+		s.Unchoked += time.Since(ch.unchokedSince)
+	}
+	s.State = ch.peerState
+	s.PendingRequests = len(ch.requests)
+	if ch.BitField != nil {
+		for _, b := range ch.BitField.Field {
+			s.Pieces += bits.OnesCount8(b)
+		}
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package peer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChannelStats(t *testing.T) {
+	ch, remote := newTestChannel(t)
+	ch.Handshake.PeerID = "-TR3000-abcdefghijkl"
+
+	received := make(chan struct{}, 1)
+	ch.RegisterReceiveHook(PieceType, func(Message) error {
+		received <- struct{}{}
+		return nil
+	})
+	remote.send(&Unchoke{})
+	remote.send(&Have{Index: 3})
+	remote.send(&PieceBlock{Index: 0, Begin: 0, Data: make([]byte, 100)})
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("block was never handled")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	s := ch.Stats()
+	if s.Client != "Transmission 3.0" {
+		t.Errorf("expected the client to be decoded from the peer ID got %q", s.Client)
+	}
+	wantIn := map[string]MessageCount{
+		"Unchoke":    {Messages: 1, Bytes: 5},
+		"Have":       {Messages: 1, Bytes: 9},
+		"PieceBlock": {Messages: 1, Bytes: 113},
+	}
+	for name, want := range wantIn {
+		if got := s.In[name]; got != want {
+			t.Errorf("expected %s to be counted as %+v got %+v", name, want, got)
+		}
+	}
+	if s.Unchoked < 20*time.Millisecond {
+		t.Errorf("expected the peer to have us unchoked for at least 20ms got %s", s.Unchoked)
+	}
+	if s.Pieces != 1 {
+		t.Errorf("expected the peer to have 1 piece got %d", s.Pieces)
+	}
+	if s.DownloadRate <= 0 {
+		t.Errorf("expected a download rate got %f", s.DownloadRate)
+	}
+
+	remote.send(&Choke{})
+	deadline := time.Now().Add(time.Second)
+	for !ch.IsChoked() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	unchoked := ch.Stats().Unchoked
+	time.Sleep(20 * time.Millisecond)
+	if got := ch.Stats().Unchoked; got != unchoked {
+		t.Errorf("expected the unchoked time to stop growing after a choke got %s then %s", unchoked, got)
+	}
+}
@@ -0,0 +1,81 @@
+package peer
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/ratelimit"
+)
+
+// Traffic is how many bytes went over a connection. Payload is the data of piece blocks and overhead is
+// everything else: message headers, requests, haves, keep alives and so on.
+type Traffic struct {
+	PayloadIn   int64
+	PayloadOut  int64
+	OverheadIn  int64
+	OverheadOut int64
+}
+
+// counters count the bytes that go over a connection
+type counters struct {
+	in, out               atomic.Int64
+	payloadIn, payloadOut atomic.Int64
+}
+
+func (c *counters) traffic() Traffic {
+	payloadIn, payloadOut := c.payloadIn.Load(), c.payloadOut.Load()
+	return Traffic{
+		PayloadIn:   payloadIn,
+		PayloadOut:  payloadOut,
+		OverheadIn:  c.in.Load() - payloadIn,
+		OverheadOut: c.out.Load() - payloadOut,
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Traffic returns how many bytes went over the connection so far
+func (ch *Channel) Traffic() Traffic {
+	return ch.counters.traffic()
+}
+
+// DownloadLimiter limits the piece data received from the peer. It is unlimited until its rate is set,
+// and its parent can be set to limit the peer together with others.
+func (ch *Channel) DownloadLimiter() *ratelimit.Limiter {
+	return ch.downLimit
+}
+
+// UploadLimiter limits the piece data sent to the peer, see DownloadLimiter
+func (ch *Channel) UploadLimiter() *ratelimit.Limiter {
+	return ch.upLimit
+}
+
+// limit waits until the limiter lets the payload of the message through. Only piece data is limited,
+// so that requests and other small messages never get stuck behind a saturated limit.
+func (ch *Channel) limit(l *ratelimit.Limiter, m Message) error {
+	blk, ok := m.(*PieceBlock)
+	if !ok {
+		return nil
+	}
+	return l.WaitN(ch.ctx, len(blk.Data))
+}
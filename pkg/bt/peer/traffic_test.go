@@ -0,0 +1,44 @@
+package peer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChannelCountsAndLimitsTraffic(t *testing.T) {
+	ch, remote := newTestChannel(t)
+	ch.DownloadLimiter().SetRate(100000)
+
+	received := make(chan time.Time, 1)
+	ch.RegisterReceiveHook(PieceType, func(Message) error {
+		received <- time.Now()
+		return nil
+	})
+
+	start := time.Now()
+	remote.send(&PieceBlock{Index: 0, Begin: 0, Data: make([]byte, 10000)})
+	select {
+	case at := <-received:
+		// the bucket starts out empty, so 10000 bytes at 100000 bytes per second take 100ms
+		if elapsed := at.Sub(start); elapsed < 80*time.Millisecond {
+			t.Errorf("expected the block to be held back by the limit but got it after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("block was never handled")
+	}
+
+	if err := ch.SendInterested(); err != nil {
+		t.Fatal(err)
+	}
+	remote.expect(&Interested{})
+
+	// the write is counted once it returns, which can be right after the peer read it
+	want := Traffic{PayloadIn: 10000, OverheadIn: 13, OverheadOut: 5}
+	deadline := time.Now().Add(time.Second)
+	for ch.Traffic() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := ch.Traffic(); got != want {
+		t.Errorf("expected %+v got %+v", want, got)
+	}
+}
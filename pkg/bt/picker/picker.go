@@ -0,0 +1,337 @@
+package picker
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RandomFirstPieces is the number of pieces picked at random before switching to rarest first. Until we
+// have a few complete pieces we have nothing to trade with, and the rarest pieces tend to be the ones
+// that are slowest to get.
+const RandomFirstPieces = 4
+
+// Priority decides the order in which pieces are picked. Pieces with a higher priority are always picked
+// before pieces with a lower one, no matter how rare they are.
+type Priority int
+
+const (
+	// Skip pieces are never picked
+	Skip Priority = iota
+	Low
+	Normal
+	High
+	// Critical pieces are needed right away, for instance because a stream is waiting on them
+	Critical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Skip:
+		return "Skip"
+	case Low:
+		return "Low"
+	case Normal:
+		return "Normal"
+	case High:
+		return "High"
+	case Critical:
+		return "Critical"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// PieceSet is a set of pieces a peer has, like a bitfield
+type PieceSet interface {
+	Has(idx int) bool
+}
+
+type pieceState int
+
+const (
+	wanted pieceState = iota
+	picked
+	have
+)
+
+// Picker decides which piece to download next from a peer. It keeps count of how many of the connected
+// peers have each piece and hands out the rarest piece the peer has, so that pieces which could disappear
+// from the swarm are fetched first and we end up with pieces other peers want from us.
+type Picker struct {
+	sync.Mutex
+
+	state        []pieceState
+	priority     []Priority
+	availability []int
+	peers        map[string][]bool
+	completed    int
+	// remaining counts the wanted pieces that aren't skipped
+	remaining  int
+	sequential bool
+
+	rand *rand.Rand
+}
+
+func New(numPieces int) *Picker {
+	priority := make([]Priority, numPieces)
+	for i := range priority {
+		priority[i] = Normal
+	}
+	return &Picker{
+		state:        make([]pieceState, numPieces),
+		priority:     priority,
+		availability: make([]int, numPieces),
+		peers:        map[string][]bool{},
+		remaining:    numPieces,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetSequential switches between picking pieces in order and picking the rarest piece first. Priorities
+// still come first in sequential mode.
+func (p *Picker) SetSequential(sequential bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.sequential = sequential
+}
+
+func (p *Picker) counted(idx int) bool {
+	return p.state[idx] == wanted && p.priority[idx] != Skip
+}
+
+// update applies the change to the piece and keeps the count of remaining pieces in step - the caller has
+// to hold the lock
+func (p *Picker) update(idx int, change func()) {
+	before := p.counted(idx)
+	change()
+	if after := p.counted(idx); after != before {
+		if after {
+			p.remaining++
+		} else {
+			p.remaining--
+		}
+	}
+}
+
+// Len returns the number of pieces the picker picks from
+func (p *Picker) Len() int {
+	return len(p.state)
+}
+
+func (p *Picker) valid(idx int) bool {
+	return idx >= 0 && idx < len(p.state)
+}
+
+// AddPeer records the pieces the peer has. Calling it again for a known peer adds the pieces to the ones
+// already recorded, so it's safe to use for a bitfield that arrives after some Have messages.
+func (p *Picker) AddPeer(id string, pieces PieceSet) {
+	p.Lock()
+	defer p.Unlock()
+	has, ok := p.peers[id]
+	if !ok {
+		has = make([]bool, len(p.state))
+		p.peers[id] = has
+	}
+	for i := range has {
+		if !has[i] && pieces.Has(i) {
+			has[i] = true
+			p.availability[i]++
+		}
+	}
+}
+
+// PeerHas records that the peer has the piece
+func (p *Picker) PeerHas(id string, idx int) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.valid(idx) {
+		return
+	}
+	has, ok := p.peers[id]
+	if !ok {
+		has = make([]bool, len(p.state))
+		p.peers[id] = has
+	}
+	if !has[idx] {
+		has[idx] = true
+		p.availability[idx]++
+	}
+}
+
+// RemovePeer forgets the peer and the pieces it had, usually because it disconnected
+func (p *Picker) RemovePeer(id string) {
+	p.Lock()
+	defer p.Unlock()
+	has, ok := p.peers[id]
+	if !ok {
+		return
+	}
+	for i, v := range has {
+		if v {
+			p.availability[i]--
+		}
+	}
+	delete(p.peers, id)
+}
+
+// HasPiece reports whether the peer told us it has the piece
+func (p *Picker) HasPiece(id string, idx int) bool {
+	p.Lock()
+	defer p.Unlock()
+	has, ok := p.peers[id]
+	return ok && p.valid(idx) && has[idx]
+}
+
+// Interesting reports whether the peer has any piece we still need
+func (p *Picker) Interesting(id string) bool {
+	p.Lock()
+	defer p.Unlock()
+	has, ok := p.peers[id]
+	if !ok {
+		return false
+	}
+	for i, v := range has {
+		if v && p.state[i] != have && p.priority[i] != Skip {
+			return true
+		}
+	}
+	return false
+}
+
+// Availability returns the number of peers that have the piece
+func (p *Picker) Availability(idx int) int {
+	p.Lock()
+	defer p.Unlock()
+	if !p.valid(idx) {
+		return 0
+	}
+	return p.availability[idx]
+}
+
+// SetPriority changes the priority of the piece
+func (p *Picker) SetPriority(idx int, priority Priority) {
+	p.Lock()
+	defer p.Unlock()
+	if p.valid(idx) {
+		p.update(idx, func() { p.priority[idx] = priority })
+	}
+}
+
+// Priority returns the priority of the piece
+func (p *Picker) Priority(idx int) Priority {
+	p.Lock()
+	defer p.Unlock()
+	if !p.valid(idx) {
+		return Skip
+	}
+	return p.priority[idx]
+}
+
+// MarkHave records that we have the piece so it is never picked again
+func (p *Picker) MarkHave(idx int) {
+	p.Lock()
+	defer p.Unlock()
+	if p.valid(idx) && p.state[idx] != have {
+		p.update(idx, func() { p.state[idx] = have })
+		p.completed++
+	}
+}
+
+// MarkMissing makes a piece we have wanted again, for instance when not all of its data was kept
+func (p *Picker) MarkMissing(idx int) {
+	p.Lock()
+	defer p.Unlock()
+	if p.valid(idx) && p.state[idx] == have {
+		p.update(idx, func() { p.state[idx] = wanted })
+		p.completed--
+	}
+}
+
+// Unpick makes a picked piece available for picking again, for instance when it failed its hash check
+func (p *Picker) Unpick(idx int) {
+	p.Lock()
+	defer p.Unlock()
+	if p.valid(idx) && p.state[idx] == picked {
+		p.update(idx, func() { p.state[idx] = wanted })
+	}
+}
+
+// Reserve marks a wanted piece as picked without handing it to a peer, for pieces that are already in
+// progress from an earlier download
+func (p *Picker) Reserve(idx int) {
+	p.Lock()
+	defer p.Unlock()
+	if p.valid(idx) && p.state[idx] == wanted {
+		p.update(idx, func() { p.state[idx] = picked })
+	}
+}
+
+// Remaining returns the number of pieces that are wanted but have not been picked yet
+func (p *Picker) Remaining() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.remaining
+}
+
+// Pick picks the next piece to download from the peer and marks it as picked. Only pieces the peer has
+// are considered. Of those the ones with the highest priority win, and within a priority the rarest
+// piece is picked - or a random one while we have fewer than RandomFirstPieces pieces. In sequential
+// mode the first piece of the highest priority is picked instead.
+func (p *Picker) Pick(id string) (int, bool) {
+	return p.PickFrom(id, nil)
+}
+
+// PickFrom is like Pick but only considers the pieces in the set, for instance the ones a peer lets us
+// request while it chokes us. A nil set considers every piece.
+func (p *Picker) PickFrom(id string, from PieceSet) (int, bool) {
+	p.Lock()
+	defer p.Unlock()
+	has, ok := p.peers[id]
+	if !ok {
+		return 0, false
+	}
+
+	randomFirst := p.completed < RandomFirstPieces && !p.sequential
+	best := -1
+	ties := 0
+	for i, s := range p.state {
+		if s != wanted || !has[i] || p.priority[i] == Skip || (from != nil && !from.Has(i)) {
+			continue
+		}
+		if best == -1 || p.better(i, best, randomFirst) {
+			best = i
+			ties = 1
+			continue
+		}
+		if p.sequential {
+			// pieces are visited in order, so the first one of the highest priority stays
+			continue
+		}
+		if p.priority[i] == p.priority[best] && (randomFirst || p.availability[i] == p.availability[best]) {
+			// reservoir sampling so every tied piece is equally likely to be picked, otherwise all
+			// peers would converge on the same piece
+			ties++
+			if p.rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+
+	p.update(best, func() { p.state[best] = picked })
+	return best, true
+}
+
+// better reports whether piece a should be picked over piece b
+func (p *Picker) better(a, b int, randomFirst bool) bool {
+	if p.priority[a] != p.priority[b] {
+		return p.priority[a] > p.priority[b]
+	}
+	if randomFirst || p.sequential {
+		return false
+	}
+	return p.availability[a] < p.availability[b]
+}
@@ -0,0 +1,174 @@
+package picker
+
+import "testing"
+
+type pieces []int
+
+func (p pieces) Has(idx int) bool {
+	for _, v := range p {
+		if v == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// withCompleted marks enough pieces as completed to get past the random first pieces
+func withCompleted(p *Picker, idx ...int) {
+	for _, i := range idx {
+		p.MarkHave(i)
+	}
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	p := New(8)
+	withCompleted(p, 4, 5, 6, 7)
+	p.AddPeer("a", pieces{0, 1, 2})
+	p.AddPeer("b", pieces{0, 1})
+	p.AddPeer("c", pieces{0})
+
+	for _, want := range []int{2, 1, 0} {
+		got, ok := p.Pick("a")
+		if !ok {
+			t.Fatalf("expected piece %d to be picked", want)
+		}
+		if got != want {
+			t.Fatalf("expected rarest piece %d got %d", want, got)
+		}
+	}
+	if _, ok := p.Pick("a"); ok {
+		t.Fatalf("no pieces should be left to pick")
+	}
+}
+
+func TestPickOnlyPiecesThePeerHas(t *testing.T) {
+	p := New(4)
+	p.AddPeer("a", pieces{3})
+
+	if got, ok := p.Pick("a"); !ok || got != 3 {
+		t.Fatalf("expected piece 3 got %d", got)
+	}
+	if _, ok := p.Pick("a"); ok {
+		t.Fatalf("peer has no other pieces")
+	}
+	if _, ok := p.Pick("unknown"); ok {
+		t.Fatalf("nothing should be picked for an unknown peer")
+	}
+}
+
+func TestPickPriorityOverridesRarity(t *testing.T) {
+	p := New(8)
+	withCompleted(p, 4, 5, 6, 7)
+	p.AddPeer("a", pieces{0, 1, 2})
+	p.AddPeer("b", pieces{1, 2})
+	p.SetPriority(2, High)
+	p.SetPriority(0, Skip)
+
+	if got, _ := p.Pick("a"); got != 2 {
+		t.Fatalf("expected high priority piece 2 got %d", got)
+	}
+	if got, _ := p.Pick("a"); got != 1 {
+		t.Fatalf("expected piece 1 got %d", got)
+	}
+	if _, ok := p.Pick("a"); ok {
+		t.Fatalf("skipped piece should not be picked")
+	}
+}
+
+func TestAvailabilityFollowsPeers(t *testing.T) {
+	p := New(2)
+	p.AddPeer("a", pieces{0})
+	p.PeerHas("a", 1)
+	p.PeerHas("a", 1)
+	p.AddPeer("b", pieces{1})
+
+	if n := p.Availability(1); n != 2 {
+		t.Fatalf("expected availability 2 got %d", n)
+	}
+
+	p.RemovePeer("a")
+	if n := p.Availability(0); n != 0 {
+		t.Fatalf("expected availability 0 after disconnect got %d", n)
+	}
+	if n := p.Availability(1); n != 1 {
+		t.Fatalf("expected availability 1 after disconnect got %d", n)
+	}
+}
+
+func TestUnpick(t *testing.T) {
+	p := New(1)
+	p.AddPeer("a", pieces{0})
+
+	if _, ok := p.Pick("a"); !ok {
+		t.Fatalf("expected piece to be picked")
+	}
+	if n := p.Remaining(); n != 0 {
+		t.Fatalf("expected nothing remaining got %d", n)
+	}
+	p.Unpick(0)
+	if got, ok := p.Pick("a"); !ok || got != 0 {
+		t.Fatalf("expected unpicked piece to be picked again")
+	}
+}
+
+func TestInteresting(t *testing.T) {
+	p := New(2)
+	p.AddPeer("a", pieces{0})
+	p.AddPeer("b", pieces{})
+
+	if !p.Interesting("a") {
+		t.Fatalf("peer has a piece we want")
+	}
+	if p.Interesting("b") {
+		t.Fatalf("peer has no pieces")
+	}
+
+	p.MarkHave(0)
+	if p.Interesting("a") {
+		t.Fatalf("peer only has a piece we already have")
+	}
+}
+
+func TestPickFrom(t *testing.T) {
+	p := New(4)
+	p.AddPeer("a", pieces{0, 1, 2, 3})
+
+	if got, ok := p.PickFrom("a", pieces{2}); !ok || got != 2 {
+		t.Fatalf("expected piece 2 got %d", got)
+	}
+	if _, ok := p.PickFrom("a", pieces{2}); ok {
+		t.Fatalf("only pieces in the set should be picked")
+	}
+}
+
+func TestPickSequential(t *testing.T) {
+	p := New(6)
+	p.AddPeer("a", pieces{0, 1, 2, 3, 4, 5})
+	p.AddPeer("b", pieces{5})
+	p.SetSequential(true)
+	p.SetPriority(4, Critical)
+
+	for _, want := range []int{4, 0, 1, 2, 3, 5} {
+		if got, ok := p.Pick("a"); !ok || got != want {
+			t.Fatalf("expected piece %d got %d", want, got)
+		}
+	}
+}
+
+func TestRemainingFollowsPriorities(t *testing.T) {
+	p := New(3)
+	p.SetPriority(0, Skip)
+	if n := p.Remaining(); n != 2 {
+		t.Fatalf("expected 2 remaining got %d", n)
+	}
+	p.MarkHave(1)
+	p.SetPriority(0, Critical)
+	if n := p.Remaining(); n != 2 {
+		t.Fatalf("expected 2 remaining got %d", n)
+	}
+	p.SetPriority(1, Skip)
+	p.Reserve(2)
+	if n := p.Remaining(); n != 1 {
+		t.Fatalf("expected 1 remaining got %d", n)
+	}
+}
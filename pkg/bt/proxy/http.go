@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// HTTPConnect dials through an HTTP proxy with the CONNECT method, with basic authentication when
+// Username is set
+type HTTPConnect struct {
+	Addr     string
+	Username string
+	Password string
+	// Forward dials the proxy, directly when it is nil
+	Forward Dialer
+}
+
+// DialContext connects to address through the proxy. Only TCP is supported.
+func (h *HTTPConnect) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedNetwork, network)
+	}
+	conn, err := Direct(h.Forward).DialContext(ctx, "tcp", h.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %w", err)
+	}
+	reset := withDeadline(ctx, conn)
+	defer reset()
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if h.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read proxy response: %w", err)
+	}
+	// a successful CONNECT has no body whatever the headers say, the tunnel starts right after them
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused %s: %s", address, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent data before the tunnel was up")
+	}
+	return conn, nil
+}
@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// socksServer is a SOCKS5 proxy that supports CONNECT and UDP ASSOCIATE, and requires the username and
+// password when username is set. The address type of every request is sent to addrTypes.
+type socksServer struct {
+	username  string
+	password  string
+	ln        net.Listener
+	addrTypes chan byte
+}
+
+func newSOCKSServer(t *testing.T, username, password string) *socksServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{username: username, password: password, ln: ln, addrTypes: make(chan byte, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	io.ReadFull(r, methods)
+
+	if s.username != "" {
+		conn.Write([]byte{socksVersion, socksUserPassAuth})
+		ver := make([]byte, 2)
+		io.ReadFull(r, ver)
+		user := make([]byte, ver[1])
+		io.ReadFull(r, user)
+		n := make([]byte, 1)
+		io.ReadFull(r, n)
+		pass := make([]byte, n[0])
+		io.ReadFull(r, pass)
+		if string(user) != s.username || string(pass) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	} else {
+		conn.Write([]byte{socksVersion, socksNoAuth})
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return
+	}
+	atyp, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	s.addrTypes <- atyp[0]
+	dst, err := readAddr(r)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case socksConnect:
+		target, err := net.Dial("tcp", dst)
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		reply, _ := appendAddr([]byte{socksVersion, 0, 0}, target.LocalAddr().String())
+		conn.Write(reply)
+		go io.Copy(target, r)
+		io.Copy(conn, target)
+	case socksUDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply, _ := appendAddr([]byte{socksVersion, 0, 0}, relay.LocalAddr().String())
+		conn.Write(reply)
+		go s.relay(relay)
+		io.Copy(io.Discard, r)
+	}
+}
+
+// relay forwards the datagrams of the client to where their header says, and wraps the answers
+func (s *socksServer) relay(relay *net.UDPConn) {
+	var client net.Addr
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readAddr(r)
+			if err != nil {
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", dst)
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(buf[n-r.Len():n], addr)
+			continue
+		}
+		packet, _ := appendAddr([]byte{0, 0, 0}, from.String())
+		relay.WriteTo(append(packet, buf[:n]...), client)
+	}
+}
+
+// echoServer echoes a line over TCP
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("expected the echo got %q %v", line, err)
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	target := echoServer(t)
+	srv := newSOCKSServer(t, "user", "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d, err := Parse("socks5://user:secret@"+srv.ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+
+	wrong := &SOCKS5{Addr: srv.ln.Addr().String(), Username: "user", Password: "wrong"}
+	if _, err := wrong.DialContext(ctx, "tcp", target); !errors.Is(err, ErrSOCKSAuth) {
+		t.Fatalf("expected %v got %v", ErrSOCKSAuth, err)
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	srv := newSOCKSServer(t, "", "")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pc, err := (&SOCKS5{Addr: srv.ln.Addr().String()}).ListenPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	pc.SetDeadline(time.Now().Add(time.Second))
+	if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != echo.LocalAddr().String() {
+		t.Fatalf("expected ping from %s got %q from %s", echo.LocalAddr(), buf[:n], from)
+	}
+}
+
+func TestSOCKS5ResolvesHostNames(t *testing.T) {
+	_, port, err := net.SplitHostPort(echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		scheme string
+		want   byte
+	}{
+		{scheme: "socks5", want: socksIPv4},
+		{scheme: "socks5h", want: socksDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			srv := newSOCKSServer(t, "", "")
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			d, err := Parse(tt.scheme+"://"+srv.ln.Addr().String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("localhost", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-srv.addrTypes; got != tt.want {
+				t.Errorf("expected address type %d got %d", tt.want, got)
+			}
+			expectEcho(t, conn)
+		})
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := echoServer(t)
+	auth := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Proxy-Authorization")
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(upstream, rw)
+		io.Copy(conn, upstream)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	d, err := Parse("http://user:secret@"+ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-auth; got != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("expected basic authentication got %q", got)
+	}
+	expectEcho(t, conn)
+}
+
+func TestParseUnsupportedScheme(t *testing.T) {
+	if _, err := Parse("ftp://proxy:21", nil); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("expected %v got %v", ErrUnsupportedScheme, err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	target := echoServer(t)
+	d, err := Local("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected the connection to come from 127.0.0.1 got %s", ip)
+	}
+	expectEcho(t, conn)
+
+	if _, err := Local("no-such-interface0"); err == nil {
+		t.Fatalf("expected an error for an unknown interface")
+	}
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksUserPassAuth = 2
+
+	socksConnect      = 1
+	socksUDPAssociate = 3
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+)
+
+var ErrSOCKSAuth = fmt.Errorf("socks5 authentication failed")
+
+// SOCKS5 dials through a SOCKS5 proxy (RFC 1928), with username and password authentication (RFC 1929)
+// when Username is set. Host names are resolved locally unless RemoteDNS is set.
+type SOCKS5 struct {
+	Addr     string
+	Username string
+	Password string
+	// RemoteDNS sends host names to the proxy to resolve, like socks5h URLs do
+	RemoteDNS bool
+	// Forward dials the proxy, directly when it is nil
+	Forward Dialer
+}
+
+// DialContext connects to address through the proxy. Only TCP is supported, use ListenPacket for UDP.
+func (s *SOCKS5) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedNetwork, network)
+	}
+	if !s.RemoteDNS {
+		resolved, err := resolve(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		address = resolved
+	}
+	conn, _, err := s.request(ctx, socksConnect, address)
+	return conn, err
+}
+
+// resolve replaces the host name of address with its IP address, an IPv4 one when there is one
+func resolve(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses for %q", host)
+	}
+	ip := addrs[0].IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ip = addr.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// ListenPacket sets up a UDP relay with UDP ASSOCIATE, for UDP trackers and the DHT. Every datagram
+// written to the returned connection goes through the relay, which stays up until the connection is
+// closed.
+func (s *SOCKS5) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	ctrl, bound, err := s.request(ctx, socksUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to resolve proxy address %q: %w", bound, err)
+	}
+	// a relay on the unspecified address is on the proxy host
+	if relay.IP.IsUnspecified() {
+		if host, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = host.IP
+		}
+	}
+	// the datagrams leave from the address the proxy is dialed from
+	var local *net.UDPAddr
+	if d, ok := s.Forward.(*net.Dialer); ok {
+		if tcp, ok := d.LocalAddr.(*net.TCPAddr); ok {
+			local = &net.UDPAddr{IP: tcp.IP}
+		}
+	}
+	udp, err := net.ListenUDP("udp", local)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	pc := &socksPacketConn{UDPConn: udp, ctrl: ctrl, relay: relay}
+	// the relay goes away when the control connection closes, and so does our side
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		pc.Close()
+	}()
+	return pc, nil
+}
+
+// request connects to the proxy, authenticates and sends a request. It returns the control connection
+// and the address the proxy bound for the request.
+func (s *SOCKS5) request(ctx context.Context, cmd byte, address string) (net.Conn, string, error) {
+	conn, err := Direct(s.Forward).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to proxy: %w", err)
+	}
+	reset := withDeadline(ctx, conn)
+	defer reset()
+
+	r := bufio.NewReader(conn)
+	if err := s.authenticate(conn, r); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	req := []byte{socksVersion, cmd, 0}
+	addr, err := appendAddr(req, address)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	if _, err := conn.Write(addr); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(r, head); err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to read proxy reply: %w", err)
+	}
+	if head[0] != socksVersion {
+		conn.Close()
+		return nil, "", fmt.Errorf("unexpected socks version %d", head[0])
+	}
+	if head[1] != 0 {
+		conn.Close()
+		return nil, "", fmt.Errorf("proxy refused %s: %s", address, socksReply(head[1]))
+	}
+	bound, err := readAddr(r)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	if r.Buffered() > 0 {
+		conn.Close()
+		return nil, "", fmt.Errorf("proxy sent data before the reply was complete")
+	}
+	return conn, bound, nil
+}
+
+func (s *SOCKS5) authenticate(conn net.Conn, r *bufio.Reader) error {
+	methods := []byte{socksNoAuth}
+	if s.Username != "" {
+		methods = []byte{socksUserPassAuth}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		return fmt.Errorf("failed to read proxy greeting: %w", err)
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksNoAuth:
+		return nil
+	case socksUserPassAuth:
+		if len(s.Username) > 255 || len(s.Password) > 255 {
+			return fmt.Errorf("%w: username or password too long", ErrSOCKSAuth)
+		}
+		auth := []byte{1, byte(len(s.Username))}
+		auth = append(auth, s.Username...)
+		auth = append(auth, byte(len(s.Password)))
+		auth = append(auth, s.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, reply); err != nil {
+			return fmt.Errorf("failed to read proxy authentication: %w", err)
+		}
+		if reply[1] != 0 {
+			return ErrSOCKSAuth
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: no acceptable method", ErrSOCKSAuth)
+}
+
+// appendAddr appends the SOCKS5 encoding of host:port to b
+func appendAddr(b []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socksIPv4), ip4...)
+		} else {
+			b = append(append(b, socksIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %q", host)
+		}
+		b = append(append(b, socksDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readAddr reads a SOCKS5 address and returns it as host:port. Host names are left as they are.
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown socks address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socksReply(code byte) string {
+	switch code {
+	case 1:
+		return "general failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("error %d", code)
+}
+
+// socksPacketConn sends datagrams through a SOCKS5 UDP relay. Every datagram carries a header with the
+// address it is for, or came from.
+type socksPacketConn struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	once sync.Once
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// RSV and FRAG, we never fragment
+	packet, err := appendAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.WriteTo(append(packet, b...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, from, err := c.UDPConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// datagrams that don't come from the relay or are fragmented are dropped
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(c.relay.IP) || udp.Port != c.relay.Port {
+			continue
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		// relays may name the sender by its host name
+		dst, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", dst)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.UDPConn.Close()
+	})
+	return err
+}
@@ -0,0 +1,109 @@
+// Package ratelimit limits the throughput of connections with token buckets. Limiters can have a parent,
+// so that a limit for a single peer sits below a limit for the torrent which sits below a global one, and
+// traffic has to get past all of them.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Unlimited is the rate of limiters that don't limit anything
+const Unlimited = 0
+
+// Limiter is a token bucket that lets rate bytes per second through, with bursts of up to a second worth
+// of bytes. Transfers bigger than the bucket still get through, they just leave the bucket in debt
+// for as long as they would have taken.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+	parent *Limiter
+}
+
+// NewLimiter returns a limiter for rate bytes per second below parent, which may be nil
+func NewLimiter(rate int, parent *Limiter) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now(), parent: parent}
+}
+
+// Rate returns the bytes per second the limiter lets through, Unlimited if it doesn't limit
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate of the limiter. Transfers that are already waiting keep their delay.
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// SetParent moves the limiter below parent, which may be nil
+func (l *Limiter) SetParent(parent *Limiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.parent = parent
+}
+
+func (l *Limiter) getParent() *Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.parent
+}
+
+// refill adds the tokens for the time since the last refill - the caller has to hold the lock
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > Unlimited {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before they may be used
+func (l *Limiter) reserve(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	if l.rate <= Unlimited {
+		return 0
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// WaitN waits until n bytes may pass the limiter and all of its parents. A nil limiter doesn't limit.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	now := time.Now()
+	var wait time.Duration
+	for lim := l; lim != nil; lim = lim.getParent() {
+		if d := lim.reserve(now, n); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		rate  int
+		takes []int
+		want  time.Duration
+	}{
+		{name: "unlimited", rate: Unlimited, takes: []int{1 << 30}, want: 0},
+		{name: "within burst", rate: 1000, takes: []int{600, 400}, want: 0},
+		{name: "over burst", rate: 1000, takes: []int{1000, 500}, want: 500 * time.Millisecond},
+		{name: "bigger than bucket", rate: 1000, takes: []int{3000}, want: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(tt.rate, nil)
+			l.last = now
+			var got time.Duration
+			for _, n := range tt.takes {
+				got = l.reserve(now, n)
+			}
+			if got != tt.want {
+				t.Errorf("expected to wait %s got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLimiterRefillAndSetRate(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1000, nil)
+	l.last = now
+	l.reserve(now, 1000)
+
+	// half a second refills half the bucket
+	if d := l.reserve(now.Add(500*time.Millisecond), 500); d != 0 {
+		t.Errorf("expected refilled tokens to be used got wait %s", d)
+	}
+
+	l.SetRate(Unlimited)
+	if d := l.reserve(time.Now(), 1<<20); d != 0 {
+		t.Errorf("expected unlimited limiter not to wait got %s", d)
+	}
+	if l.Rate() != Unlimited {
+		t.Errorf("expected unlimited rate got %d", l.Rate())
+	}
+}
+
+func TestLimiterWaitsForParent(t *testing.T) {
+	global := NewLimiter(1000, nil)
+	peer := NewLimiter(Unlimited, global)
+
+	// the first second worth of bytes is in the bucket already
+	if err := peer.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := peer.WaitN(ctx, 1000); err != context.DeadlineExceeded {
+		t.Fatalf("expected the parent to hold up the transfer got %v", err)
+	}
+
+	var none *Limiter
+	if err := none.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatalf("expected a nil limiter not to limit got %v", err)
+	}
+}
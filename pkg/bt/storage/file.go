@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// File stores each file of the torrent as a file on disk. Files are only created once data is written to
+// them, and files that are only read are opened read-only, so data we can't write can still be read.
+// The lock only guards opening files, reads and writes go to the files concurrently.
+type File struct {
+	sync.Mutex
+
+	torrent *types.Torrent
+	spans   []types.FileSpan
+	paths   []string
+	// files are opened for writing, readers for reading until the file is written to
+	files   []*os.File
+	readers []*os.File
+	dirty   []bool
+	closed  bool
+}
+
+// OpenFiles opens the storage for a download of the torrent to dst, see FilePath. It implements Opener.
+func OpenFiles(torrent *types.Torrent, dst string) (Storage, error) {
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(spans))
+	for i, span := range spans {
+		if paths[i], err = FilePath(torrent, dst, span); err != nil {
+			return nil, err
+		}
+	}
+	return &File{
+		torrent: torrent,
+		spans:   spans,
+		paths:   paths,
+		files:   make([]*os.File, len(spans)),
+		readers: make([]*os.File, len(spans)),
+		dirty:   make([]bool, len(spans)),
+	}, nil
+}
+
+// file returns the open file of the span. Files that are written to are opened read-write and created
+// when they don't exist, others are opened read-only and nil is returned for them when they don't exist.
+// Files that were opened read-only stay open for the reads that use them. - the caller has to hold the
+// lock
+func (f *File) file(i int, write bool) (*os.File, error) {
+	if f.closed {
+		return nil, ErrClosed
+	}
+	if f.files[i] != nil {
+		return f.files[i], nil
+	}
+	path := f.paths[i]
+
+	if !write {
+		if f.readers[i] != nil {
+			return f.readers[i], nil
+		}
+		fd, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		f.readers[i] = fd
+		return fd, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// the file gets its final size right away, which also drops whatever was beyond it
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if info.Size() != f.spans[i].Length {
+		if err := fd.Truncate(f.spans[i].Length); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+	f.files[i] = fd
+	return fd, nil
+}
+
+func (f *File) ReadBlock(p []byte, piece, begin int) (int, error) {
+	off, err := offset(f.torrent, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = eachSpan(f.spans, off, len(p), func(i int, pos int64, from, to int) error {
+		f.Lock()
+		fd, err := f.file(i, false)
+		f.Unlock()
+		if err != nil {
+			return err
+		}
+		if fd == nil {
+			return io.ErrUnexpectedEOF
+		}
+		read, err := fd.ReadAt(p[from:to], pos)
+		n += read
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	return n, err
+}
+
+func (f *File) WriteBlock(p []byte, piece, begin int) (int, error) {
+	off, err := offset(f.torrent, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = eachSpan(f.spans, off, len(p), func(i int, pos int64, from, to int) error {
+		f.Lock()
+		fd, err := f.file(i, true)
+		if err == nil {
+			f.dirty[i] = true
+		}
+		f.Unlock()
+		if err != nil {
+			return err
+		}
+		written, err := fd.WriteAt(p[from:to], pos)
+		n += written
+		return err
+	})
+	return n, err
+}
+
+// MarkComplete implements Storage. Pieces are written in place, so there is nothing left to do.
+func (f *File) MarkComplete(piece int) error {
+	return nil
+}
+
+// Flush syncs the files that were written to since the last flush
+func (f *File) Flush() error {
+	f.Lock()
+	defer f.Unlock()
+	for i, fd := range f.files {
+		if fd == nil || !f.dirty[i] {
+			continue
+		}
+		if err := fd.Sync(); err != nil {
+			return err
+		}
+		f.dirty[i] = false
+	}
+	return nil
+}
+
+func (f *File) Close() error {
+	err := f.Flush()
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	for _, files := range [][]*os.File{f.files, f.readers} {
+		for i, fd := range files {
+			if fd != nil {
+				fd.Close()
+				files[i] = nil
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"io"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// Memory keeps the data of the torrent in memory, which is mostly useful for tests
+type Memory struct {
+	sync.Mutex
+
+	torrent  *types.Torrent
+	pieces   map[int][]byte
+	written  map[int][]bool
+	complete map[int]bool
+	closed   bool
+}
+
+func NewMemory(torrent *types.Torrent) *Memory {
+	return &Memory{
+		torrent:  torrent,
+		pieces:   map[int][]byte{},
+		written:  map[int][]bool{},
+		complete: map[int]bool{},
+	}
+}
+
+// OpenMemory implements Opener, dst is ignored
+func OpenMemory(torrent *types.Torrent, _ string) (Storage, error) {
+	return NewMemory(torrent), nil
+}
+
+func (m *Memory) ReadBlock(p []byte, piece, begin int) (int, error) {
+	if _, err := offset(m.torrent, piece, begin, len(p)); err != nil {
+		return 0, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	written := m.written[piece]
+	for i := begin; i < begin+len(p); i++ {
+		if written == nil || !written[i] {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	return copy(p, m.pieces[piece][begin:]), nil
+}
+
+func (m *Memory) WriteBlock(p []byte, piece, begin int) (int, error) {
+	if _, err := offset(m.torrent, piece, begin, len(p)); err != nil {
+		return 0, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	data, ok := m.pieces[piece]
+	if !ok {
+		length := m.torrent.BlockPlan(piece, m.torrent.PieceLength).PieceLength
+		data = make([]byte, length)
+		m.pieces[piece] = data
+		m.written[piece] = make([]bool, length)
+	}
+	for i := begin; i < begin+len(p); i++ {
+		m.written[piece][i] = true
+	}
+	return copy(data[begin:], p), nil
+}
+
+func (m *Memory) MarkComplete(piece int) error {
+	m.Lock()
+	defer m.Unlock()
+	m.complete[piece] = true
+	return nil
+}
+
+// Completed reports whether MarkComplete was called for the piece
+func (m *Memory) Completed(piece int) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.complete[piece]
+}
+
+func (m *Memory) Flush() error {
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	m.closed = true
+	return nil
+}
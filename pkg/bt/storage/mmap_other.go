@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+var ErrMmapUnsupported = fmt.Errorf("mmap storage is not supported on this platform")
+
+// OpenMmap implements Opener but always fails on this platform, use OpenFiles instead
+func OpenMmap(torrent *types.Torrent, dst string) (Storage, error) {
+	return nil, ErrMmapUnsupported
+}
@@ -0,0 +1,208 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// Mmap stores each file of the torrent as a file on disk like File, but maps the files into memory so
+// blocks are copied straight into the page cache. Like File it only creates files once data is written
+// to them. The lock guards mapping files, reads and writes copy to the mappings concurrently.
+type Mmap struct {
+	sync.RWMutex
+
+	torrent *types.Torrent
+	spans   []types.FileSpan
+	paths   []string
+	files   []*os.File
+	maps    [][]byte
+	closed  bool
+}
+
+// OpenMmap opens the storage for a download of the torrent to dst, see FilePath. It implements Opener.
+func OpenMmap(torrent *types.Torrent, dst string) (Storage, error) {
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(spans))
+	for i, span := range spans {
+		if paths[i], err = FilePath(torrent, dst, span); err != nil {
+			return nil, err
+		}
+	}
+	return &Mmap{
+		torrent: torrent,
+		spans:   spans,
+		paths:   paths,
+		files:   make([]*os.File, len(spans)),
+		maps:    make([][]byte, len(spans)),
+	}, nil
+}
+
+// mapFile maps the file of the span unless it is mapped already. Files that don't exist are only
+// created when create is set, and files that are shorter than the span are only mapped once they are
+// written to and get their final size, since touching a mapping past the end of its file faults. Spans
+// that aren't mapped afterwards have no data to read - the caller has to hold the lock
+func (m *Mmap) mapFile(i int, create bool) error {
+	if m.maps[i] != nil {
+		return nil
+	}
+	path := m.paths[i]
+	if m.files[i] == nil {
+		flags := os.O_RDWR
+		if create {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			flags |= os.O_CREATE
+		}
+		fd, err := os.OpenFile(path, flags, 0644)
+		if !create && errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m.files[i] = fd
+	}
+
+	fd := m.files[i]
+	length := m.spans[i].Length
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < length && !create {
+		return nil
+	}
+	// like File, a file that is written to gets its final size, which also drops whatever was beyond it
+	if create && info.Size() != length {
+		if err := fd.Truncate(length); err != nil {
+			return err
+		}
+	}
+	data, err := syscall.Mmap(int(fd.Fd()), 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.maps[i] = data
+	return nil
+}
+
+// mapSpans maps the files the n bytes at off touch, see mapFile
+func (m *Mmap) mapSpans(off int64, n int, create bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	return eachSpan(m.spans, off, n, func(i int, _ int64, _, _ int) error {
+		return m.mapFile(i, create)
+	})
+}
+
+// ReadBlock implements Storage. Data in files that exist but was never written reads as zeros.
+func (m *Mmap) ReadBlock(p []byte, piece, begin int) (int, error) {
+	off, err := offset(m.torrent, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	if err := m.mapSpans(off, len(p), false); err != nil {
+		return 0, err
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	n := 0
+	err = eachSpan(m.spans, off, len(p), func(i int, pos int64, from, to int) error {
+		if m.maps[i] == nil {
+			return io.ErrUnexpectedEOF
+		}
+		n += copy(p[from:to], m.maps[i][pos:])
+		return nil
+	})
+	return n, err
+}
+
+func (m *Mmap) WriteBlock(p []byte, piece, begin int) (int, error) {
+	off, err := offset(m.torrent, piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	if err := m.mapSpans(off, len(p), true); err != nil {
+		return 0, err
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	n := 0
+	err = eachSpan(m.spans, off, len(p), func(i int, pos int64, from, to int) error {
+		n += copy(m.maps[i][pos:], p[from:to])
+		return nil
+	})
+	return n, err
+}
+
+// MarkComplete implements Storage. Pieces are written in place, so there is nothing left to do.
+func (m *Mmap) MarkComplete(piece int) error {
+	return nil
+}
+
+// Flush syncs the files, which writes back the pages of the mappings that were changed
+func (m *Mmap) Flush() error {
+	m.RLock()
+	defer m.RUnlock()
+	for _, fd := range m.files {
+		if fd == nil {
+			continue
+		}
+		if err := fd.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Mmap) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	var firstErr error
+	for i, data := range m.maps {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		m.maps[i] = nil
+	}
+	for i, fd := range m.files {
+		if fd == nil {
+			continue
+		}
+		if err := fd.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		fd.Close()
+		m.files[i] = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,85 @@
+// Package storage stores the data of a torrent. Peers send us blocks of pieces, so data is read and
+// written by piece and offset in the piece, and backends map that to wherever they keep the data.
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+var ErrOutOfBounds = fmt.Errorf("block is outside of the piece")
+var ErrClosed = fmt.Errorf("storage is closed")
+
+// Storage holds the data of a single torrent. Implementations have to be safe for concurrent use.
+type Storage interface {
+	// ReadBlock reads len(p) bytes of the piece starting at begin. Reading data that was never written
+	// fails with io.ErrUnexpectedEOF, unless the backend can't tell, in which case it reads as zeros.
+	ReadBlock(p []byte, piece, begin int) (int, error)
+	// WriteBlock writes p to the piece starting at begin
+	WriteBlock(p []byte, piece, begin int) (int, error)
+	// MarkComplete is called once all the data of the piece is written and verified
+	MarkComplete(piece int) error
+	// Flush makes sure everything written so far survives a crash
+	Flush() error
+	// Close flushes and releases the storage. Reads and writes after it fail with ErrClosed.
+	Close() error
+}
+
+// Opener opens the storage for a download of the torrent to dst
+type Opener func(torrent *types.Torrent, dst string) (Storage, error)
+
+// FilePath returns where the file of the torrent is kept for a download to dst. For single file
+// torrents dst is the file, for torrents with several files it is the directory that holds them. Paths
+// that would end up outside of dst are rejected with types.ErrInvalidPath.
+func FilePath(torrent *types.Torrent, dst string, span types.FileSpan) (string, error) {
+	if len(torrent.Files) == 0 {
+		return dst, nil
+	}
+	path := filepath.Join(dst, span.Path)
+	rel, err := filepath.Rel(dst, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("%w: %q is outside of %s", types.ErrInvalidPath, span.Path, dst)
+	}
+	return path, nil
+}
+
+// offset returns where the block starts in the data of the torrent
+func offset(torrent *types.Torrent, piece, begin, n int) (int64, error) {
+	if piece < 0 || piece >= torrent.GetPieceCount() || begin < 0 {
+		return 0, ErrOutOfBounds
+	}
+	if begin+n > torrent.BlockPlan(piece, torrent.PieceLength).PieceLength {
+		return 0, ErrOutOfBounds
+	}
+	return int64(piece)*int64(torrent.PieceLength) + int64(begin), nil
+}
+
+// eachSpan calls fn for every file the n bytes at off touch, with the position in the file and the range
+// of the n bytes that fall in it
+func eachSpan(spans []types.FileSpan, off int64, n int, fn func(i int, pos int64, from, to int) error) error {
+	done := 0
+	for i, span := range spans {
+		if done == n {
+			break
+		}
+		pos := off + int64(done)
+		if span.Length == 0 || pos < span.Offset || pos >= span.Offset+span.Length {
+			continue
+		}
+		count := n - done
+		if left := span.Offset + span.Length - pos; int64(count) > left {
+			count = int(left)
+		}
+		if err := fn(i, pos-span.Offset, done, done+count); err != nil {
+			return err
+		}
+		done += count
+	}
+	if done < n {
+		return ErrOutOfBounds
+	}
+	return nil
+}
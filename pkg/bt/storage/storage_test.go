@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// testTorrent has the files a (6 bytes), empty (0 bytes) and b (10 bytes) in pieces of 4 bytes
+func testTorrent() *types.Torrent {
+	hashes := make([]string, 4)
+	for i := range hashes {
+		hashes[i] = string(make([]byte, 20))
+	}
+	return &types.Torrent{
+		Name:        "test",
+		PieceLength: 4,
+		PieceHashes: hashes,
+		Length:      16,
+		Files: []*types.FileInfo{
+			{Length: 6, Paths: []string{"a"}},
+			{Length: 0, Paths: []string{"empty"}},
+			{Length: 10, Paths: []string{"sub", "b"}},
+		},
+	}
+}
+
+func TestStorage(t *testing.T) {
+	tt := []struct {
+		name string
+		open Opener
+		// sparse backends can't tell data that was never written from zeros
+		sparse bool
+	}{
+		{"file", OpenFiles, true},
+		{"memory", OpenMemory, false},
+		{"mmap", OpenMmap, true},
+	}
+
+	data := []byte("aaaaaabbbbbbbbbb")
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := t.TempDir()
+			s, err := tc.open(testTorrent(), dst)
+			if err != nil {
+				t.Fatalf("failed to open storage: %v", err)
+			}
+
+			// piece 1 spans the files a and b
+			if n, err := s.WriteBlock(data[4:6], 1, 0); err != nil || n != 2 {
+				t.Fatalf("failed to write block: %d %v", n, err)
+			}
+			if n, err := s.WriteBlock(data[6:8], 1, 2); err != nil || n != 2 {
+				t.Fatalf("failed to write block: %d %v", n, err)
+			}
+			if err := s.MarkComplete(1); err != nil {
+				t.Fatalf("failed to mark piece complete: %v", err)
+			}
+			buf := make([]byte, 4)
+			if _, err := s.ReadBlock(buf, 1, 0); err != nil || !bytes.Equal(buf, data[4:8]) {
+				t.Fatalf("expected %q got %q: %v", data[4:8], buf, err)
+			}
+
+			if _, err := s.WriteBlock(make([]byte, 3), 3, 2); !errors.Is(err, ErrOutOfBounds) {
+				t.Errorf("expected write past the end of the piece to fail got %v", err)
+			}
+			if _, err := s.ReadBlock(buf, 2, 0); !tc.sparse && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("expected reading unwritten data to fail got %v", err)
+			}
+			if err := s.Flush(); err != nil {
+				t.Errorf("failed to flush: %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("failed to close: %v", err)
+			}
+			if _, err := s.ReadBlock(buf, 1, 0); !errors.Is(err, ErrClosed) {
+				t.Errorf("expected reading after close to fail with %v got %v", ErrClosed, err)
+			}
+			if _, err := s.WriteBlock(buf, 1, 0); !errors.Is(err, ErrClosed) {
+				t.Errorf("expected writing after close to fail with %v got %v", ErrClosed, err)
+			}
+		})
+	}
+}
+
+func TestFileStorageLayout(t *testing.T) {
+	for name, open := range map[string]Opener{"file": OpenFiles, "mmap": OpenMmap} {
+		t.Run(name, func(t *testing.T) {
+			dst := t.TempDir()
+			s, err := open(testTorrent(), dst)
+			if err != nil {
+				t.Fatalf("failed to open storage: %v", err)
+			}
+			if _, err := s.WriteBlock([]byte("bbbb"), 3, 0); err != nil {
+				t.Fatalf("failed to write block: %v", err)
+			}
+			if _, err := s.ReadBlock(make([]byte, 4), 0, 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("expected reading from a missing file to fail got %v", err)
+			}
+			s.Close()
+
+			for _, missing := range []string{"a", "empty"} {
+				if _, err := os.Stat(filepath.Join(dst, missing)); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("files should only be created when written to: %v", err)
+				}
+			}
+			b, err := os.ReadFile(filepath.Join(dst, "sub", "b"))
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+			if want := "\x00\x00\x00\x00\x00\x00bbbb"; string(b) != want {
+				t.Errorf("expected %q got %q", want, b)
+			}
+
+			// the data is still there when the storage is opened again
+			s, err = open(testTorrent(), dst)
+			if err != nil {
+				t.Fatalf("failed to open storage: %v", err)
+			}
+			defer s.Close()
+			buf := make([]byte, 4)
+			if _, err := s.ReadBlock(buf, 3, 0); err != nil || string(buf) != "bbbb" {
+				t.Errorf("expected %q got %q: %v", "bbbb", buf, err)
+			}
+		})
+	}
+}
+
+func TestFileStorageReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write read-only files")
+	}
+	dst := t.TempDir()
+	path := filepath.Join(dst, "a")
+	if err := os.WriteFile(path, []byte("aaaaaa"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenFiles(testTorrent(), dst)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	defer s.Close()
+
+	buf := make([]byte, 4)
+	if _, err := s.ReadBlock(buf, 0, 0); err != nil || string(buf) != "aaaa" {
+		t.Fatalf("expected %q got %q: %v", "aaaa", buf, err)
+	}
+	if _, err := s.WriteBlock(buf, 0, 0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected writing a read-only file to fail got %v", err)
+	}
+}
+
+func TestFilePathOutsideDst(t *testing.T) {
+	dst := t.TempDir()
+	torrent := testTorrent()
+	if _, err := FilePath(torrent, dst, types.FileSpan{Path: filepath.Join("..", "escaped")}); !errors.Is(err, types.ErrInvalidPath) {
+		t.Errorf("expected %v got %v", types.ErrInvalidPath, err)
+	}
+	if p, err := FilePath(torrent, dst, types.FileSpan{Path: filepath.Join("sub", "b")}); err != nil || p != filepath.Join(dst, "sub", "b") {
+		t.Errorf("expected %s got %s %v", filepath.Join(dst, "sub", "b"), p, err)
+	}
+
+	torrent.Files[0].Paths = []string{"..", "escaped"}
+	if _, err := OpenFiles(torrent, dst); !errors.Is(err, types.ErrInvalidPath) {
+		t.Errorf("expected opening the storage to fail with %v got %v", types.ErrInvalidPath, err)
+	}
+}
@@ -0,0 +1,182 @@
+// Package torrentfs exposes the files of a torrent as an io/fs file system. Directory listings come from
+// the metadata of the torrent and the contents of files are read through a TorrentManager, so reads
+// block until the pieces they need are downloaded.
+package torrentfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/manager"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// FS is the file system of a torrent. The files of torrents with several files are at their path in the
+// torrent, and single file torrents have one file named after the torrent.
+type FS struct {
+	ctx   context.Context
+	tm    *manager.TorrentManager
+	files map[string]types.FileSpan
+	dirs  map[string][]fs.DirEntry
+}
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// New returns the file system of the torrent. The contents of files are read from the download tm
+// has been started with. Torrents with file paths that are not valid are rejected with
+// types.ErrInvalidPath.
+func New(tm *manager.TorrentManager, torrent *types.Torrent) (*FS, error) {
+	spans, err := torrent.Layout()
+	if err != nil {
+		return nil, err
+	}
+	f := &FS{
+		ctx:   context.Background(),
+		tm:    tm,
+		files: map[string]types.FileSpan{},
+		dirs:  map[string][]fs.DirEntry{".": nil},
+	}
+	for _, span := range spans {
+		name := filepath.ToSlash(span.Path)
+		f.files[name] = span
+		f.add(name, &fileInfo{name: path.Base(name), size: span.Length})
+	}
+	for _, entries := range f.dirs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return f, nil
+}
+
+// add adds the entry to its directory and the directories above it to theirs
+func (f *FS) add(name string, info *fileInfo) {
+	dir := path.Dir(name)
+	_, exists := f.dirs[dir]
+	f.dirs[dir] = append(f.dirs[dir], fs.FileInfoToDirEntry(info))
+	if !exists {
+		f.add(dir, &fileInfo{name: path.Base(dir), dir: true})
+	}
+}
+
+// WithContext returns a copy of the file system whose reads return once ctx is done
+func (f *FS) WithContext(ctx context.Context) *FS {
+	other := *f
+	other.ctx = ctx
+	return &other
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.dir {
+		return &dir{info: info, entries: f.dirs[name]}, nil
+	}
+
+	mf, err := f.tm.OpenFileContext(f.ctx, f.files[name].Path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{File: mf, info: info}, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := f.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return append([]fs.DirEntry{}, f.dirs[name]...), nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+func (f *FS) stat(op, name string) (*fileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if span, ok := f.files[name]; ok {
+		return &fileInfo{name: path.Base(name), size: span.Length}, nil
+	}
+	if _, ok := f.dirs[name]; ok {
+		return &fileInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return time.Time{} }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() interface{}   { return nil }
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// file is a file of the torrent. It can seek and read at offsets like the manager.File it wraps.
+type file struct {
+	*manager.File
+	info *fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// dir is a directory of the torrent
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	left := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return append([]fs.DirEntry{}, left...), nil
+	}
+	if len(left) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(left) {
+		n = len(left)
+	}
+	d.offset += n
+	return append([]fs.DirEntry{}, left[:n]...), nil
+}
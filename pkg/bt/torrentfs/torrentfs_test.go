@@ -0,0 +1,129 @@
+package torrentfs
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/manager"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+// completeDownload writes the files of a torrent to a directory together with resume data that claims
+// all of the pieces, so that the download starts without any peers
+func completeDownload(t *testing.T, pieceLength int, files map[string]string, order ...string) (*manager.TorrentManager, *types.Torrent) {
+	torrent := &types.Torrent{Name: "fs", PieceLength: pieceLength}
+	var data []byte
+	for _, name := range order {
+		torrent.Files = append(torrent.Files, &types.FileInfo{Length: len(files[name]), Paths: strings.Split(name, "/")})
+		data = append(data, files[name]...)
+	}
+	torrent.Length = len(data)
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[i:end])
+		torrent.PieceHashes = append(torrent.PieceHashes, string(hash[:]))
+	}
+
+	dst := t.TempDir()
+	resume := manager.NewResumeData(torrent)
+	spans, err := torrent.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, span := range spans {
+		p, err := storage.FilePath(torrent, dst, span)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(files[order[i]]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resume.Files = append(resume.Files, manager.FileState{Path: p, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	for i := 0; i < torrent.GetPieceCount(); i++ {
+		resume.Pieces.Set(i)
+	}
+	if err := resume.Save(manager.ResumePath(dst)); err != nil {
+		t.Fatal(err)
+	}
+
+	tm := &manager.TorrentManager{}
+	if err := tm.Start(context.Background(), torrent, dst); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tm.Stop() })
+	return tm, torrent
+}
+
+func TestFS(t *testing.T) {
+	files := map[string]string{
+		"readme":          "hello torrent",
+		"docs/a.txt":      "aaaaaaaaaa",
+		"docs/empty":      "",
+		"docs/more/b.txt": "bbbbbbbbbbbbbbbbbbbbb",
+	}
+	tm, torrent := completeDownload(t, 8, files, "readme", "docs/a.txt", "docs/empty", "docs/more/b.txt")
+	fsys, err := New(tm, torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fstest.TestFS(fsys, "readme", "docs/a.txt", "docs/empty", "docs/more/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fsys.ReadDir("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 3 || names[0] != "a.txt" || names[1] != "empty" || names[2] != "more" || !entries[2].IsDir() {
+		t.Errorf("unexpected entries in docs: %v", names)
+	}
+
+	data, err := fs.ReadFile(fsys, "docs/more/b.txt")
+	if err != nil || string(data) != files["docs/more/b.txt"] {
+		t.Errorf("expected %q got %q %v", files["docs/more/b.txt"], data, err)
+	}
+	if _, err := fsys.Stat("docs/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v got %v", fs.ErrNotExist, err)
+	}
+}
+
+func TestFSSingleFile(t *testing.T) {
+	torrent := &types.Torrent{Name: "single", PieceLength: 4, Length: 6}
+	fsys, err := New(&manager.TorrentManager{}, torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fsys.Stat("single")
+	if err != nil || info.Size() != 6 || info.IsDir() {
+		t.Fatalf("unexpected info %v %v", info, err)
+	}
+	// the contents need a download that was started
+	if _, err := fsys.Open("single"); !errors.Is(err, manager.ErrNotStarted) {
+		t.Fatalf("expected %v got %v", manager.ErrNotStarted, err)
+	}
+}
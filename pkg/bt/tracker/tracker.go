@@ -2,24 +2,60 @@ package tracker
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"time"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/proxy"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
 )
 
+// Event tells the tracker why we announce. Regular announces have no event.
+type Event string
+
+const (
+	// Started is sent with the first announce of a download
+	Started Event = "started"
+	// Completed is sent when the download completes
+	Completed Event = "completed"
+	// Stopped is sent when the download stops, so the tracker stops handing us out to other peers
+	Stopped Event = "stopped"
+)
+
 type TrackerClient struct {
-	client *http.Client
+	// Logger is where announces are logged, the default logger is used when it is nil
+	Logger *slog.Logger
+	// Dialer makes the connections to trackers, like through a proxy or from a local address. They are
+	// made directly when it is nil. Set it before announcing.
+	Dialer proxy.Dialer
+	// TLSConfig is used for https trackers, like for private CAs and client certificates. The system
+	// defaults are used when it is nil. Set it before announcing.
+	TLSConfig *tls.Config
+	// HTTPClient sends the announces. NewClient sets up one that uses Dialer and TLSConfig, a client set
+	// instead is used as it is.
+	HTTPClient *http.Client
+
+	// IP, Key and NumWant are sent with every announce that doesn't set them itself. IP is the address
+	// peers should connect to when it isn't the one the announce comes from, Key lets the tracker know
+	// us when our address changes and NumWant is how many peers we want. Empty values are left out.
+	IP      string
+	Key     string
+	NumWant int
 }
 
 type TrackerRequest interface {
-	HTTPRequest() (*http.Request, error)
+	HTTPRequest(ctx context.Context) (*http.Request, error)
 }
 
 type PeersRequest struct {
@@ -46,6 +82,12 @@ type PeersRequest struct {
 	// For the purposes of this challenge, set this to 1.
 	// The compact representation is more commonly used in the wild, the non-compact representation is mostly supported for backward-compatibility.
 	Compact int
+	// event: why we announce, left out for regular announces
+	Event Event
+	// ip, key and numwant: see TrackerClient, left out when empty
+	IP      string
+	Key     string
+	NumWant int
 }
 
 type PeersResponse struct {
@@ -53,16 +95,60 @@ type PeersResponse struct {
 	Peers    []*types.Peer
 }
 
+// NewClient returns a client that announces with a random key
 func NewClient() *TrackerClient {
-	return &TrackerClient{
-		client: &http.Client{
-			CheckRedirect: nil, Jar: nil,
-			Timeout: 30 * time.Second,
-		},
+	t := &TrackerClient{Key: randomKey()}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// proxies come from Dialer, not the environment
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return proxy.Direct(t.Dialer).DialContext(ctx, network, addr)
 	}
+	transport.DialTLSContext = t.dialTLS
+	t.HTTPClient = &http.Client{
+		CheckRedirect: nil, Jar: nil,
+		Transport: transport,
+		Timeout:   30 * time.Second,
+	}
+	return t
 }
 
-func newPeerRequest(peerID string, port int, m *types.Torrent) (*PeersRequest, error) {
+// dialTLS connects to an https tracker with Dialer and TLSConfig
+func (t *TrackerClient) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := proxy.Direct(t.Dialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if t.TLSConfig != nil {
+		cfg = t.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// randomKey returns a key for announces, 8 hex characters like most clients send
+func randomKey() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewPeersRequest returns the request for the first announce of the torrent, before anything has been
+// downloaded
+func NewPeersRequest(peerID string, port int, m *types.Torrent) *PeersRequest {
 	return &PeersRequest{
 		Announce: m.Announce,
 		PeerID:   peerID,
@@ -70,19 +156,30 @@ func newPeerRequest(peerID string, port int, m *types.Torrent) (*PeersRequest, e
 		InfoHash: m.Hash,
 		Left:     m.Length,
 		Compact:  1,
-	}, nil
-
+	}
 }
 
-func (p *PeersRequest) HTTPRequest() (*http.Request, error) {
+func (p *PeersRequest) HTTPRequest(ctx context.Context) (*http.Request, error) {
 	reqValues := url.Values{}
 	reqValues.Set("info_hash", string(p.InfoHash[:]))
 	reqValues.Set("peer_id", p.PeerID)
 	reqValues.Set("port", fmt.Sprintf("%d", p.Port))
-	reqValues.Set("uploaded", "0")
-	reqValues.Set("downloaded", "0")
+	reqValues.Set("uploaded", fmt.Sprintf("%.0f", p.Uploaded))
+	reqValues.Set("downloaded", fmt.Sprintf("%.0f", p.Downloaded))
 	reqValues.Set("left", fmt.Sprintf("%d", p.Left))
 	reqValues.Set("compact", fmt.Sprintf("%d", p.Compact))
+	if p.Event != "" {
+		reqValues.Set("event", string(p.Event))
+	}
+	if p.IP != "" {
+		reqValues.Set("ip", p.IP)
+	}
+	if p.Key != "" {
+		reqValues.Set("key", p.Key)
+	}
+	if p.NumWant > 0 {
+		reqValues.Set("numwant", fmt.Sprintf("%d", p.NumWant))
+	}
 
 	trackerURL, err := url.Parse(p.Announce)
 	if err != nil {
@@ -90,19 +187,18 @@ func (p *PeersRequest) HTTPRequest() (*http.Request, error) {
 	}
 	trackerURL.RawQuery = reqValues.Encode()
 
-	fmt.Println(trackerURL.String())
-
-	return http.NewRequest("GET", trackerURL.String(), nil)
+	return http.NewRequestWithContext(ctx, "GET", trackerURL.String(), nil)
 }
 
-func (t *TrackerClient) peersRequest(treq TrackerRequest) (*PeersResponse, error) {
-	req, err := treq.HTTPRequest()
+func (t *TrackerClient) peersRequest(ctx context.Context, treq TrackerRequest) (*PeersResponse, error) {
+	req, err := treq.HTTPRequest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("http request creation failure: %v", err)
 	}
 
-	resp, err := t.client.Do(req)
-	if err != err {
+	bt.Logger(t.Logger).Debug("announcing", "url", req.URL.Redacted())
+	resp, err := t.HTTPClient.Do(req)
+	if err != nil {
 		return nil, err
 	}
 
@@ -167,7 +263,12 @@ func decodePeersResponse(d []byte) (*PeersResponse, error) {
 	peers := []*types.Peer{}
 	var readErr error
 	for readErr != io.EOF && readErr == nil {
-		_, readErr = buf.Read(section[:])
+		var n int
+		n, readErr = buf.Read(section[:])
+		if n < len(section) {
+			// the last read hits the end of the peers, which is not a peer
+			continue
+		}
 
 		// We use BigEndian and binary here because:
 		// - by convention that is network layout of bytes
@@ -190,18 +291,32 @@ func decodePeersResponse(d []byte) (*PeersResponse, error) {
 
 }
 
-func (t *TrackerClient) GetPeers(peerID string, port int, torrent *types.Torrent) (*types.PeerSpec, error) {
-	req, err := newPeerRequest(peerID, port, torrent)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create peer request: %v", err)
+// GetPeers announces that the download started and returns the peers the tracker knows of
+func (t *TrackerClient) GetPeers(ctx context.Context, peerID string, port int, torrent *types.Torrent) (*types.PeerSpec, error) {
+	req := NewPeersRequest(peerID, port, torrent)
+	req.Event = Started
+	return t.Announce(ctx, req, torrent)
+}
+
+// Announce sends the request to the tracker of the torrent, trying the trackers of the announce list
+// when it fails
+func (t *TrackerClient) Announce(ctx context.Context, req *PeersRequest, torrent *types.Torrent) (*types.PeerSpec, error) {
+	if req.IP == "" {
+		req.IP = t.IP
+	}
+	if req.Key == "" {
+		req.Key = t.Key
+	}
+	if req.NumWant == 0 {
+		req.NumWant = t.NumWant
 	}
-	resp, err := t.peersRequest(req)
+	resp, err := t.peersRequest(ctx, req)
 	if err != nil {
 		// TODO(burmudar): look into using this more
 		if len(torrent.AnnounceList) > 0 {
 			for i := 0; i < len(torrent.AnnounceList) && (resp == nil && err != nil); i++ {
 				req.Announce = torrent.AnnounceList[i]
-				resp, err = t.peersRequest(req)
+				resp, err = t.peersRequest(ctx, req)
 				// } else {
 				// 	fmt.Printf("udp tracke request not supported: %s\n", torrent.AnnounceList[i])
 				// }
@@ -0,0 +1,54 @@
+package tracker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/types"
+)
+
+func TestAnnounceOverTLSWithClientSettings(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer srv.Close()
+
+	torrent := &types.Torrent{Announce: srv.URL, Length: 10}
+	client := NewClient()
+	client.IP = "10.0.0.1"
+	client.NumWant = 50
+
+	// the certificate of the test server is only trusted with the TLS config
+	if _, err := client.GetPeers(context.Background(), "00112233445566778899", 6881, torrent); err == nil {
+		t.Fatalf("expected the announce to fail without the CA of the tracker")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	client.TLSConfig = &tls.Config{RootCAs: pool}
+	peers, err := client.GetPeers(context.Background(), "00112233445566778899", 6881, torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers.Peers) != 1 || peers.Peers[0].String() != "127.0.0.1:6881" {
+		t.Fatalf("expected the peer of the tracker got %v", peers.Peers)
+	}
+
+	q := <-queries
+	want := map[string]string{"ip": "10.0.0.1", "key": client.Key, "numwant": "50", "event": string(Started)}
+	for k, v := range want {
+		if got := q.Get(k); got != v {
+			t.Errorf("expected %s=%q got %q", k, v, got)
+		}
+	}
+	if len(client.Key) != 8 {
+		t.Errorf("expected a random 8 character key got %q", client.Key)
+	}
+}
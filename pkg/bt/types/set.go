@@ -28,6 +28,12 @@ func (s *SyncSet[K]) All() []K {
 	return s.BasicSet.All()
 }
 
+func (s *SyncSet[K]) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.BasicSet.Len()
+}
+
 func (s *SyncSet[K]) Put(v K) {
 	s.Lock()
 	defer s.Unlock()
@@ -63,7 +69,9 @@ func NewSet[K comparable]() Set[K] {
 }
 
 func NewSyncSet[K comparable]() Set[K] {
-	return &SyncSet[K]{}
+	return &SyncSet[K]{
+		BasicSet: BasicSet[K]{items: make(map[K]struct{})},
+	}
 }
 
 func (s *BasicSet[K]) All() []K {
@@ -3,12 +3,15 @@ package types
 import (
 	"fmt"
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt"
 )
 
+var ErrInvalidPath = fmt.Errorf("invalid file path in torrent")
+
 type FileInfo struct {
 	Length int
 	Paths  []string
@@ -50,7 +53,6 @@ type Piece struct {
 
 func ParsePeer(v string) (*Peer, error) {
 	parts := strings.Split(v, ":")
-	println(v)
 
 	if len(parts) < 1 {
 		return nil, fmt.Errorf("malformed peer value - expected IP:PORT format, got %s", v)
@@ -86,17 +88,96 @@ func (m *Torrent) InfoDict() map[string]interface{} {
 			"pieces":       strings.Join(m.PieceHashes, ""),
 		}
 	} else {
+		files := []interface{}{}
+		for _, f := range m.Files {
+			paths := []interface{}{}
+			for _, p := range f.Paths {
+				paths = append(paths, p)
+			}
+			files = append(files, map[string]interface{}{
+				"length": f.Length,
+				"path":   paths,
+			})
+		}
 		info = map[string]interface{}{
 			"name":         m.Name,
 			"piece length": m.PieceLength,
 			"pieces":       strings.Join(m.PieceHashes, ""),
-			"files":        m.Files,
+			"files":        files,
 		}
 	}
 
 	return info
 }
 
+// Private reports whether the torrent is private (BEP 27). Peers of a private torrent come from its
+// trackers only, never from the DHT.
+func (m *Torrent) Private() bool {
+	return m.RawInfo["private"] == 1
+}
+
+// FileSpan is a file of the torrent and where its data lives when all the files are laid out back to
+// back, which is how pieces are hashed
+type FileSpan struct {
+	// Path is the path of the file relative to the download directory. Single file torrents have a
+	// single span with the torrent name as path.
+	Path   string
+	Offset int64
+	Length int64
+}
+
+// Layout returns the files of the torrent in the order their data appears in the pieces. The paths come
+// from the torrent, so a path that would end up outside of the download directory is rejected with
+// ErrInvalidPath.
+func (m *Torrent) Layout() ([]FileSpan, error) {
+	if len(m.Files) == 0 {
+		if err := validPathPart(m.Name); err != nil {
+			return nil, err
+		}
+		return []FileSpan{{Path: m.Name, Length: int64(m.Length)}}, nil
+	}
+
+	spans := make([]FileSpan, 0, len(m.Files))
+	var offset int64
+	for _, f := range m.Files {
+		if len(f.Paths) == 0 {
+			return nil, fmt.Errorf("%w: file without a path", ErrInvalidPath)
+		}
+		for _, part := range f.Paths {
+			if err := validPathPart(part); err != nil {
+				return nil, err
+			}
+		}
+		spans = append(spans, FileSpan{
+			Path:   filepath.Join(f.Paths...),
+			Offset: offset,
+			Length: int64(f.Length),
+		})
+		offset += int64(f.Length)
+	}
+	return spans, nil
+}
+
+// validPathPart checks a single part of a file path in the torrent, which has to name a file or directory
+// inside the directory above it
+func validPathPart(part string) error {
+	if part == "" || part == "." || part == ".." || strings.ContainsRune(part, '/') ||
+		strings.ContainsRune(part, filepath.Separator) || filepath.IsAbs(part) || filepath.VolumeName(part) != "" {
+		return fmt.Errorf("%w: %q", ErrInvalidPath, part)
+	}
+	return nil
+}
+
+// PieceRange returns the first and last piece holding data of the file. Empty files have no pieces, in
+// which case last is smaller than first.
+func (m *Torrent) PieceRange(f FileSpan) (first, last int) {
+	if f.Length == 0 {
+		return 0, -1
+	}
+	pieceLength := int64(m.PieceLength)
+	return int(f.Offset / pieceLength), int((f.Offset + f.Length - 1) / pieceLength)
+}
+
 func (m *Torrent) GetPieceCount() int {
 	return len(m.PieceHashes)
 }
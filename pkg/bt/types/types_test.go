@@ -1,6 +1,7 @@
 package types_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bt/encoding"
@@ -70,3 +71,33 @@ func TestBlocks(t *testing.T) {
 	}
 
 }
+
+func TestLayoutRejectsInvalidPaths(t *testing.T) {
+	tt := []struct {
+		name  string
+		paths []string
+	}{
+		{"parent directory", []string{"..", "etc", "passwd"}},
+		{"parent directory inside", []string{"a", "..", "..", "b"}},
+		{"absolute", []string{"/etc", "passwd"}},
+		{"separator in part", []string{"a/../../b"}},
+		{"empty part", []string{"a", "", "b"}},
+		{"no parts", []string{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			torrent := &types.Torrent{Name: "test", Files: []*types.FileInfo{
+				{Length: 1, Paths: []string{"ok"}},
+				{Length: 1, Paths: tc.paths},
+			}}
+			if _, err := torrent.Layout(); !errors.Is(err, types.ErrInvalidPath) {
+				t.Errorf("expected %v got %v", types.ErrInvalidPath, err)
+			}
+		})
+	}
+
+	single := &types.Torrent{Name: "..", Length: 1}
+	if _, err := single.Layout(); !errors.Is(err, types.ErrInvalidPath) {
+		t.Errorf("expected %v for a single file named .. got %v", types.ErrInvalidPath, err)
+	}
+}
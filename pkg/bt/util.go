@@ -16,6 +16,14 @@ func Min(a, b int) int {
 	return b
 }
 
+// Min64 returns the smaller of two int64s
+func Min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // Ceil performs integer division and always rounds up
 // It performs a + b - 1 / b since that is faster than
 // than converting it to floats for math.Ceil